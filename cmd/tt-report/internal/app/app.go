@@ -4,27 +4,50 @@ Copyright © 2024 ain ghazal <ain@openobservatory.org>
 package app
 
 import (
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-var (
-	// TODO: pass report from json file in disk.
-	reportFile string
-)
-
 type flag int
 
 const (
-	flagDebug flag = iota
+	flagAPIKey flag = iota
+	flagCollector
+	flagConfig
+	flagDebug
+	flagDryRun
+	flagDuration
+	flagEndpoint
+	flagFailureError
+	flagFailureOp
+	flagFanOut
+	flagOutbox
 	flagSkipGeolocation
+	flagTime
+	flagTimeout
 )
 
 var allFlags = map[flag]string{
+	flagAPIKey:          "api-key",
+	flagCollector:       "collector",
+	flagConfig:          "config",
 	flagDebug:           "debug",
+	flagDryRun:          "dry-run",
+	flagDuration:        "duration",
+	flagEndpoint:        "endpoint",
+	flagFailureError:    "failure-error",
+	flagFailureOp:       "failure-op",
+	flagFanOut:          "fan-out",
+	flagOutbox:          "outbox",
 	flagSkipGeolocation: "skip-geolocation",
+	flagTime:            "time",
+	flagTimeout:         "timeout",
 }
 
 func (f flag) String() string {
@@ -35,27 +58,74 @@ func (f flag) String() string {
 }
 
 type config struct {
+	APIKey          string
+	Collectors      []string
+	Config          []string
 	Debug           bool
+	DryRun          bool
+	Duration        time.Duration
+	Endpoint        string
+	FailureError    string
+	FailureOp       string
+	FanOut          bool
+	Outbox          string
 	SkipGeolocation bool
+	Time            string
+	Timeout         time.Duration
 }
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   "tt-server",
-	Short: "Run a tunnel-telemetry collector server",
-	Long: `Tunnel-telemetry collector server.
-
-A collector server receives reports from tunnel clients,
-and optionally stores them and/or relays them to an upstream collector.`,
+	Use:   "tt-report [FILE...]",
+	Short: "Submit tunnel-telemetry reports to a collector",
+	Long: `Submit tunnel-telemetry reports to a collector.
+
+Reports are read from the files (JSON, a JSON array or NDJSON), or from
+stdin if there are no files (or the file is -). With --endpoint, a single
+report is built from the flags instead:
+
+  tt-report --collector https://collector.example.org \
+    --endpoint ss://1.1.1.1:443 --duration 2s \
+    --failure-op tcp_connect --failure-error connection_refused
+
+Every report is validated before submitting any of them. With --outbox,
+the reports that no collector could take are kept, and sent later with
+the flush command.`,
+	// the arguments are files, not subcommands.
+	Args: cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		cfg := &config{
-			Debug:           viper.GetBool(flagDebug.String()),
-			SkipGeolocation: viper.GetBool(flagSkipGeolocation.String()),
+		cfg := loadConfig()
+		if len(cfg.Collectors) == 0 && !cfg.DryRun {
+			fmt.Println("ERROR: empty --collector")
+			os.Exit(1)
+		}
+		if err := processAndSubmitReports(cfg, args); err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
 		}
-		processAndSubmitReport(cfg)
 	},
 }
 
+// loadConfig returns the config from the flags and the environment.
+func loadConfig() *config {
+	return &config{
+		APIKey:          viper.GetString(flagAPIKey.String()),
+		Collectors:      viper.GetStringSlice(flagCollector.String()),
+		Config:          viper.GetStringSlice(flagConfig.String()),
+		Debug:           viper.GetBool(flagDebug.String()),
+		DryRun:          viper.GetBool(flagDryRun.String()),
+		Duration:        viper.GetDuration(flagDuration.String()),
+		Endpoint:        viper.GetString(flagEndpoint.String()),
+		FailureError:    viper.GetString(flagFailureError.String()),
+		FailureOp:       viper.GetString(flagFailureOp.String()),
+		FanOut:          viper.GetBool(flagFanOut.String()),
+		Outbox:          viper.GetString(flagOutbox.String()),
+		SkipGeolocation: viper.GetBool(flagSkipGeolocation.String()),
+		Time:            viper.GetString(flagTime.String()),
+		Timeout:         viper.GetDuration(flagTimeout.String()),
+	}
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -68,8 +138,20 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 
-	rootCmd.Flags().BoolP(flagDebug.String(), "d", false, "set debug level in logs")
-	rootCmd.Flags().BoolP(flagSkipGeolocation.String(), "", false, "skip geolocation using stun/https apis")
+	rootCmd.PersistentFlags().StringP(flagAPIKey.String(), "", "", "key for collectors that only accept reports from known applications")
+	rootCmd.PersistentFlags().StringSliceP(flagCollector.String(), "", nil, "URLs of the collectors, in order of preference (e.g. https://collector.example.org)")
+	rootCmd.Flags().StringArrayP(flagConfig.String(), "", nil, "connection config for the report, as key=value (can be repeated)")
+	rootCmd.PersistentFlags().BoolP(flagDebug.String(), "d", false, "set debug level in logs")
+	rootCmd.Flags().BoolP(flagDryRun.String(), "", false, "validate and print the reports, without submitting them")
+	rootCmd.Flags().DurationP(flagDuration.String(), "", 0, "how long the connection attempt took (e.g. 1.5s)")
+	rootCmd.Flags().StringP(flagEndpoint.String(), "", "", "build a report for this endpoint (e.g. ss://1.1.1.1:443), instead of reading reports")
+	rootCmd.Flags().StringP(flagFailureError.String(), "", "", "the error, if the connection failed")
+	rootCmd.Flags().StringP(flagFailureOp.String(), "", "", "the operation that failed, if the connection failed (one of: "+strings.Join(model.Ops(), ", ")+")")
+	rootCmd.PersistentFlags().BoolP(flagFanOut.String(), "", false, "submit every report to all the collectors, instead of only the first that accepts it")
+	rootCmd.PersistentFlags().StringP(flagOutbox.String(), "", "", "dir to keep the reports that could not be submitted, until the next flush (disabled if empty)")
+	rootCmd.PersistentFlags().BoolP(flagSkipGeolocation.String(), "", false, "skip geolocation using stun/https apis")
+	rootCmd.Flags().StringP(flagTime.String(), "", "", "when the connection attempt started, in RFC 3339 (default: now)")
+	rootCmd.PersistentFlags().DurationP(flagTimeout.String(), "", 10*time.Second, "timeout for submitting each report to each collector")
 }
 
 // initConfig reads config file and any relevant ENV variables if set.
@@ -77,7 +159,11 @@ func initConfig() {
 	viper.AutomaticEnv() // read any environment variables that match
 
 	for _, flg := range allFlags {
-		viper.BindPFlag(flg, rootCmd.Flags().Lookup(flg))
+		f := rootCmd.Flags().Lookup(flg)
+		if f == nil {
+			f = rootCmd.PersistentFlags().Lookup(flg)
+		}
+		viper.BindPFlag(flg, f)
 	}
 
 	/*
@@ -1,26 +1,193 @@
 package app
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/ainghazal/tunnel-telemetry/internal/client"
-	"github.com/ainghazal/tunnel-telemetry/pkg/geolocate"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
 )
 
-func processAndSubmitReport(cfg *config) error {
-	if cfg.SkipGeolocation {
-		log.Println("Skipping geolocation")
+// processAndSubmitReports reads the reports in the files (or builds one from the flags),
+// validates them, and submits them to the collector.
+func processAndSubmitReports(cfg *config, files []string) error {
+	setupLogging(cfg)
+
+	var mm []*model.Measurement
+	var err error
+	if cfg.Endpoint != "" {
+		if len(files) != 0 {
+			return errors.New("cannot use --endpoint with files")
+		}
+		var m *model.Measurement
+		m, err = buildReport(cfg)
+		mm = []*model.Measurement{m}
 	} else {
-		geo, err := geolocate.FindCurrentHostGeolocation()
-		if err != nil {
+		mm, err = readReports(files)
+	}
+	if err != nil {
+		return err
+	}
+	if len(mm) == 0 {
+		return errors.New("no reports")
+	}
+
+	// we do not submit anything unless all the reports are valid. Failures are mapped to
+	// the same vocabulary that the collector uses.
+	for i, m := range mm {
+		m.Normalize()
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("report %d: %w", i+1, err)
+		}
+	}
+
+	if cfg.DryRun {
+		return printReports(mm)
+	}
+
+	c := newClient(cfg)
+	if err := c.Geolocate(); err != nil {
+		// the collector geolocates the reports without an ASN.
+		slog.Warn("cannot geolocate", "error", err)
+	}
+	var outbox *client.Outbox
+	if cfg.Outbox != "" {
+		if outbox, err = client.NewOutbox(cfg.Outbox); err != nil {
 			return err
 		}
-		log.Println("ASN", geo.ASN)
-		log.Println("CC", geo.CC)
+		outbox.ClientASN, outbox.ClientCC = c.ClientASN, c.ClientCC
 	}
+	failed := 0
+	for i, m := range mm {
+		res, err := c.Submit(context.Background(), m)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "report %d: %s\n", i+1, err)
+			failed++
+			if outbox != nil && !errors.Is(err, client.ErrRejected) {
+				// we'll try again on the next flush.
+				if err := outbox.Add(m); err != nil {
+					slog.Warn("cannot keep report in the outbox", "report", i+1, "error", err)
+				} else {
+					slog.Info("report kept in the outbox", "report", i+1, "uuid", m.UUID)
+				}
+			}
+			continue
+		}
+		for _, attempt := range res.Attempts {
+			if attempt.Err != nil {
+				slog.Warn("report not accepted", "report", i+1, "error", attempt.Err)
+			}
+		}
+		if res.OONILink != "" {
+			fmt.Println(res.Report.UUID, res.OONILink)
+		} else {
+			fmt.Println(res.Report.UUID)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d reports not submitted", failed, len(mm))
+	}
+	return nil
+}
+
+// setupLogging sends the logs to stderr, so that stdout only has the results.
+func setupLogging(cfg *config) {
+	level := slog.LevelInfo
+	if cfg.Debug {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+}
 
-	_ = client.Client{}
+func newClient(cfg *config) *client.Client {
+	return &client.Client{
+		DoGeolocation: !cfg.SkipGeolocation,
+		Collectors:    cfg.Collectors,
+		FanOut:        cfg.FanOut,
+		Timeout:       cfg.Timeout,
+		APIKey:        cfg.APIKey,
+	}
+}
 
-	// c.Submit()
+// buildReport builds a report from the flags.
+func buildReport(cfg *config) (*model.Measurement, error) {
+	m := model.NewMeasurement()
+	m.Type = "tunnel-telemetry"
+	m.Endpoint = cfg.Endpoint
+	m.DurationMS = cfg.Duration.Milliseconds()
+
+	start := time.Now().UTC()
+	if cfg.Time != "" {
+		var err error
+		if start, err = time.Parse(time.RFC3339, cfg.Time); err != nil {
+			return nil, fmt.Errorf("bad --time: %w", err)
+		}
+	} else if cfg.Duration > 0 {
+		// the connection attempt has just finished.
+		start = start.Add(-cfg.Duration)
+	}
+	m.TimeStart = &start
+
+	if cfg.FailureOp != "" || cfg.FailureError != "" {
+		m.Failure = &model.Failure{Op: cfg.FailureOp, Error: cfg.FailureError}
+	}
+
+	for _, kv := range cfg.Config {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad --config %q: expected key=value", kv)
+		}
+		if m.Config == nil {
+			m.Config = make(map[string]string)
+		}
+		m.Config[key] = value
+	}
+	return m, nil
+}
+
+// readReports reads the reports in the files, or in stdin if there are no files.
+func readReports(files []string) ([]*model.Measurement, error) {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var mm []*model.Measurement
+	for _, name := range files {
+		read, err := readReportFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		mm = append(mm, read...)
+	}
+	return mm, nil
+}
+
+func readReportFile(name string) ([]*model.Measurement, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return client.ReadMeasurements(r)
+}
+
+// printReports writes the reports to stdout, as NDJSON.
+func printReports(mm []*model.Measurement) error {
+	enc := json.NewEncoder(os.Stdout)
+	for _, m := range mm {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
 	return nil
 }
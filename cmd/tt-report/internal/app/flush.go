@@ -0,0 +1,56 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/client"
+	"github.com/spf13/cobra"
+)
+
+// flushCmd submits the reports in the outbox.
+var flushCmd = &cobra.Command{
+	Use:   "flush",
+	Short: "Submit the reports in the outbox",
+	Long: `Submit the reports in the outbox, in batches.
+
+Reports that a collector accepts or rejects are removed from the outbox;
+the rest are kept until the next flush, unless they get too old for the
+collectors to accept them.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := loadConfig()
+		if err := flushOutbox(cfg); err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(flushCmd)
+}
+
+func flushOutbox(cfg *config) error {
+	setupLogging(cfg)
+	if cfg.Outbox == "" {
+		return errors.New("empty --outbox")
+	}
+	if len(cfg.Collectors) == 0 {
+		return errors.New("empty --collector")
+	}
+	outbox, err := client.NewOutbox(cfg.Outbox)
+	if err != nil {
+		return err
+	}
+	// the reports were stamped with the network they were measured from, if it was
+	// known when they were added. We might be on another network now, so we do not
+	// geolocate; the collector geolocates the reports that have no network.
+	res, err := outbox.Flush(context.Background(), newClient(cfg))
+	if res != nil {
+		fmt.Printf("submitted: %d, rejected: %d, expired: %d, pending: %d\n", res.Submitted, res.Rejected, res.Expired, res.Pending)
+	}
+	return err
+}
@@ -4,46 +4,126 @@ Copyright © 2024 ain ghazal <ain@openobservatory.org>
 package app
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/logging"
+	"github.com/ainghazal/tunnel-telemetry/internal/privacy"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
 	cfgFile           string
+	configFileLoaded  bool
 	defaultConfigFile = "/etc/tunneltelemetry/config.yaml"
 	defaultCacheDir   = "/var/www/.cache"
+	defaultDataDir    = "/var/lib/tunneltelemetry"
 	defaultHTTPAddr   = ":8080"
 	defaultHTTPSAddr  = ":443"
+
+	// configKeyAPIKeys is the list of keys in the config file. It has no flag.
+	configKeyAPIKeys = "api-keys"
 )
 
 type flag int
 
 const (
-	flagAllowPublicEndpoint flag = iota
+	flagAggregateWindow flag = iota
+	flagAllowPublicEndpoint
 	flagAutoTLS
 	flagAutoTLSCacheDir
+	flagBanDuration
+	flagBanThreshold
+	flagBatchMaxReports
+	flagBatchMaxSizeKB
 	flagCollectorID
+	flagDataDir
 	flagDebug
 	flagDebugGeolocation
 	flagHostname
+	flagHTTPListen
+	flagKeyFile
 	flagListenAddr
+	flagLogFormat
+	flagLogRedact
+	flagMetricsListen
 	flagDisableOONIRelay
+	flagPrivacyK
+	flagPrivacyPolicy
+	flagPrivacyWindow
+	flagProxyProtocol
+	flagQueryToken
+	flagRateLimitASN
+	flagRateLimitIP
+	flagReadyMaxRelayQueue
+	flagReadyMaxUpstreamOutage
+	flagRelayBacklog
+	flagRelayMaxAttempts
+	flagRelayMode
+	flagRelayReportMaxAge
+	flagRelayWorkers
+	flagReportMaxSizeKB
+	flagRotateSizeMB
+	flagStorageBackend
+	flagStrictDecoding
+	flagTLSCertFile
+	flagTLSClientAuth
+	flagTLSClientCA
+	flagTLSClientCertAuth
+	flagTLSKeyFile
+	flagTrustedProxies
 )
 
 var allFlags = map[flag]string{
-	flagAllowPublicEndpoint: "allow-public-endpoint",
-	flagAutoTLS:             "autotls",
-	flagAutoTLSCacheDir:     "autotls-cache-dir",
-	flagCollectorID:         "collector-id",
-	flagDebug:               "debug",
-	flagDebugGeolocation:    "debug-geolocation",
-	flagHostname:            "hostname",
-	flagListenAddr:          "listen",
-	flagDisableOONIRelay:    "no-ooni-relay",
+	flagAggregateWindow:        "aggregate-window",
+	flagAllowPublicEndpoint:    "allow-public-endpoint",
+	flagAutoTLS:                "autotls",
+	flagAutoTLSCacheDir:        "autotls-cache-dir",
+	flagBanDuration:            "ban-duration",
+	flagBanThreshold:           "ban-threshold",
+	flagBatchMaxReports:        "batch-max-reports",
+	flagBatchMaxSizeKB:         "batch-max-size-kb",
+	flagCollectorID:            "collector-id",
+	flagDataDir:                "data-dir",
+	flagDebug:                  "debug",
+	flagDebugGeolocation:       "debug-geolocation",
+	flagHostname:               "hostname",
+	flagHTTPListen:             "http-listen",
+	flagKeyFile:                "key-file",
+	flagListenAddr:             "listen",
+	flagLogFormat:              "log-format",
+	flagLogRedact:              "log-redact",
+	flagMetricsListen:          "metrics-listen",
+	flagDisableOONIRelay:       "no-ooni-relay",
+	flagPrivacyK:               "privacy-k",
+	flagPrivacyPolicy:          "privacy-policy",
+	flagPrivacyWindow:          "privacy-window",
+	flagProxyProtocol:          "proxy-protocol",
+	flagQueryToken:             "query-token",
+	flagRateLimitASN:           "rate-limit-asn",
+	flagRateLimitIP:            "rate-limit-ip",
+	flagReadyMaxRelayQueue:     "ready-max-relay-queue",
+	flagReadyMaxUpstreamOutage: "ready-max-upstream-outage",
+	flagRelayBacklog:           "relay-backlog",
+	flagRelayMaxAttempts:       "relay-max-attempts",
+	flagRelayMode:              "relay-mode",
+	flagRelayReportMaxAge:      "relay-report-max-age",
+	flagRelayWorkers:           "relay-workers",
+	flagReportMaxSizeKB:        "report-max-size-kb",
+	flagRotateSizeMB:           "rotate-size-mb",
+	flagStorageBackend:         "storage",
+	flagStrictDecoding:         "strict-decoding",
+	flagTLSCertFile:            "tls-cert",
+	flagTLSClientAuth:          "tls-client-auth",
+	flagTLSClientCA:            "tls-client-ca",
+	flagTLSClientCertAuth:      "tls-client-cert-auth",
+	flagTLSKeyFile:             "tls-key",
+	flagTrustedProxies:         "trusted-proxies",
 }
 
 func (f flag) String() string {
@@ -62,33 +142,155 @@ var rootCmd = &cobra.Command{
 A collector server receives reports from tunnel clients,
 and optionally stores them and/or relays them to an upstream collector.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		cfg := &config.Config{
-			AllowPublicEndpoint: viper.GetBool(flagAllowPublicEndpoint.String()),
-			AutoTLS:             viper.GetBool(flagAutoTLS.String()),
-			AutoTLSCacheDir:     viper.GetString(flagAutoTLSCacheDir.String()),
-			CollectorID:         viper.GetString(flagCollectorID.String()),
-			Debug:               viper.GetBool(flagDebug.String()),
-			DebugGeolocation:    viper.GetBool(flagDebugGeolocation.String()),
-			Hostname:            viper.GetString(flagHostname.String()),
-			ListenAddr:          viper.GetString(flagListenAddr.String()),
-			RelayToOONI:         !viper.GetBool(flagDisableOONIRelay.String()),
+		cfg, err := loadConfig()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
 		}
+		startEchoServer(cfg)
+	},
+}
 
-		if cfg.AutoTLS && cfg.Hostname == "" {
-			fmt.Println("ERROR: empty --hostname")
-			os.Exit(1)
+// loadConfig returns the config from the flags, the environment and the config file,
+// and checks that it's valid.
+func loadConfig() (*config.Config, error) {
+	cfg := &config.Config{
+		AggregateWindow:        viper.GetDuration(flagAggregateWindow.String()),
+		AllowPublicEndpoint:    viper.GetBool(flagAllowPublicEndpoint.String()),
+		AutoTLS:                viper.GetBool(flagAutoTLS.String()),
+		AutoTLSCacheDir:        viper.GetString(flagAutoTLSCacheDir.String()),
+		BanDuration:            viper.GetDuration(flagBanDuration.String()),
+		BanThreshold:           viper.GetInt(flagBanThreshold.String()),
+		BatchMaxReports:        viper.GetInt(flagBatchMaxReports.String()),
+		BatchMaxSizeKB:         viper.GetInt(flagBatchMaxSizeKB.String()),
+		CollectorID:            viper.GetString(flagCollectorID.String()),
+		DataDir:                viper.GetString(flagDataDir.String()),
+		Debug:                  viper.GetBool(flagDebug.String()),
+		DebugGeolocation:       viper.GetBool(flagDebugGeolocation.String()),
+		Hostnames:              viper.GetStringSlice(flagHostname.String()),
+		HTTPListen:             viper.GetString(flagHTTPListen.String()),
+		KeyFile:                viper.GetString(flagKeyFile.String()),
+		ListenAddr:             viper.GetString(flagListenAddr.String()),
+		LogFormat:              viper.GetString(flagLogFormat.String()),
+		LogRedact:              viper.GetStringSlice(flagLogRedact.String()),
+		MetricsListen:          viper.GetString(flagMetricsListen.String()),
+		PrivacyK:               viper.GetInt(flagPrivacyK.String()),
+		PrivacyPolicy:          viper.GetString(flagPrivacyPolicy.String()),
+		PrivacyWindow:          viper.GetDuration(flagPrivacyWindow.String()),
+		ProxyProtocol:          viper.GetBool(flagProxyProtocol.String()),
+		QueryToken:             viper.GetString(flagQueryToken.String()),
+		RateLimitASN:           viper.GetInt(flagRateLimitASN.String()),
+		RateLimitIP:            viper.GetInt(flagRateLimitIP.String()),
+		ReadyMaxRelayQueue:     viper.GetInt(flagReadyMaxRelayQueue.String()),
+		ReadyMaxUpstreamOutage: viper.GetDuration(flagReadyMaxUpstreamOutage.String()),
+		RelayBacklog:           viper.GetInt(flagRelayBacklog.String()),
+		RelayMaxAttempts:       viper.GetInt(flagRelayMaxAttempts.String()),
+		RelayMode:              viper.GetString(flagRelayMode.String()),
+		RelayReportMaxAge:      viper.GetDuration(flagRelayReportMaxAge.String()),
+		RelayToOONI:            !viper.GetBool(flagDisableOONIRelay.String()),
+		RelayWorkers:           viper.GetInt(flagRelayWorkers.String()),
+		ReportMaxSizeKB:        viper.GetInt(flagReportMaxSizeKB.String()),
+		RotateSizeMB:           viper.GetInt(flagRotateSizeMB.String()),
+		StorageBackend:         viper.GetString(flagStorageBackend.String()),
+		StrictDecoding:         viper.GetBool(flagStrictDecoding.String()),
+		TLSCertFile:            viper.GetString(flagTLSCertFile.String()),
+		TLSClientAuth:          viper.GetString(flagTLSClientAuth.String()),
+		TLSClientCA:            viper.GetString(flagTLSClientCA.String()),
+		TLSClientCertAuth:      viper.GetBool(flagTLSClientCertAuth.String()),
+		TLSKeyFile:             viper.GetString(flagTLSKeyFile.String()),
+		TrustedProxies:         viper.GetStringSlice(flagTrustedProxies.String()),
+	}
+
+	if err := viper.UnmarshalKey(configKeyAPIKeys, &cfg.APIKeys); err != nil {
+		return nil, fmt.Errorf("bad api-keys: %w", err)
+	}
+
+	if cfg.AutoTLS && len(cfg.Hostnames) == 0 {
+		return nil, errors.New("empty --hostname")
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, errors.New("--tls-cert and --tls-key must be used together")
+	}
+
+	if cfg.AutoTLS && cfg.TLSCertFile != "" {
+		return nil, errors.New("--autotls cannot be used with --tls-cert")
+	}
+
+	if cfg.TLSClientCA != "" && !useTLS(cfg) {
+		return nil, errors.New("--tls-client-ca needs --autotls or --tls-cert")
+	}
+
+	if cfg.TLSClientCertAuth && cfg.TLSClientCA == "" {
+		return nil, errors.New("--tls-client-cert-auth needs --tls-client-ca")
+	}
+
+	if cfg.HTTPListen != "" && !useTLS(cfg) {
+		return nil, errors.New("--http-listen needs --autotls or --tls-cert")
+	}
+
+	if cfg.HTTPListen != "" && len(cfg.Hostnames) == 0 {
+		return nil, errors.New("--http-listen needs --hostname to redirect to")
+	}
+
+	if cfg.ProxyProtocol && len(cfg.TrustedProxies) == 0 {
+		return nil, errors.New("--proxy-protocol needs --trusted-proxies")
+	}
+
+	switch cfg.TLSClientAuth {
+	case server.ClientAuthOptional:
+	case server.ClientAuthRequire:
+		if cfg.AutoTLS && cfg.TLSClientCA != "" {
+			// the ACME server would not be able to complete the TLS challenge.
+			return nil, errors.New("--tls-client-auth=require cannot be used with --autotls")
 		}
+	default:
+		return nil, fmt.Errorf("unknown --tls-client-auth: %s", cfg.TLSClientAuth)
+	}
 
-		if cfg.ListenAddr == "" {
-			if cfg.AutoTLS {
-				cfg.ListenAddr = defaultHTTPSAddr
-			} else {
-				cfg.ListenAddr = defaultHTTPAddr
-			}
+	switch cfg.RelayMode {
+	case config.RelayModeMeasurement:
+	case config.RelayModeAggregate:
+		if cfg.AggregateWindow < time.Minute {
+			return nil, errors.New("--aggregate-window must be at least one minute")
 		}
+	default:
+		return nil, fmt.Errorf("unknown --relay-mode: %s", cfg.RelayMode)
+	}
 
-		startEchoServer(cfg)
-	},
+	switch cfg.PrivacyPolicy {
+	case privacy.PolicyCoarsen, privacy.PolicyDrop:
+	default:
+		return nil, fmt.Errorf("unknown --privacy-policy: %s", cfg.PrivacyPolicy)
+	}
+
+	switch cfg.LogFormat {
+	case "json", "text":
+	default:
+		return nil, fmt.Errorf("unknown --log-format: %s", cfg.LogFormat)
+	}
+
+	if _, err := logging.ParseRedactions(cfg.LogRedact); err != nil {
+		return nil, fmt.Errorf("bad --log-redact: %w", err)
+	}
+
+	if _, err := server.ParseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("bad --trusted-proxies: %w", err)
+	}
+
+	if cfg.ListenAddr == "" {
+		if useTLS(cfg) {
+			cfg.ListenAddr = defaultHTTPSAddr
+		} else {
+			cfg.ListenAddr = defaultHTTPAddr
+		}
+	}
+	return cfg, nil
+}
+
+// useTLS returns whether the server serves TLS, either with autotls or a static certificate.
+func useTLS(cfg *config.Config) bool {
+	return cfg.AutoTLS || cfg.TLSCertFile != ""
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -105,15 +307,50 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", defaultConfigFile, "config file")
 
+	rootCmd.Flags().DurationP(flagAggregateWindow.String(), "", time.Hour, "time window for aggregates (e.g. 1h, 24h)")
 	rootCmd.Flags().BoolP(flagAllowPublicEndpoint.String(), "", false, "allow publishing of the endpoints IP")
 	rootCmd.Flags().BoolP(flagAutoTLS.String(), "", false, "use autotls to manage LetsEncrypt Certificates")
 	rootCmd.Flags().StringP(flagAutoTLSCacheDir.String(), "", defaultCacheDir, "dir to cache autotls material")
+	rootCmd.Flags().DurationP(flagBanDuration.String(), "", time.Hour, "how long to ban IPs that keep hitting the rate limit")
+	rootCmd.Flags().IntP(flagBanThreshold.String(), "", 50, "rate-limited requests after which an IP is banned (0 to disable bans)")
+	rootCmd.Flags().IntP(flagBatchMaxReports.String(), "", 500, "maximum number of reports in a batch")
+	rootCmd.Flags().IntP(flagBatchMaxSizeKB.String(), "", 1024, "maximum size of a batch of reports, in KB")
 	rootCmd.Flags().StringP(flagCollectorID.String(), "", "", "collector ID to add to enrich reports with")
+	rootCmd.Flags().StringP(flagDataDir.String(), "", defaultDataDir, "dir to store reports in (empty to disable storage)")
 	rootCmd.Flags().BoolP(flagDebug.String(), "d", false, "set debug level in logs")
 	rootCmd.Flags().BoolP(flagDebugGeolocation.String(), "", false, "get real IP from headers (potentially insecure!)")
-	rootCmd.Flags().StringP(flagHostname.String(), "", "", "hostname (for autotls certs)")
+	rootCmd.Flags().StringSliceP(flagHostname.String(), "", nil, "hostnames (for autotls certs, and for redirects to HTTPS)")
+	rootCmd.Flags().StringP(flagHTTPListen.String(), "", "", "address to serve ACME HTTP-01 challenges and redirects to HTTPS on (e.g. :80)")
+	rootCmd.PersistentFlags().StringP(flagKeyFile.String(), "", "", "file with the keys for submitting reports (see the keys command)")
 	rootCmd.Flags().StringP(flagListenAddr.String(), "", "", "address to listen on (:8080 or :443 if autotls is set)")
+	rootCmd.Flags().StringP(flagLogFormat.String(), "", "json", "format of the logs (json, text)")
+	rootCmd.Flags().StringSliceP(flagLogRedact.String(), "", nil, "how to log the IPs in each field, as field=mode (modes: hash, truncate, drop, keep)")
+	rootCmd.Flags().StringP(flagMetricsListen.String(), "", "", "separate address to serve Prometheus metrics on (e.g. 127.0.0.1:9100)")
 	rootCmd.Flags().BoolP(flagDisableOONIRelay.String(), "", false, "disable relay reports to OONI (relay on by default)")
+	rootCmd.Flags().IntP(flagPrivacyK.String(), "", 0, "distinct clients needed in a bucket before relaying its reports (0 to disable)")
+	rootCmd.Flags().StringP(flagPrivacyPolicy.String(), "", privacy.PolicyCoarsen, "what to do with reports below the threshold (coarsen, drop)")
+	rootCmd.Flags().DurationP(flagPrivacyWindow.String(), "", time.Hour, "time window to count distinct clients")
+	rootCmd.Flags().BoolP(flagProxyProtocol.String(), "", false, "accept the PROXY protocol (v1, v2) from load balancers")
+	rootCmd.Flags().StringP(flagQueryToken.String(), "", "", "bearer token to access the query API (disabled if empty)")
+	rootCmd.Flags().IntP(flagRateLimitASN.String(), "", 0, "reports per minute accepted from the same client ASN (0 to disable)")
+	rootCmd.Flags().IntP(flagRateLimitIP.String(), "", 0, "reports per minute accepted from the same client IP (0 to disable)")
+	rootCmd.Flags().IntP(flagReadyMaxRelayQueue.String(), "", 1000, "reports pending in the relay queue above which the collector is not ready (0 to disable)")
+	rootCmd.Flags().DurationP(flagReadyMaxUpstreamOutage.String(), "", 30*time.Minute, "how long submissions to OONI can keep failing before the collector is not ready (0 to disable)")
+	rootCmd.Flags().IntP(flagRelayBacklog.String(), "", 1000, "reports that can wait for a relay worker before asking clients to retry")
+	rootCmd.Flags().IntP(flagRelayMaxAttempts.String(), "", 10, "failed relay attempts before giving up on a report")
+	rootCmd.Flags().StringP(flagRelayMode.String(), "", config.RelayModeMeasurement, "relay every measurement, or only aggregates (measurement, aggregate)")
+	rootCmd.Flags().DurationP(flagRelayReportMaxAge.String(), "", time.Hour, "how long to keep an OONI report open before opening a new one")
+	rootCmd.Flags().IntP(flagRelayWorkers.String(), "", 4, "workers relaying reports in the background (0 to relay before responding)")
+	rootCmd.Flags().IntP(flagReportMaxSizeKB.String(), "", 64, "maximum size of a single report, in KB")
+	rootCmd.Flags().IntP(flagRotateSizeMB.String(), "", 0, "rotate report files after this size in MB (0 to rotate only daily)")
+	rootCmd.Flags().StringP(flagStorageBackend.String(), "", "filesystem", "storage backend for reports (filesystem, sqlite)")
+	rootCmd.Flags().BoolP(flagStrictDecoding.String(), "", false, "reject reports with unknown fields, instead of ignoring them")
+	rootCmd.Flags().StringP(flagTLSCertFile.String(), "", "", "file with a TLS certificate (reloaded when it changes), instead of autotls")
+	rootCmd.Flags().StringP(flagTLSClientAuth.String(), "", server.ClientAuthOptional, "whether client certificates are optional or required (optional, require)")
+	rootCmd.Flags().StringP(flagTLSClientCA.String(), "", "", "CA bundle to verify client certificates with (disabled if empty)")
+	rootCmd.Flags().BoolP(flagTLSClientCertAuth.String(), "", false, "accept verified client certificates instead of API keys, with the common name as the agent")
+	rootCmd.Flags().StringP(flagTLSKeyFile.String(), "", "", "file with the key for --tls-cert")
+	rootCmd.Flags().StringSliceP(flagTrustedProxies.String(), "", nil, "CIDRs of proxies trusted to pass the client IP (X-Forwarded-For, X-Real-IP, PROXY protocol)")
 }
 
 // initConfig reads config file and any relevant ENV variables if set.
@@ -128,10 +365,15 @@ func initConfig() {
 	viper.AutomaticEnv() // read any environment variables that match
 
 	for _, flg := range allFlags {
-		viper.BindPFlag(flg, rootCmd.Flags().Lookup(flg))
+		f := rootCmd.Flags().Lookup(flg)
+		if f == nil {
+			f = rootCmd.PersistentFlags().Lookup(flg)
+		}
+		viper.BindPFlag(flg, f)
 	}
 
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+		configFileLoaded = true
 	}
 }
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/apikeys"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// keysCmd groups the commands to manage the keys for submitting reports.
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage the keys that applications use to submit reports",
+	Long: `Manage the keys that applications use to submit reports.
+
+Keys are stored (hashed) in the --key-file. A running server picks up
+any change to the key file after a few seconds.`,
+}
+
+var keysGenerateCmd = &cobra.Command{
+	Use:   "generate APP",
+	Short: "Generate a new key for an application",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := keyFileOrExit()
+		entries := loadKeysOrExit(path)
+		key, entry, err := apikeys.Generate(args[0])
+		if err != nil {
+			fmt.Println("ERROR: cannot generate key:", err)
+			os.Exit(1)
+		}
+		entries = append(entries, entry)
+		saveKeysOrExit(path, entries)
+		fmt.Printf("Generated key %s for %s. Keep it safe, it won't be shown again:\n\n", entry.ID, entry.App)
+		fmt.Println(key)
+	},
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the keys",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		entries := loadKeysOrExit(keyFileOrExit())
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tAPP\tSTATUS\tCREATED")
+		for _, e := range entries {
+			status := "enabled"
+			if e.Disabled {
+				status = "disabled"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.ID, e.App, status, e.Created.Format("2006-01-02"))
+		}
+		w.Flush()
+	},
+}
+
+var keysDisableCmd = &cobra.Command{
+	Use:   "disable ID",
+	Short: "Disable a key",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		setKeyDisabled(args[0], true)
+	},
+}
+
+var keysEnableCmd = &cobra.Command{
+	Use:   "enable ID",
+	Short: "Enable a key that was disabled",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		setKeyDisabled(args[0], false)
+	},
+}
+
+func init() {
+	keysCmd.AddCommand(keysGenerateCmd, keysListCmd, keysDisableCmd, keysEnableCmd)
+	rootCmd.AddCommand(keysCmd)
+}
+
+func setKeyDisabled(id string, disabled bool) {
+	path := keyFileOrExit()
+	entries := loadKeysOrExit(path)
+	if err := apikeys.SetDisabled(entries, id, disabled); err != nil {
+		fmt.Println("ERROR:", err, id)
+		os.Exit(1)
+	}
+	saveKeysOrExit(path, entries)
+}
+
+func keyFileOrExit() string {
+	path := viper.GetString(flagKeyFile.String())
+	if path == "" {
+		fmt.Println("ERROR: empty --key-file")
+		os.Exit(1)
+	}
+	return path
+}
+
+func loadKeysOrExit(path string) []*apikeys.Entry {
+	entries, err := apikeys.LoadFile(path)
+	if err != nil {
+		fmt.Println("ERROR: cannot read key file:", err)
+		os.Exit(1)
+	}
+	return entries
+}
+
+func saveKeysOrExit(path string, entries []*apikeys.Entry) {
+	if err := apikeys.SaveFile(path, entries); err != nil {
+		fmt.Println("ERROR: cannot write key file:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// liveSettings are the fields of the config that can change without a restart. Changes
+// to any other field are ignored until the server is restarted. The collector ID is not
+// live, since it also names the storage and the relay queue.
+var liveSettings = map[string]bool{
+	"AllowPublicEndpoint": true,
+	"BatchMaxReports":     true,
+	"BatchMaxSizeKB":      true,
+	"RelayMaxAttempts":    true,
+	"RelayReportMaxAge":   true,
+	"RelayToOONI":         true,
+	"ReportMaxSizeKB":     true,
+	"StrictDecoding":      true,
+}
+
+// reloader reloads the config, and passes the live settings that changed to apply.
+// viper is not safe for concurrent use, so all the reloads happen in the goroutine
+// that calls Run.
+type reloader struct {
+	current *config.Config
+	apply   func(cfg *config.Config)
+}
+
+func newReloader(cfg *config.Config, apply func(cfg *config.Config)) *reloader {
+	return &reloader{current: cfg, apply: apply}
+}
+
+// Run reloads the config on SIGHUP and, if the server was started with a config file,
+// whenever the file changes. It returns when the context is done.
+func (r *reloader) Run(ctx context.Context) {
+	var changes <-chan struct{}
+	if configFileLoaded {
+		ch, err := watchFile(ctx, viper.ConfigFileUsed())
+		if err != nil {
+			slog.Warn("cannot watch the config file", "file", viper.ConfigFileUsed(), "error", err)
+		}
+		changes = ch
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reload()
+		case <-changes:
+			r.reload()
+		}
+	}
+}
+
+// watchFile returns a channel that gets a value when the file changes. We watch the
+// directory rather than the file, so that we see the file when an editor or a config
+// management tool replaces it. Changes that arrive while the last one is still pending
+// are coalesced.
+func watchFile(ctx context.Context, file string) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	file = filepath.Clean(file)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != file || !event.Has(fsnotify.Write|fsnotify.Create) {
+					continue
+				}
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("cannot watch the config file", "file", file, "error", err)
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// reload reads the config again and applies the live settings that changed. The
+// current config is kept if the new one is not valid.
+func (r *reloader) reload() {
+	if err := viper.ReadInConfig(); err != nil {
+		slog.Warn("cannot read the config file", "file", viper.ConfigFileUsed(), "error", err)
+		return
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Warn("cannot reload the config", "error", err)
+		return
+	}
+
+	next := *r.current
+	from, to := reflect.ValueOf(r.current).Elem(), reflect.ValueOf(cfg).Elem()
+	var changed []string
+	for _, name := range config.Diff(r.current, cfg) {
+		if !liveSettings[name] {
+			// we don't log the values, since some settings are secret.
+			slog.Warn("cannot change setting without a restart", "setting", name)
+			continue
+		}
+		slog.Info("setting changed", "setting", name,
+			"old", from.FieldByName(name).Interface(), "new", to.FieldByName(name).Interface())
+		reflect.ValueOf(&next).Elem().FieldByName(name).Set(to.FieldByName(name))
+		changed = append(changed, name)
+	}
+	if len(changed) == 0 {
+		slog.Info("config reloaded, nothing to change")
+		return
+	}
+	r.current = &next
+	r.apply(&next)
+	slog.Info("config reloaded", "changed", changed)
+}
@@ -3,14 +3,28 @@ package app
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ainghazal/tunnel-telemetry/internal/aggregate"
+	"github.com/ainghazal/tunnel-telemetry/internal/apikeys"
 	"github.com/ainghazal/tunnel-telemetry/internal/collector"
 	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/logging"
+	"github.com/ainghazal/tunnel-telemetry/internal/metrics"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/ainghazal/tunnel-telemetry/internal/oonirelay"
+	"github.com/ainghazal/tunnel-telemetry/internal/privacy"
+	"github.com/ainghazal/tunnel-telemetry/internal/ratelimit"
+	"github.com/ainghazal/tunnel-telemetry/internal/relayqueue"
 	"github.com/ainghazal/tunnel-telemetry/internal/server"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
@@ -33,29 +47,291 @@ func handleVersionInfo(c echo.Context) error {
 	return c.String(http.StatusOK, commitInfo)
 }
 
+// fatal logs the error and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func startEchoServer(cfg *config.Config) {
+	// the server, the collector and the relays log through the default logger, which
+	// takes care of redacting client IPs.
+	slog.SetDefault(logging.New(cfg, os.Stderr))
+
 	e := server.NewEchoServer(cfg)
 	if cfg.Debug {
 		e.Logger.SetLevel(log.DEBUG)
 	}
 
-	collector := collector.NewFileSystemCollector(cfg)
-	h := server.NewHandler(collector, collector)
+	var store model.Storage
+	if cfg.DataDir != "" {
+		var err error
+		if store, err = collector.NewStorage(cfg); err != nil {
+			fatal("cannot open storage", err)
+		}
+	}
+	col := collector.NewCollector(cfg, store)
+	defer col.Close()
+
+	// measurements and aggregates are sent into long-lived OONI reports, which are
+	// rotated periodically and closed on shutdown. Relaying can be turned on and off
+	// without a restart, so we always set up everything it needs: no report is opened
+	// until something is sent.
+	channels := oonirelay.NewChannelManager(cfg.RelayReportMaxAge)
+	col.SetRelay(channels)
+	var relaying atomic.Bool
+	relaying.Store(cfg.RelayToOONI)
+
+	// background workers run until the server has been shut down. The aggregator and the
+	// privacy gate pass what they hold to the next stage on their way out, so they are
+	// stopped first, one at a time, in the reverse order they were started.
+	bgCtx, bgCancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	var stages []func()
+	defer func() {
+		for i := len(stages) - 1; i >= 0; i-- {
+			stages[i]()
+		}
+		bgCancel()
+		wg.Wait()
+		// the workers may have flushed something on their way out.
+		if err := channels.Close(); err != nil {
+			slog.Warn("cannot close OONI reports", "error", err)
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		channels.Run(bgCtx)
+	}()
+
+	// the relay queue keeps the dir it gets at startup, even if the collector ID changes.
+	var queue *relayqueue.Queue
+	if cfg.DataDir != "" && cfg.RelayMode == config.RelayModeMeasurement {
+		var err error
+		if queue, err = relayqueue.New(collector.RelayQueueDir(cfg), cfg.RelayMaxAttempts); err != nil {
+			fatal("cannot open relay queue", err)
+		}
+		queue.SetPaused(!cfg.RelayToOONI)
+		col.SetRelayQueue(queue)
+		metrics.RegisterRelayQueue(queue)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queue.Run(bgCtx, col.Relay)
+		}()
+	}
+
+	var submitter model.Submitter = col
+	var gate *privacy.Gate
+	var aggregator *aggregate.Aggregator
+	if cfg.RelayMode == config.RelayModeAggregate {
+		aggregator = aggregate.NewAggregator(cfg, channels)
+		aggregator.SetPaused(!cfg.RelayToOONI)
+		stages = append(stages, startStage(aggregator.Run))
+		submitter = aggregator
+	}
+	if cfg.PrivacyK > 1 {
+		// reports from rare networks are held until there are enough clients to hide among.
+		gate = privacy.NewGate(cfg, submitter)
+		gate.Store = store
+		stages = append(stages, startStage(gate.Run))
+		submitter = gate
+	}
+	h := server.NewHandler(col, submitter)
+	h.Privacy = gate
+	h.SetConfig(cfg)
+	// without relaying, the handler does not dispatch anything, and reports are final as
+	// soon as they're stored.
+	if cfg.RelayWorkers > 0 {
+		h.Dispatcher = server.NewDispatcher(submitter, cfg.RelayWorkers, cfg.RelayBacklog)
+		h.Dispatcher.Start()
+	}
+
+	// some settings can be changed without a restart, on SIGHUP or when the config file changes.
+	reloader := newReloader(cfg, func(cfg *config.Config) {
+		col.SetConfig(cfg)
+		h.SetConfig(cfg)
+		if aggregator != nil {
+			aggregator.SetPaused(!cfg.RelayToOONI)
+		}
+		if queue != nil {
+			queue.SetMaxAttempts(cfg.RelayMaxAttempts)
+			queue.SetPaused(!cfg.RelayToOONI)
+		}
+		channels.SetMaxAge(cfg.RelayReportMaxAge)
+		relaying.Store(cfg.RelayToOONI)
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reloader.Run(bgCtx)
+	}()
+
+	// reports are rate limited by client IP (before doing anything else) and by client ASN.
+	var reportMiddleware []echo.MiddlewareFunc
+	var limiter *ratelimit.Limiter
+	if cfg.RateLimitIP > 0 || cfg.RateLimitASN > 0 {
+		limiter = ratelimit.NewLimiter(cfg)
+		h.Limiter = limiter
+		reportMiddleware = append(reportMiddleware, server.RateLimit(limiter))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.Run(bgCtx)
+		}()
+	}
+
+	// if there are keys, or certificates are accepted instead, only known applications
+	// can submit reports.
+	if apikeys.Enabled(cfg) {
+		keyring, err := apikeys.NewKeyring(cfg)
+		if err != nil {
+			fatal("cannot load keys", err)
+		}
+		requireApp := server.RequireAPIKey
+		if cfg.TLSClientCertAuth {
+			requireApp = server.RequireAPIKeyOrClientCert
+		}
+		reportMiddleware = append(reportMiddleware, requireApp(keyring))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keyring.Run(bgCtx)
+		}()
+	}
+
+	// the orchestrator restarts the collector if it's not alive, and only routes reports
+	// to it while it's ready.
+	health := server.NewHealth()
+	health.Add("geoip", collector.CheckGeoIP)
+	if store != nil {
+		health.Add("storage", store.Check)
+	}
+	if queue != nil && cfg.ReadyMaxRelayQueue > 0 {
+		health.Add("relay_queue", func() error {
+			stats, err := queue.Stats()
+			if err != nil {
+				return err
+			}
+			if stats.Pending > cfg.ReadyMaxRelayQueue {
+				return fmt.Errorf("%d reports pending (max %d)", stats.Pending, cfg.ReadyMaxRelayQueue)
+			}
+			return nil
+		})
+	}
+	// a single failed submission is retried, so only a sustained outage makes the
+	// collector unready.
+	if cfg.ReadyMaxUpstreamOutage > 0 {
+		health.Add("upstream", func() error {
+			if !relaying.Load() {
+				return nil
+			}
+			since, err := channels.FailingSince()
+			if !since.IsZero() && time.Since(since) > cfg.ReadyMaxUpstreamOutage {
+				return fmt.Errorf("failing since %s: %w", since.UTC().Format(time.RFC3339), err)
+			}
+			return nil
+		})
+	}
 
 	e.GET("/", server.HandleRootDecoy)
-	e.POST("/report", h.CreateReport)
+	e.GET(server.PathLive, health.HandleLive)
+	e.GET(server.PathReady, health.HandleReady)
+	e.POST("/report", h.CreateReport, reportMiddleware...)
+	e.POST("/report/batch", h.CreateReportBatch, reportMiddleware...)
+	e.GET("/report/:uuid", h.GetReport)
 	e.GET("/version", handleVersionInfo)
+	if cfg.QueryToken != "" {
+		e.GET("/reports", h.ListReports, server.RequireToken(cfg.QueryToken))
+		if queue != nil {
+			e.GET("/relay/queue", server.HandleRelayQueueStats(queue), server.RequireToken(cfg.QueryToken))
+		}
+		if limiter != nil {
+			e.GET("/ratelimit", server.HandleRateLimitStats(limiter), server.RequireToken(cfg.QueryToken))
+		}
+	}
+
+	if cfg.MetricsListen != "" {
+		metricsServer := &http.Server{
+			Addr:     cfg.MetricsListen,
+			Handler:  metrics.Handler(),
+			ErrorLog: server.ErrorLog(slog.Default()),
+		}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("shutting down the metrics server", err)
+			}
+		}()
+		defer metricsServer.Close()
+	} else if cfg.QueryToken != "" {
+		e.GET("/metrics", echo.WrapHandler(metrics.Handler()), server.RequireToken(cfg.QueryToken))
+	} else {
+		// the report listener is public, so the metrics are never served on it without a token.
+		slog.Warn("metrics are not served: set --metrics-listen or --query-token")
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
-	if cfg.AutoTLS {
-		// Start server
-		go startAutoTLSServer(e, cfg)
+	// the listener takes care of the PROXY protocol, if enabled.
+	ln, err := server.NewListener(cfg)
+	if err != nil {
+		fatal("cannot listen", err)
+	}
+
+	// certificates come from autotls, or from files that are reloaded when they change.
+	var tlsConfig *tls.Config
+	var httpHandler http.Handler = server.RedirectToHTTPS(cfg.ListenAddr, cfg.Hostnames)
+	switch {
+	case cfg.AutoTLS:
+		autoTLSManager := newAutoTLSManager(cfg)
+		tlsConfig = &tls.Config{
+			GetCertificate: autoTLSManager.GetCertificate,
+			NextProtos:     []string{acme.ALPNProto},
+		}
+		// some providers block the TLS-ALPN challenge, so we also answer the HTTP-01 one.
+		httpHandler = autoTLSManager.HTTPHandler(httpHandler)
+	case cfg.TLSCertFile != "":
+		certs, err := server.NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			fatal("cannot load certificate", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			certs.Run(bgCtx)
+		}()
+		tlsConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+	}
+
+	if tlsConfig != nil {
+		if err := server.ConfigureClientAuth(tlsConfig, cfg); err != nil {
+			fatal("cannot load client CA", err)
+		}
+		go startTLSServer(e, ln, tlsConfig)
 	} else {
+		e.Listener = ln
 		go func() {
 			if err := e.Start(cfg.ListenAddr); err != nil && err != http.ErrServerClosed {
-				e.Logger.Fatalf("shutting down the server: %v", err)
+				fatal("shutting down the server", err)
+			}
+		}()
+	}
+
+	// in TLS mode, plain HTTP is only used for ACME challenges and redirects.
+	var httpServer *http.Server
+	if tlsConfig != nil && cfg.HTTPListen != "" {
+		httpServer = &http.Server{
+			Addr:        cfg.HTTPListen,
+			Handler:     httpHandler,
+			ReadTimeout: 30 * time.Second,
+			ErrorLog:    server.ErrorLog(slog.Default()),
+		}
+		go func() {
+			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("shutting down the HTTP server", err)
 			}
 		}()
 	}
@@ -64,29 +340,67 @@ func startEchoServer(cfg *config.Config) {
 	<-ctx.Done()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			slog.Warn("cannot shut down the HTTP server", "error", err)
+		}
+	}
 	if err := e.Shutdown(ctx); err != nil {
-		e.Logger.Fatal(err)
+		fatal("cannot shut down the server", err)
+	}
+	if h.Dispatcher != nil {
+		// give the workers some time to relay what's left in the backlog. Whatever is
+		// left has been stored and accepted already, so it goes to the relay queue, going
+		// through the privacy gate or the aggregator first, if there's one.
+		left, err := h.Dispatcher.Close(ctx)
+		if err != nil {
+			slog.Warn("relay backlog not drained", "left", len(left), "error", err)
+		}
+		if len(left) != 0 {
+			col.DeferRelays()
+			if !submitter.Submit(left) {
+				slog.Warn("cannot keep the reports left in the relay backlog", "left", len(left))
+			}
+		}
+	}
+}
+
+// startStage runs fn in the background, and returns a function that stops it and waits
+// for it to return.
+func startStage(fn func(ctx context.Context)) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
 	}
 }
 
-func startAutoTLSServer(e *echo.Echo, cfg *config.Config) {
-	autoTLSManager := autocert.Manager{
+// newAutoTLSManager returns a manager that fetches certificates from Let's Encrypt
+// for the configured hostnames.
+func newAutoTLSManager(cfg *config.Config) *autocert.Manager {
+	return &autocert.Manager{
 		Prompt: autocert.AcceptTOS,
 		// Cache certificates to avoid issues with rate limits (https://letsencrypt.org/docs/rate-limits)
 		Cache:      autocert.DirCache(cfg.AutoTLSCacheDir),
-		HostPolicy: autocert.HostWhitelist(cfg.Hostname),
+		HostPolicy: autocert.HostWhitelist(cfg.Hostnames...),
 	}
-	s := http.Server{
-		Addr:    cfg.ListenAddr,
-		Handler: e, // set Echo as handler
-		TLSConfig: &tls.Config{
-			GetCertificate: autoTLSManager.GetCertificate,
-			NextProtos:     []string{acme.ALPNProto},
-		},
-		ReadTimeout: 30 * time.Second, // use custom timeouts
-	}
-	e.Logger.Info("Starting autotls server (can take a few secs)")
-	if err := s.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
-		e.Logger.Fatal(err)
+}
+
+// startTLSServer serves on the listener with the TLS config. It uses the echo TLS server,
+// so that it's shut down along with echo.
+func startTLSServer(e *echo.Echo, ln net.Listener, tlsConfig *tls.Config) {
+	s := e.TLSServer
+	s.Handler = e // set Echo as handler
+	s.TLSConfig = tlsConfig
+	s.ReadTimeout = 30 * time.Second // use custom timeouts
+	s.ErrorLog = e.StdLogger         // so that client addresses are redacted
+	slog.Info("starting TLS server (autotls can take a few secs)")
+	if err := s.ServeTLS(ln, "", ""); err != http.ErrServerClosed {
+		fatal("shutting down the server", err)
 	}
 }
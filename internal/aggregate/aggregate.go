@@ -0,0 +1,253 @@
+// Package aggregate implements a [model.Submitter] that, instead of relaying every
+// measurement, relays periodic aggregates upstream.
+package aggregate
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/metrics"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+)
+
+var (
+	// gracePeriod is how long we wait after the end of a window before flushing it,
+	// so that we can still count the reports that arrive a bit late.
+	gracePeriod = 5 * time.Minute
+
+	// flushInterval is how often we check for windows to flush.
+	flushInterval = time.Minute
+
+	// DefaultMaxPending is the maximum number of aggregates kept for retrying. When the
+	// upstream collector is down for longer than that, the oldest ones are dropped.
+	DefaultMaxPending = 1000
+)
+
+// bucketKey identifies the measurements that are aggregated together.
+type bucketKey struct {
+	windowStart  time.Time
+	protocol     string
+	clientASN    string
+	clientCC     string
+	endpointASN  string
+	endpointCC   string
+	endpointPort int
+}
+
+type bucket struct {
+	successes  int
+	failures   int
+	failureOps map[string]int
+	durations  []int64
+}
+
+// Aggregator buckets measurements by time window, protocol, client network and endpoint,
+// and periodically submits the aggregates of the windows that are over.
+type Aggregator struct {
+	window   time.Duration
+	upstream model.AggregateSubmitter
+	now      func() time.Time
+
+	// MaxPending is the maximum number of aggregates kept for retrying.
+	MaxPending int
+
+	mu          sync.Mutex
+	collectorID string
+	buckets     map[bucketKey]*bucket
+
+	// pending are aggregates that we failed to submit, and that we'll retry on the next flush.
+	pending []*model.Aggregate
+
+	paused atomic.Bool
+}
+
+// NewAggregator returns an Aggregator that submits the aggregates to the upstream collector,
+// with the window configured in cfg.
+func NewAggregator(cfg *config.Config, upstream model.AggregateSubmitter) *Aggregator {
+	window := cfg.AggregateWindow
+	if window <= 0 {
+		window = time.Hour
+	}
+	return &Aggregator{
+		collectorID: cfg.CollectorID,
+		window:      window,
+		upstream:    upstream,
+		now:         time.Now,
+		MaxPending:  DefaultMaxPending,
+		buckets:     make(map[bucketKey]*bucket),
+	}
+}
+
+// SetPaused stops (or resumes) the submission of the aggregates (e.g., while relaying is
+// turned off). They are kept in memory in the meantime, so they are lost if the aggregator
+// stops before it's resumed. It can be called while the aggregator is running.
+func (a *Aggregator) SetPaused(paused bool) {
+	a.paused.Store(paused)
+}
+
+// Submit implements [model.Submitter]. It adds the measurements to the current aggregates;
+// nothing is sent upstream until the window is over.
+//
+// Measurements are bucketed by the time they're received, not by the time they were
+// taken: clients can send reports that are days old, and a window that has already been
+// flushed must not be opened again.
+func (a *Aggregator) Submit(mm []*model.Measurement) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	windowStart := a.now().UTC().Truncate(a.window)
+	for _, m := range mm {
+		key := bucketKey{
+			windowStart:  windowStart,
+			protocol:     m.Protocol,
+			clientASN:    m.ClientASN,
+			clientCC:     m.ClientCC,
+			endpointASN:  m.EndpointASN,
+			endpointCC:   m.EndpointCC,
+			endpointPort: m.EndpointPort,
+		}
+		b, ok := a.buckets[key]
+		if !ok {
+			b = &bucket{failureOps: make(map[string]int)}
+			a.buckets[key] = b
+		}
+		if m.Failure != nil {
+			b.failures++
+			b.failureOps[m.Failure.Op]++
+		} else {
+			b.successes++
+		}
+		if m.DurationMS > 0 {
+			b.durations = append(b.durations, m.DurationMS)
+		}
+	}
+	return true
+}
+
+// Run flushes the windows that are over, until the context is done. Before returning,
+// it flushes all the aggregates, including the ones for windows still open.
+func (a *Aggregator) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			a.FlushAll()
+			return
+		case <-ticker.C:
+			a.flush(a.now().Add(-gracePeriod))
+		}
+	}
+}
+
+// FlushAll submits all the aggregates, without waiting for their windows to be over.
+func (a *Aggregator) FlushAll() error {
+	return a.flush(time.Time{})
+}
+
+// flush submits the aggregates for the windows ending before the passed time.
+// A zero time flushes all the aggregates.
+func (a *Aggregator) flush(before time.Time) error {
+	if a.paused.Load() {
+		return nil
+	}
+	a.mu.Lock()
+	aggregates := a.pending
+	a.pending = nil
+	for key, b := range a.buckets {
+		windowEnd := key.windowStart.Add(a.window)
+		if !before.IsZero() && windowEnd.After(before) {
+			continue
+		}
+		aggregates = append(aggregates, a.makeAggregate(key, b))
+		delete(a.buckets, key)
+	}
+	a.mu.Unlock()
+
+	if len(aggregates) == 0 {
+		return nil
+	}
+	// the pending ones go first, so that the oldest are dropped if they fail again.
+	sort.SliceStable(aggregates, func(i, j int) bool {
+		return aggregates[i].WindowStart.Before(aggregates[j].WindowStart)
+	})
+
+	// we submit them one by one, so that we only retry the ones that failed.
+	var failed []*model.Aggregate
+	var lastErr error
+	for _, agg := range aggregates {
+		start := time.Now()
+		err := a.upstream.SubmitAggregates([]*model.Aggregate{agg})
+		metrics.ObserveRelay(metrics.RelayAggregate, start, err)
+		if err != nil {
+			failed = append(failed, agg)
+			lastErr = err
+		}
+	}
+	if len(failed) != 0 {
+		a.mu.Lock()
+		a.pending = append(a.pending, failed...)
+		if a.MaxPending > 0 && len(a.pending) > a.MaxPending {
+			// they're sorted by window, so the oldest ones go first.
+			dropped := len(a.pending) - a.MaxPending
+			a.pending = slices.Clone(a.pending[dropped:])
+			metrics.AggregatesDropped(dropped)
+			slog.Warn("dropped aggregates over the pending limit", "dropped", dropped, "max_pending", a.MaxPending)
+		}
+		a.mu.Unlock()
+	}
+	return lastErr
+}
+
+func (a *Aggregator) makeAggregate(key bucketKey, b *bucket) *model.Aggregate {
+	agg := &model.Aggregate{
+		Type:         model.AggregateReportType,
+		CollectorID:  a.collectorID,
+		WindowStart:  key.windowStart,
+		WindowEnd:    key.windowStart.Add(a.window),
+		Protocol:     key.protocol,
+		ClientASN:    key.clientASN,
+		ClientCC:     key.clientCC,
+		EndpointASN:  key.endpointASN,
+		EndpointCC:   key.endpointCC,
+		EndpointPort: key.endpointPort,
+		Count:        b.successes + b.failures,
+		Successes:    b.successes,
+		Failures:     b.failures,
+	}
+	if len(b.failureOps) != 0 {
+		agg.FailureOps = b.failureOps
+	}
+	if len(b.durations) != 0 {
+		agg.DurationMS = percentiles(b.durations)
+	}
+	return agg
+}
+
+// percentiles returns the distribution of durations, using the nearest-rank method.
+func percentiles(durations []int64) *model.DurationPercentile {
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	rank := func(p int) int64 {
+		idx := (p*len(durations)+99)/100 - 1
+		if idx < 0 {
+			idx = 0
+		}
+		return durations[idx]
+	}
+	return &model.DurationPercentile{
+		Min: durations[0],
+		P50: rank(50),
+		P90: rank(90),
+		P99: rank(99),
+		Max: durations[len(durations)-1],
+	}
+}
+
+// Aggregator implements [model.Submitter]
+var _ model.Submitter = &Aggregator{}
@@ -0,0 +1,235 @@
+// Package apikeys implements the per-application keys that clients use to submit reports.
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+)
+
+var (
+	// ErrUnknownKey is returned when there's no key with the passed ID.
+	ErrUnknownKey = errors.New("unknown key")
+
+	// keyPrefix makes keys easy to spot (e.g., in leaked logs).
+	keyPrefix = "tt_"
+
+	// reloadInterval is how often we check whether the key file has changed.
+	reloadInterval = 10 * time.Second
+)
+
+// Entry is a key, as kept in the key file. We only keep a hash of the key itself.
+type Entry struct {
+	ID       string    `json:"id"`
+	App      string    `json:"app"`
+	Hash     string    `json:"hash"`
+	Disabled bool      `json:"disabled,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// Generate returns a new random key for the app, and the entry to store for it.
+func Generate(app string) (string, *Entry, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	key := keyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	e := newEntry(app, key)
+	e.Created = time.Now().UTC().Truncate(time.Second)
+	return key, e, nil
+}
+
+func newEntry(app, key string) *Entry {
+	hash := hashKey(key)
+	return &Entry{
+		ID:   hash[:12],
+		App:  app,
+		Hash: hash,
+	}
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadFile reads the entries in the key file. A missing file has no entries.
+func LoadFile(path string) ([]*Entry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []*Entry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []*Entry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// SaveFile atomically replaces the key file with the passed entries.
+func SaveFile(path string, entries []*Entry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// SetDisabled disables (or enables again) the entry with the passed ID.
+func SetDisabled(entries []*Entry, id string, disabled bool) error {
+	for _, e := range entries {
+		if e.ID == id {
+			e.Disabled = disabled
+			return nil
+		}
+	}
+	return ErrUnknownKey
+}
+
+// Keyring holds the keys from the config and from the key file, and it maps them
+// to application names.
+type Keyring struct {
+	path   string
+	static []*Entry
+
+	mu      sync.RWMutex
+	byHash  map[string]*Entry
+	modTime time.Time
+}
+
+// NewKeyring returns a Keyring with the keys in the config and in the configured key file.
+func NewKeyring(cfg *config.Config) (*Keyring, error) {
+	k := &Keyring{path: cfg.KeyFile}
+	for _, key := range cfg.APIKeys {
+		e := newEntry(key.App, key.Key)
+		e.Disabled = key.Disabled
+		k.static = append(k.static, e)
+	}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Enabled returns true if clients must authenticate: the config has keys, or it accepts
+// client certificates instead of keys (then, the keyring can be empty).
+func Enabled(cfg *config.Config) bool {
+	return cfg.KeyFile != "" || len(cfg.APIKeys) != 0 || cfg.TLSClientCertAuth
+}
+
+// Lookup returns the application name for the key, if the key is known and enabled.
+func (k *Keyring) Lookup(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	e, ok := k.byHash[hashKey(key)]
+	if !ok || e.Disabled {
+		return "", false
+	}
+	return e.App, true
+}
+
+// Reload reads the key file again.
+func (k *Keyring) Reload() error {
+	byHash := make(map[string]*Entry)
+	for _, e := range k.static {
+		byHash[e.Hash] = e
+	}
+	var modTime time.Time
+	if k.path != "" {
+		if info, err := os.Stat(k.path); err == nil {
+			modTime = info.ModTime()
+		}
+		entries, err := LoadFile(k.path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			byHash[strings.ToLower(e.Hash)] = e
+		}
+	}
+	k.mu.Lock()
+	k.byHash = byHash
+	k.modTime = modTime
+	k.mu.Unlock()
+	return nil
+}
+
+// Run reloads the key file whenever it changes, until the context is done. This way,
+// keys that are disabled from the command line are revoked without a restart.
+func (k *Keyring) Run(ctx context.Context) {
+	if k.path == "" {
+		return
+	}
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.ReloadIfChanged(); err != nil {
+				slog.Warn("cannot reload the key file", "file", k.path, "error", err)
+			}
+		}
+	}
+}
+
+// ReloadIfChanged reads the key file again if it has changed since the last time. If
+// the file has been removed, only the keys in the config are left. If the file cannot
+// be read, the current keys are kept.
+func (k *Keyring) ReloadIfChanged() error {
+	if k.path == "" {
+		return nil
+	}
+	var modTime time.Time
+	info, err := os.Stat(k.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// a missing file has no entries, and it has no modification time either.
+	case err != nil:
+		return err
+	default:
+		modTime = info.ModTime()
+	}
+	k.mu.RLock()
+	changed := !modTime.Equal(k.modTime)
+	k.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	return k.Reload()
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+)
+
+// BatchItemResult is the outcome for a single report in a batch.
+type BatchItemResult struct {
+	// Index is the position of the report in the batch, starting at zero.
+	Index   int    `json:"index"`
+	UUID    string `json:"uuid,omitempty"`
+	OK      bool   `json:"ok"`
+	Message string `json:"msg,omitempty"`
+
+	// Retry is set when the collector did not accept the report for a reason that has
+	// nothing to do with the report itself, so that it can be sent again later.
+	Retry bool `json:"retry,omitempty"`
+}
+
+// BatchResult is the outcome of submitting a batch of reports.
+type BatchResult struct {
+	// Collector is the collector that processed the batch.
+	Collector string `json:"-"`
+
+	Accepted int                `json:"accepted"`
+	Rejected int                `json:"rejected"`
+	Results  []*BatchItemResult `json:"results"`
+}
+
+// SubmitBatch sends the measurements in a single request to the first collector that
+// processes the batch, moving on to the next collector like [Client.Submit] does. The
+// batch is never fanned out. Every report is accepted or rejected on its own, and the
+// result has the outcome for each of them.
+func (c *Client) SubmitBatch(ctx context.Context, mm []*model.Measurement) (*BatchResult, error) {
+	if len(c.Collectors) == 0 {
+		return nil, ErrNoCollectors
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, m := range mm {
+		if m.ClientASN == "" && m.ClientCC == "" {
+			m.ClientASN, m.ClientCC = c.ClientASN, c.ClientCC
+		}
+		if err := enc.Encode(m); err != nil {
+			return nil, err
+		}
+	}
+
+	var attempts []Attempt
+	for _, collector := range c.Collectors {
+		result := &BatchResult{}
+		err := c.post(ctx, collector, "/report/batch", "application/x-ndjson", body.Bytes(), result)
+		if err == nil {
+			result.Collector = collector
+			return result, nil
+		}
+		attempts = append(attempts, Attempt{Collector: collector, Err: err})
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, &SubmitError{Attempts: attempts}
+}
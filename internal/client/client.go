@@ -1,10 +1,32 @@
-// Package client implements a tunneltelemetry server.
+// Package client implements a tunneltelemetry client.
 package client
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/ainghazal/tunnel-telemetry/pkg/geolocate"
+)
+
+// DefaultTimeout is the time we give each collector to accept a report.
+const DefaultTimeout = 10 * time.Second
+
+var (
+	// ErrRejected is returned when a collector does not accept a report because of
+	// something in the report (or in the request), so that retrying would not help.
+	ErrRejected = errors.New("report rejected")
+
+	// ErrNoCollectors is returned when the client has no collectors to submit reports to.
+	ErrNoCollectors = errors.New("no collectors")
 )
 
 // A Client is used to produce and submit reports to a collector.
@@ -12,17 +34,234 @@ type Client struct {
 	// If DoGeolocation is set to false, we will not attempt to geolcate ourselves.
 	DoGeolocation bool
 
-	// Collector is the primary collector where to submit reports.
-	Collector string
+	// Collectors are the URLs of the collectors where to submit reports, in order of
+	// preference: the first one is the primary collector, and the others are backups.
+	Collectors []string
+
+	// FanOut submits every report to all the collectors, instead of stopping at the
+	// first one that accepts it.
+	FanOut bool
+
+	// Timeout is the time we give each collector to accept a report. If zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// APIKey, if set, is sent as a bearer token to collectors that require keys.
+	APIKey string
 
 	// ClientASN is the ASN for this client's public IP.
 	ClientASN string
 
 	// ClientCC is the country code for this client's public IP.
 	ClientCC string
+
+	// HTTPClient is used to submit reports. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// Result is the outcome of submitting a report.
+type Result struct {
+	// Collector is the collector that accepted the report (the first one in the list,
+	// when fanning out).
+	Collector string
+
+	// Report is the report as the collector accepted it, i.e. after scrubbing.
+	Report *model.Measurement
+
+	// OONILink is the link to the measurement in OONI Explorer. It's empty if the
+	// collector relays reports in the background, or in aggregate.
+	OONILink string
+
+	// Attempts has the outcome for every collector we tried, in order.
+	Attempts []Attempt
+}
+
+// Attempt is the outcome of submitting a report to a single collector.
+type Attempt struct {
+	Collector string
+
+	// Err is nil if the collector accepted the report.
+	Err error
+}
+
+// CollectorError is returned when a collector responds with an error.
+type CollectorError struct {
+	Collector  string
+	StatusCode int
+	Message    string
+}
+
+func (e *CollectorError) Error() string {
+	return fmt.Sprintf("%s: %d %s: %s", e.Collector, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
 }
 
-func (c *Client) Submit(m *model.Measurement) error {
-	fmt.Println("dummy submit")
+// Unwrap returns ErrRejected for client errors, except for rate limiting.
+func (e *CollectorError) Unwrap() error {
+	if e.StatusCode >= 400 && e.StatusCode < 500 && e.StatusCode != http.StatusTooManyRequests {
+		return ErrRejected
+	}
 	return nil
 }
+
+// SubmitError is returned when no collector accepts a report.
+type SubmitError struct {
+	Attempts []Attempt
+}
+
+func (e *SubmitError) Error() string {
+	msgs := make([]string, 0, len(e.Attempts))
+	for _, attempt := range e.Attempts {
+		msgs = append(msgs, attempt.Err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns ErrRejected if all the collectors rejected the report, so that
+// callers know that submitting it again would not help.
+func (e *SubmitError) Unwrap() error {
+	for _, attempt := range e.Attempts {
+		if !errors.Is(attempt.Err, ErrRejected) {
+			return nil
+		}
+	}
+	return ErrRejected
+}
+
+// Geolocate fills ClientASN and ClientCC with the geolocation of the public IP of this
+// host, unless they are already set or DoGeolocation is false.
+func (c *Client) Geolocate() error {
+	if !c.DoGeolocation || (c.ClientASN != "" && c.ClientCC != "") {
+		return nil
+	}
+	geo, err := geolocate.FindCurrentHostGeolocation()
+	if err != nil {
+		return err
+	}
+	c.ClientASN = fmt.Sprintf("AS%d", geo.ASN)
+	c.ClientCC = geo.CC
+	return nil
+}
+
+// Submit sends the measurement to the collectors, in order, until one of them accepts
+// it. We move on to the next collector on network errors and server errors, and also
+// when a collector rejects the report: a backup collector might run with other
+// limits or keys. With FanOut, the report is submitted to all the collectors.
+//
+// The measurement is stamped with the client ASN and CC, if they are known and the
+// measurement does not have them. If no collector accepts the report, the error is a
+// [*SubmitError] with the outcome of every attempt.
+func (c *Client) Submit(ctx context.Context, m *model.Measurement) (*Result, error) {
+	if len(c.Collectors) == 0 {
+		return nil, ErrNoCollectors
+	}
+	if m.ClientASN == "" && m.ClientCC == "" {
+		m.ClientASN, m.ClientCC = c.ClientASN, c.ClientCC
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Attempts: make([]Attempt, len(c.Collectors))}
+	accepted := make([]*model.Measurement, len(c.Collectors))
+	if c.FanOut {
+		var wg sync.WaitGroup
+		for i, collector := range c.Collectors {
+			wg.Add(1)
+			go func(i int, collector string) {
+				defer wg.Done()
+				var err error
+				accepted[i], err = c.submitTo(ctx, collector, body)
+				result.Attempts[i] = Attempt{Collector: collector, Err: err}
+			}(i, collector)
+		}
+		wg.Wait()
+	} else {
+		for i, collector := range c.Collectors {
+			var err error
+			accepted[i], err = c.submitTo(ctx, collector, body)
+			result.Attempts[i] = Attempt{Collector: collector, Err: err}
+			if err == nil || ctx.Err() != nil {
+				result.Attempts = result.Attempts[:i+1]
+				break
+			}
+		}
+	}
+
+	for i, attempt := range result.Attempts {
+		if attempt.Err == nil && result.Report == nil {
+			result.Collector = attempt.Collector
+			result.Report = accepted[i]
+			result.OONILink = accepted[i].OOIDLink
+		}
+	}
+	if result.Report == nil {
+		return result, &SubmitError{Attempts: result.Attempts}
+	}
+	return result, nil
+}
+
+// submitTo submits the encoded measurement to a single collector.
+func (c *Client) submitTo(ctx context.Context, collector string, body []byte) (*model.Measurement, error) {
+	accepted := &model.Measurement{}
+	if err := c.post(ctx, collector, "/report", "application/json", body, accepted); err != nil {
+		return nil, err
+	}
+	return accepted, nil
+}
+
+// post sends the body to the path in a collector, and decodes the response into out.
+func (c *Client) post(ctx context.Context, collector, path, contentType string, body []byte, out any) error {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	url := strings.TrimSuffix(collector, "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("%s: %w", collector, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusAccepted:
+	default:
+		return &CollectorError{Collector: collector, StatusCode: resp.StatusCode, Message: responseMessage(data)}
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("%s: %w", collector, err)
+	}
+	return nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// responseMessage returns the message in an error response from the collector.
+func responseMessage(data []byte) string {
+	r := struct {
+		Message string `json:"msg"`
+	}{}
+	if err := json.Unmarshal(data, &r); err != nil || r.Message == "" {
+		return strings.TrimSpace(string(data))
+	}
+	return r.Message
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/google/uuid"
+)
+
+// HandshakeFunc completes the handshake of a tunnel over a connection that has just
+// been established, and returns the connection to use from then on.
+type HandshakeFunc func(ctx context.Context, conn net.Conn) (net.Conn, error)
+
+// Dialer connects to tunnel endpoints, and produces a measurement for every attempt:
+// when it started, how long it took, and what failed, if anything.
+//
+//	d := &client.Dialer{Protocol: "ss", Handshake: handshake, Emit: outbox.Emit}
+//	conn, err := d.DialContext(ctx, "tcp", "1.1.1.1:443")
+type Dialer struct {
+	// Dialer is used to connect. If nil, a zero net.Dialer is used.
+	Dialer *net.Dialer
+
+	// Protocol is the scheme of the endpoint URI in the measurements (e.g. "ss"). If
+	// empty, the network passed to DialContext is used.
+	Protocol string
+
+	// Handshake, if set, runs after connecting, and it's measured as part of the
+	// connection attempt.
+	Handshake HandshakeFunc
+
+	// HandshakeOp is the operation reported when the handshake fails. If empty,
+	// model.OpProxyHandshake is used.
+	HandshakeOp string
+
+	// Config is added to every measurement. It must not carry anything sensitive.
+	Config map[string]string
+
+	// Emit receives every measurement (e.g., [Outbox.Emit], or a function that submits
+	// them with a [Client]). If nil, measurements are discarded.
+	Emit func(m *model.Measurement)
+}
+
+// DialContext connects to the address on the named network, runs the handshake if
+// there's one, and emits a measurement with the outcome. Attempts that the caller
+// cancels are not measured.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, op, err := d.dial(ctx, network, address)
+	if !canceled(ctx, err) {
+		d.emit(network, address, start, op, err)
+	}
+	return conn, err
+}
+
+// dial connects and runs the handshake, and returns the operation that failed, if any.
+func (d *Dialer) dial(ctx context.Context, network, address string) (net.Conn, string, error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, connectOp(network, err), err
+	}
+	if d.Handshake != nil {
+		tunnel, err := d.Handshake(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, d.handshakeOp(), err
+		}
+		conn = tunnel
+	}
+	return conn, "", nil
+}
+
+// Measure runs fn, which connects to the endpoint at address in some other way (e.g., a
+// protocol over UDP), and emits a measurement with the outcome. The op is reported if
+// fn fails, normalized to the vocabulary (e.g. "openvpn_handshake" is reported as
+// model.OpProxyHandshake). The Protocol must be set. As with DialContext, attempts
+// that the caller cancels are not measured.
+func (d *Dialer) Measure(ctx context.Context, address, op string, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	err := fn(ctx)
+	if !canceled(ctx, err) {
+		d.emit("", address, start, op, err)
+	}
+	return err
+}
+
+// canceled tells whether the attempt failed because the caller canceled the context
+// (e.g., it was racing several endpoints, and another one won). That says nothing about
+// the endpoint, so it's not worth a measurement. A deadline that runs out is still a
+// failure of the endpoint, and it's measured as a timeout.
+func canceled(ctx context.Context, err error) bool {
+	return errors.Is(err, context.Canceled) && ctx.Err() != nil
+}
+
+// emit builds the measurement for an attempt, and passes it to Emit.
+func (d *Dialer) emit(network, address string, start time.Time, op string, err error) {
+	if d.Emit == nil {
+		return
+	}
+	proto := d.Protocol
+	if proto == "" {
+		proto = network
+	}
+	m := model.NewMeasurement()
+	m.Type = "tunnel-telemetry"
+	m.UUID = uuid.New().String()
+	m.DurationMS = time.Since(start).Milliseconds()
+	start = start.UTC()
+	m.TimeStart = &start
+	m.Endpoint = fmt.Sprintf("%s://%s", proto, address)
+	m.Config = maps.Clone(d.Config)
+	if err != nil {
+		m.Failure = model.NewFailure(op, err)
+		// the op can come from the caller (e.g. "openvpn_handshake").
+		m.Normalize()
+	}
+	d.Emit(m)
+}
+
+func (d *Dialer) handshakeOp() string {
+	if d.HandshakeOp != "" {
+		return d.HandshakeOp
+	}
+	return model.OpProxyHandshake
+}
+
+// connectOp returns the operation that failed while connecting.
+func connectOp(network string, err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return model.OpDNSResolve
+	case strings.HasPrefix(network, "udp"):
+		return model.OpUDPConnect
+	default:
+		return model.OpTCPConnect
+	}
+}
+
+// Emit adds the measurement to the outbox, so that it can be used as [Dialer.Emit].
+func (o *Outbox) Emit(m *model.Measurement) {
+	if err := o.Add(m); err != nil {
+		slog.Warn("cannot add measurement to the outbox", "uuid", m.UUID, "error", err)
+	}
+}
@@ -0,0 +1,260 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/itemfile"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/google/uuid"
+)
+
+var (
+	// DefaultOutboxMaxReports is the number of reports kept in the outbox, if not set.
+	DefaultOutboxMaxReports = 1000
+
+	// DefaultFlushBatchSize is the number of reports sent in every batch when flushing.
+	DefaultFlushBatchSize = 100
+
+	// ErrTooOld is returned when adding a report that the collectors would not accept
+	// anymore.
+	ErrTooOld = errors.New("report too old")
+
+	// ErrNoTime is returned when adding a report without a start time, which the
+	// collectors would not accept.
+	ErrNoTime = errors.New("report has no time")
+)
+
+// outboxItem is what we store on disk for every report in the outbox.
+type outboxItem struct {
+	Measurement *model.Measurement `json:"measurement"`
+	AddedAt     time.Time          `json:"added_at"`
+
+	// name is the file name of the item.
+	name string
+}
+
+// FlushResult is the outcome of flushing the outbox.
+type FlushResult struct {
+	// Submitted is the number of reports that a collector accepted.
+	Submitted int
+
+	// Rejected is the number of reports that a collector did not accept, and that
+	// have been removed from the outbox since sending them again would not help.
+	Rejected int
+
+	// Expired is the number of reports that were too old to be submitted.
+	Expired int
+
+	// Pending is the number of reports left in the outbox.
+	Pending int
+}
+
+// Outbox is a bounded queue, on disk, of reports that have not been submitted yet
+// (e.g., because the client had no connectivity when it produced them). Every report
+// is a file in the outbox dir, named after its UUID, so that adding the same report
+// twice only keeps it once. When the outbox is full, the oldest reports are dropped;
+// reports older than the collectors accept are dropped when flushing.
+type Outbox struct {
+	dir string
+
+	// MaxReports is the maximum number of reports in the outbox.
+	MaxReports int
+
+	// BatchSize is the number of reports sent in every batch when flushing.
+	BatchSize int
+
+	// MaxAge is the maximum age of a report. It matches what the collectors accept.
+	MaxAge time.Duration
+
+	// ClientASN and ClientCC are the network the reports are measured from, if known
+	// (e.g., from [Client.Geolocate]). Add stamps them on the reports that have none:
+	// when the outbox is flushed, the client may be on another network, and the
+	// collector would geolocate that one instead.
+	ClientASN string
+	ClientCC  string
+
+	now func() time.Time
+
+	// mu protects the files in the dir, and flushing serializes the flushes.
+	mu       sync.Mutex
+	flushing sync.Mutex
+}
+
+// NewOutbox returns an outbox that stores the reports in dir.
+func NewOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Outbox{
+		dir:        dir,
+		MaxReports: DefaultOutboxMaxReports,
+		BatchSize:  DefaultFlushBatchSize,
+		MaxAge:     time.Duration(model.AllowedLimitForOldReportsInDays) * 24 * time.Hour,
+		now:        time.Now,
+	}, nil
+}
+
+// Add puts a report in the outbox. Reports without a UUID get one, so that the
+// collector does not store them twice if they are submitted more than once.
+func (o *Outbox) Add(m *model.Measurement) error {
+	if m.TimeStart == nil {
+		return ErrNoTime
+	}
+	if o.expired(m) {
+		return ErrTooOld
+	}
+	if m.UUID == "" {
+		m.UUID = uuid.New().String()
+	}
+	if m.ClientASN == "" && m.ClientCC == "" {
+		m.ClientASN, m.ClientCC = o.ClientASN, o.ClientCC
+	}
+	it := &outboxItem{Measurement: m, AddedAt: o.now().UTC()}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := itemfile.Write(o.dir, itemfile.Name(m.UUID), it); err != nil {
+		return err
+	}
+	return o.evict()
+}
+
+// Len returns the number of reports in the outbox.
+func (o *Outbox) Len() (int, error) {
+	names, err := o.list()
+	return len(names), err
+}
+
+// Flush submits the reports in the outbox with the client, in batches, oldest first.
+// Reports that are accepted or rejected by a collector are removed from the outbox; the
+// ones that a collector asks to retry are kept. Flush stops at the first batch that no
+// collector processes, and returns its error.
+func (o *Outbox) Flush(ctx context.Context, c *Client) (*FlushResult, error) {
+	o.flushing.Lock()
+	defer o.flushing.Unlock()
+
+	result := &FlushResult{}
+	items, err := o.items()
+	if err != nil {
+		return nil, err
+	}
+	var pending []*outboxItem
+	for _, it := range items {
+		if o.expired(it.Measurement) {
+			o.remove(it.name)
+			result.Expired++
+			continue
+		}
+		pending = append(pending, it)
+	}
+
+	batchSize := o.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultFlushBatchSize
+	}
+	for len(pending) != 0 {
+		batch := pending[:min(batchSize, len(pending))]
+		mm := make([]*model.Measurement, 0, len(batch))
+		for _, it := range batch {
+			mm = append(mm, it.Measurement)
+		}
+		res, err := c.SubmitBatch(ctx, mm)
+		if err != nil {
+			result.Pending = len(pending)
+			return result, err
+		}
+		for _, r := range res.Results {
+			if r.Index < 0 || r.Index >= len(batch) {
+				continue
+			}
+			switch {
+			case r.OK:
+				result.Submitted++
+			case r.Retry:
+				continue
+			default:
+				result.Rejected++
+			}
+			o.remove(batch[r.Index].name)
+		}
+		pending = pending[len(batch):]
+	}
+	result.Pending, err = o.Len()
+	return result, err
+}
+
+// expired returns whether the collectors would reject the report for being too old.
+func (o *Outbox) expired(m *model.Measurement) bool {
+	return m.TimeStart == nil || m.TimeStart.Before(o.now().Add(-o.MaxAge))
+}
+
+// evict removes the oldest reports, until there are no more than MaxReports.
+func (o *Outbox) evict() error {
+	if o.MaxReports <= 0 {
+		return nil
+	}
+	names, err := o.list()
+	if err != nil || len(names) <= o.MaxReports {
+		return err
+	}
+	items, err := o.items()
+	if err != nil {
+		return err
+	}
+	for _, it := range items[:len(items)-o.MaxReports] {
+		o.remove(it.name)
+	}
+	return nil
+}
+
+// items returns the reports in the outbox, sorted by the time of the measurement.
+func (o *Outbox) items() ([]*outboxItem, error) {
+	names, err := o.list()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*outboxItem, 0, len(names))
+	for _, name := range names {
+		it, err := o.read(name)
+		if err != nil || it.Measurement == nil {
+			// a corrupted item is of no use to anybody.
+			o.remove(name)
+			continue
+		}
+		it.name = name
+		items = append(items, it)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return timeStart(items[i]).Before(timeStart(items[j]))
+	})
+	return items, nil
+}
+
+func timeStart(it *outboxItem) time.Time {
+	if it.Measurement.TimeStart == nil {
+		return time.Time{}
+	}
+	return *it.Measurement.TimeStart
+}
+
+func (o *Outbox) list() ([]string, error) {
+	return itemfile.List(o.dir)
+}
+
+func (o *Outbox) read(name string) (*outboxItem, error) {
+	it := &outboxItem{}
+	if err := itemfile.Read(o.dir, name, it); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+func (o *Outbox) remove(name string) {
+	os.Remove(filepath.Join(o.dir, name))
+}
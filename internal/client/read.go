@@ -0,0 +1,66 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+)
+
+// ReadMeasurements reads the measurements in r, which can be a single JSON object, a JSON
+// array, or newline-delimited JSON.
+func ReadMeasurements(r io.Reader) ([]*model.Measurement, error) {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+	first, err := firstByte(br)
+	if err != nil {
+		return nil, err
+	}
+	if first == '[' {
+		var items []json.RawMessage
+		if err := dec.Decode(&items); err != nil {
+			return nil, err
+		}
+		mm := make([]*model.Measurement, 0, len(items))
+		for i, item := range items {
+			m := model.NewMeasurement()
+			if err := json.Unmarshal(item, m); err != nil {
+				return nil, fmt.Errorf("report %d: %w", i+1, err)
+			}
+			mm = append(mm, m)
+		}
+		return mm, nil
+	}
+	var mm []*model.Measurement
+	for {
+		m := model.NewMeasurement()
+		err := dec.Decode(m)
+		if err == io.EOF {
+			return mm, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("report %d: %w", len(mm)+1, err)
+		}
+		mm = append(mm, m)
+	}
+}
+
+// firstByte returns the first byte in br that is not whitespace, without consuming it.
+func firstByte(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, br.UnreadByte()
+	}
+}
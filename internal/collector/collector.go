@@ -0,0 +1,240 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/logging"
+	"github.com/ainghazal/tunnel-telemetry/internal/metrics"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/ainghazal/tunnel-telemetry/internal/oonirelay"
+	"github.com/ainghazal/tunnel-telemetry/internal/relayqueue"
+	"github.com/ooni/probe-engine/pkg/geoipx"
+)
+
+// Collector geolocates, scrubs and stores the reports it receives in a [model.Storage],
+// and it's able to relay them upstream.
+type Collector struct {
+	config atomic.Pointer[config.Config]
+	store  model.Storage
+	queue  *relayqueue.Queue
+	relay  oonirelay.Relay
+
+	// deferred makes Submit push measurements to the queue without relaying them.
+	deferred atomic.Bool
+}
+
+// NewCollector creates a new collector that persists measurements in the passed storage.
+// If store is nil, the collector will not persist any measurement.
+func NewCollector(cfg *config.Config, store model.Storage) *Collector {
+	c := &Collector{store: store, relay: oonirelay.DirectRelay{}}
+	c.config.Store(cfg)
+	return c
+}
+
+// NewFileSystemCollector creates a new collector that stores reports in the filesystem,
+// as JSON lines under the configured data dir. If the config does not have a data dir,
+// the collector will not persist any measurement.
+func NewFileSystemCollector(cfg *config.Config) *Collector {
+	if cfg.DataDir == "" {
+		return NewCollector(cfg, nil)
+	}
+	return NewCollector(cfg, NewFileStorage(cfg))
+}
+
+// SetConfig replaces the config of the collector (e.g., to turn relaying off), while
+// it's collecting reports.
+func (c *Collector) SetConfig(cfg *config.Config) {
+	c.config.Store(cfg)
+}
+
+// SetRelayQueue configures a persistent queue where the collector defers the
+// relays that fail, so that they can be retried later.
+func (c *Collector) SetRelayQueue(q *relayqueue.Queue) {
+	c.queue = q
+}
+
+// DeferRelays makes Submit push measurements straight to the relay queue, if the
+// collector has one, instead of relaying them (e.g., when shutting down, so that they
+// are relayed after the restart).
+func (c *Collector) DeferRelays() {
+	c.deferred.Store(true)
+}
+
+// SetRelay configures how measurements are relayed to OONI. By default, the collector
+// opens a new OONI report for every measurement.
+func (c *Collector) SetRelay(r oonirelay.Relay) {
+	c.relay = r
+}
+
+func (c *Collector) Geolocate(m *model.Measurement, ip string) error {
+	asnLookup := mmdbLookupper{}
+
+	// if the client already filled ASN and CC, we don't attempt to override them,
+	// but we still need to parse and geolocate the endpoint.
+	if m.ClientASN == "" || m.ClientCC == "" {
+		if asn, _, err := asnLookup.LookupASN(ip); err == nil {
+			m.ClientASN = fmt.Sprintf("AS%d", asn)
+		} else {
+			slog.Debug("cannot geolocate client", logging.FieldClientIP, ip)
+		}
+		if cc, err := asnLookup.LookupCC(ip); err == nil {
+			m.ClientCC = cc
+		}
+	}
+
+	endpoint, err := parseEndpointURI(m.Endpoint)
+	if err != nil {
+		// the error carries the endpoint, so we do not log it.
+		slog.Debug("cannot parse endpoint", "proto", endpoint.Proto)
+		return err
+	}
+
+	m.Protocol = endpoint.Proto
+
+	if endpoint.Host != "" {
+
+		m.EndpointPort = int(endpoint.Port)
+
+		if c.config.Load().AllowPublicEndpoint {
+			// we only want to expose the endpoint address if explicitely configured to do so.
+			m.EndpointAddr = endpoint.Host
+		}
+		if asn, _, err := asnLookup.LookupASN(endpoint.Host); err == nil {
+			m.EndpointASN = fmt.Sprintf("AS%d", asn)
+		} else {
+			slog.Debug("cannot geolocate endpoint", logging.FieldEndpointIP, endpoint.Host)
+		}
+		if cc, err := asnLookup.LookupCC(endpoint.Host); err == nil {
+			m.EndpointCC = cc
+		}
+	}
+
+	return nil
+}
+
+// LookupASN implements [model.Geolocator]
+func (c *Collector) LookupASN(ip string) string {
+	asn, _, err := mmdbLookupper{}.LookupASN(ip)
+	if err != nil {
+		return "AS0"
+	}
+	return fmt.Sprintf("AS%d", asn)
+}
+
+// Save implements [model.Collector]
+func (c *Collector) Save(m *model.Measurement) error {
+	if err := m.PreSave(c.config.Load()); err != nil {
+		return err
+	}
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Save(m)
+}
+
+// Get implements [model.Collector]
+func (c *Collector) Get(uuid string) (*model.Measurement, error) {
+	if c.store == nil {
+		return nil, model.ErrNotFound
+	}
+	return c.store.Get(uuid)
+}
+
+// List implements [model.Collector]
+func (c *Collector) List(q *model.Query) ([]*model.Measurement, error) {
+	if c.store == nil {
+		return []*model.Measurement{}, nil
+	}
+	return c.store.List(q)
+}
+
+// Submit implements [model.Submitter]. It relays every measurement to OONI; the ones that
+// fail are pushed to the relay queue, if the collector has one. While relaying is turned
+// off, measurements go straight to the queue (which is paused), so that they are relayed
+// once it's turned on again.
+func (c *Collector) Submit(mm []*model.Measurement) bool {
+	relaying := c.config.Load().RelayToOONI
+	if !relaying && c.queue == nil {
+		return false
+	}
+	if (c.deferred.Load() || !relaying) && c.queue != nil {
+		ok := true
+		for _, m := range mm {
+			queued := c.queue.Push(m) == nil
+			ok = ok && queued
+		}
+		return ok
+	}
+	ok := true
+	for _, m := range mm {
+		if err := c.Relay(m); err != nil {
+			// every failed measurement is queued, even after one that cannot be.
+			queued := c.queue != nil && c.queue.Push(m) == nil
+			ok = ok && queued
+		}
+	}
+	return ok
+}
+
+// Relay submits a single measurement to OONI, and stores the OONI measurement ID
+// so that it can be looked up later. It only fails if the measurement was not submitted,
+// so that the caller can try again. The rest of the stored measurement is left as it
+// was received (e.g., it's not coarsened).
+func (c *Collector) Relay(m *model.Measurement) error {
+	start := time.Now()
+	err := c.relay.SubmitMeasurement(m)
+	metrics.ObserveRelay(metrics.RelayMeasurement, start, err)
+	if err != nil {
+		slog.Warn("cannot relay report", "uuid", m.UUID, "error", err)
+		return err
+	}
+	if c.store == nil {
+		return nil
+	}
+	// the report is already in OONI: failing here must not get it relayed again.
+	if err := c.store.SetOONIID(m.UUID, m.OOID, m.OOIDLink); err != nil {
+		slog.Warn("cannot store the OONI measurement ID", "uuid", m.UUID, "error", err)
+	}
+	return nil
+}
+
+// Close releases the underlying storage.
+func (c *Collector) Close() error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Close()
+}
+
+// Collector implements [model.GeolocatingCollector]
+var _ model.GeolocatingCollector = &Collector{}
+
+// geoipProbeIP is a well-known address that the GeoIP database must be able to geolocate.
+const geoipProbeIP = "8.8.8.8"
+
+// CheckGeoIP returns an error if the GeoIP database cannot be used to geolocate reports.
+func CheckGeoIP() error {
+	asn, _, err := mmdbLookupper{}.LookupASN(geoipProbeIP)
+	if err != nil {
+		return err
+	}
+	if asn == 0 {
+		return errors.New("geoip database returned no ASN")
+	}
+	return nil
+}
+
+type mmdbLookupper struct{}
+
+func (mmdbLookupper) LookupASN(ip string) (uint, string, error) {
+	return geoipx.LookupASN(ip)
+}
+
+func (mmdbLookupper) LookupCC(ip string) (string, error) {
+	return geoipx.LookupCC(ip)
+}
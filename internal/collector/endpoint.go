@@ -1,7 +1,6 @@
 package collector
 
 import (
-	"fmt"
 	"net"
 	"net/url"
 	"strconv"
@@ -19,7 +18,6 @@ func parseEndpointURI(uri string) (*endpoint, error) {
 	// Parse the URI
 	u, err := url.Parse(uri)
 	if err != nil {
-		fmt.Println("Error parsing URI:", err)
 		return e, err
 	}
 
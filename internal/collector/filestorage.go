@@ -0,0 +1,390 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+)
+
+var (
+	// maxLineSize is the biggest JSON line that we're willing to read back.
+	maxLineSize = 1024 * 1024
+)
+
+// FileStorage is a [model.Storage] that appends measurements, as JSON lines, to
+// daily files under the configured data dir.
+//
+// Files are append-only: setting the OONI measurement ID appends a new line, and the
+// last line for a given UUID wins when reading. The storage keeps in memory where the
+// last line for every stored UUID is (which also allows rejecting duplicates), so that
+// Get only reads that line. List scans all the files written by this collector, so this
+// storage is better suited for archival than for queries.
+type FileStorage struct {
+	// mu protects the files against a rewrite while we're reading or appending.
+	mu     sync.RWMutex
+	writer *rotatingWriter
+
+	// saving serializes the saves, and protects the index.
+	saving sync.Mutex
+	index  map[uuidHash]lineLocation
+}
+
+// uuidHash is what we keep in memory for every stored UUID, since clients choose them.
+type uuidHash [16]byte
+
+// lineLocation is where a line is in the files.
+type lineLocation struct {
+	path   string
+	offset int64
+	length int
+}
+
+func hashUUID(uuid string) uuidHash {
+	sum := sha256.Sum256([]byte(uuid))
+	return uuidHash(sum[:16])
+}
+
+// NewFileStorage returns a [FileStorage] that writes to the configured data dir.
+func NewFileStorage(cfg *config.Config) *FileStorage {
+	maxSize := int64(cfg.RotateSizeMB) * 1024 * 1024
+	return &FileStorage{
+		writer: newRotatingWriter(cfg.DataDir, cfg.CollectorID, maxSize),
+	}
+}
+
+// Save implements [model.Storage].
+func (fs *FileStorage) Save(m *model.Measurement) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fs.saving.Lock()
+	defer fs.saving.Unlock()
+
+	if err := fs.loadIndex(); err != nil {
+		return err
+	}
+	key := hashUUID(m.UUID)
+	if _, ok := fs.index[key]; ok {
+		return model.ErrDuplicate
+	}
+	loc, err := fs.writer.WriteLine(data)
+	if err != nil {
+		return err
+	}
+	fs.index[key] = loc
+	return nil
+}
+
+// loadIndex reads where the last line for every UUID is, the first time it's called.
+// The caller must hold the saving lock, and at least the read lock.
+func (fs *FileStorage) loadIndex() error {
+	if fs.index != nil {
+		return nil
+	}
+	index := make(map[uuidHash]lineLocation)
+	err := fs.scan(func(loc lineLocation, _ []byte, m *model.Measurement) {
+		index[hashUUID(m.UUID)] = loc
+	})
+	if err != nil {
+		return err
+	}
+	fs.index = index
+	return nil
+}
+
+// SetOONIID implements [model.Storage]. It appends the updated measurement, which
+// replaces the previous one when reading.
+func (fs *FileStorage) SetOONIID(uuid, id, link string) error {
+	relayed := time.Now().UTC()
+	return fs.update(uuid, func(m *model.Measurement) {
+		m.OOID, m.OOIDLink, m.TimeRelayed = id, link, &relayed
+	})
+}
+
+// SetPrivacy implements [model.Storage]. Like SetOONIID, it appends the updated measurement.
+func (fs *FileStorage) SetPrivacy(uuid, privacy string) error {
+	return fs.update(uuid, func(m *model.Measurement) {
+		m.Privacy = privacy
+	})
+}
+
+// update appends the last version of a measurement, after changing it with fn.
+func (fs *FileStorage) update(uuid string, fn func(m *model.Measurement)) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fs.saving.Lock()
+	defer fs.saving.Unlock()
+
+	if err := fs.loadIndex(); err != nil {
+		return err
+	}
+	m, err := fs.get(uuid)
+	if err != nil {
+		return err
+	}
+	fn(m)
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	loc, err := fs.writer.WriteLine(data)
+	if err != nil {
+		return err
+	}
+	fs.index[hashUUID(uuid)] = loc
+	return nil
+}
+
+// Get implements [model.Storage].
+func (fs *FileStorage) Get(uuid string) (*model.Measurement, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fs.saving.Lock()
+	defer fs.saving.Unlock()
+	if err := fs.loadIndex(); err != nil {
+		return nil, err
+	}
+	return fs.get(uuid)
+}
+
+// get reads the last version of a measurement. The caller must hold the saving lock, and
+// at least the read lock, and the index must be loaded.
+func (fs *FileStorage) get(uuid string) (*model.Measurement, error) {
+	loc, ok := fs.index[hashUUID(uuid)]
+	if !ok {
+		return nil, model.ErrNotFound
+	}
+	f, err := os.Open(loc.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line := make([]byte, loc.length)
+	if _, err := f.ReadAt(line, loc.offset); err != nil {
+		return nil, err
+	}
+	m := &model.Measurement{}
+	if err := json.Unmarshal(line, m); err != nil {
+		return nil, err
+	}
+	if m.UUID != uuid {
+		// another UUID with the same hash.
+		return nil, model.ErrNotFound
+	}
+	return m, nil
+}
+
+// List implements [model.Storage].
+func (fs *FileStorage) List(q *model.Query) ([]*model.Measurement, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	latest := make(map[string]*model.Measurement)
+	err := fs.scan(func(_ lineLocation, _ []byte, m *model.Measurement) {
+		latest[m.UUID] = m
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*model.Measurement{}
+	for _, m := range latest {
+		if q.Match(m) {
+			result = append(result, m)
+		}
+	}
+	sortMeasurements(result)
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
+	}
+	return result, nil
+}
+
+// Delete implements [model.Storage]. It rewrites any file containing the measurement.
+func (fs *FileStorage) Delete(uuid string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// the writer will reopen the current file on the next write.
+	if err := fs.writer.Close(); err != nil {
+		return err
+	}
+
+	files, err := fs.files()
+	if err != nil {
+		return err
+	}
+	deleted := false
+	for _, path := range files {
+		found, err := rewriteWithout(path, uuid)
+		if err != nil {
+			return err
+		}
+		deleted = deleted || found
+	}
+	if !deleted {
+		return model.ErrNotFound
+	}
+	// the lines after the deleted ones have moved, so the index is loaded again.
+	fs.saving.Lock()
+	fs.index = nil
+	fs.saving.Unlock()
+	return syncDir(fs.writer.dir)
+}
+
+// Check implements [model.Storage].
+func (fs *FileStorage) Check() error {
+	return checkWritable(fs.writer.dir)
+}
+
+// Close implements [model.Storage].
+func (fs *FileStorage) Close() error {
+	return fs.writer.Close()
+}
+
+// files returns the paths of all the files written by this collector, oldest first.
+func (fs *FileStorage) files() ([]string, error) {
+	pattern := filepath.Join(fs.writer.dir, "tt-"+fs.writer.name+"-*"+jsonlExtension)
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, path := range matches {
+		// the pattern also matches the files of collectors with a longer name.
+		day, seq, ok := parseFilename(path)
+		if ok && filepath.Base(path) == fs.writer.filename(day, seq) {
+			files = append(files, path)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return fileOrder(files[i]) < fileOrder(files[j])
+	})
+	return files, nil
+}
+
+// scan calls fn for every measurement stored, in the order they were written.
+func (fs *FileStorage) scan(fn func(loc lineLocation, line []byte, m *model.Measurement)) error {
+	files, err := fs.files()
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		if err := scanFile(path, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanFile(path string, fn func(loc lineLocation, line []byte, m *model.Measurement)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	scanner.Split(scanRawLines)
+	var offset int64
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		loc := lineLocation{path: path, offset: offset, length: len(line)}
+		offset += int64(len(line)) + 1
+		m := &model.Measurement{}
+		if err := json.Unmarshal(line, m); err != nil || m.UUID == "" {
+			// a truncated line after a crash; skip it.
+			continue
+		}
+		fn(loc, line, m)
+	}
+	return scanner.Err()
+}
+
+// scanRawLines is like [bufio.ScanLines], but it keeps any carriage return, so that the
+// offsets of the lines can be computed from their lengths.
+func scanRawLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// rewriteWithout atomically replaces the file at path with a copy that does not
+// contain the measurement with the given uuid. It returns true if it was found.
+func rewriteWithout(path, uuid string) (bool, error) {
+	var buf bytes.Buffer
+	found := false
+	err := scanFile(path, func(_ lineLocation, line []byte, m *model.Measurement) {
+		if m.UUID == uuid {
+			found = true
+			return
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	})
+	if err != nil || !found {
+		return found, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".rewrite-*")
+	if err != nil {
+		return found, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return found, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return found, err
+	}
+	if err := tmp.Close(); err != nil {
+		return found, err
+	}
+	if err := os.Chmod(tmp.Name(), 0o640); err != nil {
+		return found, err
+	}
+	return found, os.Rename(tmp.Name(), path)
+}
+
+// sortMeasurements sorts measurements by start time, and then by UUID.
+func sortMeasurements(mm []*model.Measurement) {
+	sort.Slice(mm, func(i, j int) bool {
+		ti, tj := mm[i].TimeStart, mm[j].TimeStart
+		switch {
+		case ti == nil && tj == nil:
+		case ti == nil:
+			return true
+		case tj == nil:
+			return false
+		case !ti.Equal(*tj):
+			return ti.Before(*tj)
+		}
+		return mm[i].UUID < mm[j].UUID
+	})
+}
+
+// FileStorage implements [model.Storage]
+var _ model.Storage = &FileStorage{}
@@ -0,0 +1,251 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// jsonlExtension is the extension for the files where we store the measurements.
+	jsonlExtension = ".jsonl"
+
+	// jsonlDateFormat is the date layout used in the file names.
+	jsonlDateFormat = "2006-01-02"
+
+	// defaultCollectorName is used in the file names when the collector has no ID.
+	defaultCollectorName = "default"
+
+	unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+)
+
+// rotatingWriter appends lines to JSONL files in a directory. Files are rotated
+// daily and, optionally, when they grow beyond a maximum size. Every file name
+// carries the collector name, so that several collectors can share the same volume:
+//
+//	tt-<collector>-<hash>-<date>.<seq>.jsonl
+type rotatingWriter struct {
+	mu      sync.Mutex
+	dir     string
+	name    string
+	maxSize int64
+	now     func() time.Time
+
+	file *os.File
+	day  string
+	seq  int
+	size int64
+}
+
+// newRotatingWriter returns a rotatingWriter for the given dir. The underlying files
+// are only opened on the first write.
+func newRotatingWriter(dir, collectorID string, maxSize int64) *rotatingWriter {
+	return &rotatingWriter{
+		dir:     dir,
+		name:    sanitizeCollectorName(collectorID),
+		maxSize: maxSize,
+		now:     time.Now,
+	}
+}
+
+// sanitizeCollectorName returns the name of the collector to use in file names. Since
+// different IDs can be the same once sanitized (e.g. "a/b" and "a.b"), the name ends
+// with a short hash of the ID.
+func sanitizeCollectorName(id string) string {
+	if id == "" {
+		return defaultCollectorName
+	}
+	sum := sha256.Sum256([]byte(id))
+	return unsafeFilenameChars.ReplaceAllString(id, "_") + "-" + hex.EncodeToString(sum[:4])
+}
+
+// WriteLine appends a single line to the current file, and syncs it to disk before returning.
+// It returns where the line was written.
+func (w *rotatingWriter) WriteLine(line []byte) (lineLocation, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.rotateIfNeeded(int64(len(line) + 1)); err != nil {
+		return lineLocation{}, err
+	}
+	buf := make([]byte, 0, len(line)+1)
+	buf = append(buf, line...)
+	buf = append(buf, '\n')
+
+	// a single write call, so that an append is never interleaved with another one.
+	loc := lineLocation{path: w.file.Name(), offset: w.size, length: len(line)}
+	n, err := w.file.Write(buf)
+	w.size += int64(n)
+	if err != nil {
+		return lineLocation{}, err
+	}
+	return loc, w.file.Sync()
+}
+
+// Close closes the file currently opened, if any.
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeFile()
+}
+
+func (w *rotatingWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// rotateIfNeeded makes sure that we have an open file that can take n more bytes.
+func (w *rotatingWriter) rotateIfNeeded(n int64) error {
+	day := w.now().UTC().Format(jsonlDateFormat)
+
+	switch {
+	case w.file == nil || day != w.day:
+		if err := w.closeFile(); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(w.dir, 0o750); err != nil {
+			return err
+		}
+		// resume from the last file for the day, if we are restarting.
+		seq, err := w.lastSeq(day)
+		if err != nil {
+			return err
+		}
+		w.day, w.seq = day, seq
+	case w.maxSize > 0 && w.size > 0 && w.size+n > w.maxSize:
+		if err := w.closeFile(); err != nil {
+			return err
+		}
+		w.seq++
+	default:
+		return nil
+	}
+	return w.openFile()
+}
+
+// openFile opens the file for the current day and sequence, rolling over to the
+// next sequence number if the file is already full.
+func (w *rotatingWriter) openFile() error {
+	for {
+		path := filepath.Join(w.dir, w.filename(w.day, w.seq))
+		_, statErr := os.Stat(path)
+		isNew := os.IsNotExist(statErr)
+
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o640)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if w.maxSize > 0 && info.Size() >= w.maxSize {
+			f.Close()
+			w.seq++
+			continue
+		}
+		if isNew {
+			// make sure that the new directory entry also survives a crash.
+			if err := syncDir(w.dir); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		size, err := terminateLastLine(f, info.Size())
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.file = f
+		w.size = size
+		return nil
+	}
+}
+
+// terminateLastLine appends a newline to the file if its last line is incomplete (e.g.,
+// it was cut short by a crash), so that the next line is not glued to it. It returns
+// the new size of the file.
+func terminateLastLine(f *os.File, size int64) (int64, error) {
+	if size == 0 {
+		return 0, nil
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, size-1); err != nil {
+		return 0, err
+	}
+	if last[0] == '\n' {
+		return size, nil
+	}
+	n, err := f.Write([]byte{'\n'})
+	return size + int64(n), err
+}
+
+func (w *rotatingWriter) filename(day string, seq int) string {
+	return fmt.Sprintf("tt-%s-%s.%d%s", w.name, day, seq, jsonlExtension)
+}
+
+// lastSeq returns the highest sequence number already present in the dir for the passed day.
+func (w *rotatingWriter) lastSeq(day string) (int, error) {
+	prefix := fmt.Sprintf("tt-%s-%s.", w.name, day)
+	matches, err := filepath.Glob(filepath.Join(w.dir, prefix+"*"+jsonlExtension))
+	if err != nil {
+		return 0, err
+	}
+	last := 0
+	for _, match := range matches {
+		_, seq, ok := parseFilename(match)
+		if ok && seq > last {
+			last = seq
+		}
+	}
+	return last, nil
+}
+
+// parseFilename extracts the date and the sequence number from the name of a file
+// written by a rotatingWriter.
+func parseFilename(path string) (string, int, bool) {
+	base := strings.TrimSuffix(filepath.Base(path), jsonlExtension)
+	dot := strings.LastIndexByte(base, '.')
+	if dot < len(jsonlDateFormat) {
+		return "", 0, false
+	}
+	seq, err := strconv.Atoi(base[dot+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	day := base[dot-len(jsonlDateFormat) : dot]
+	if _, err := time.Parse(jsonlDateFormat, day); err != nil {
+		return "", 0, false
+	}
+	return day, seq, true
+}
+
+// fileOrder returns a key that sorts the files in the order they were written.
+func fileOrder(path string) string {
+	day, seq, ok := parseFilename(path)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s.%08d", day, seq)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,280 @@
+package collector
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+
+	// registers the pure-go "sqlite" driver.
+	_ "modernc.org/sqlite"
+)
+
+var (
+	// sqlTimeFormat is a fixed-width time layout, so that timestamps sort lexicographically.
+	sqlTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+	sqlSchema = `
+CREATE TABLE IF NOT EXISTS measurements (
+	uuid                TEXT PRIMARY KEY,
+	time                TEXT NOT NULL,
+	duration_ms         INTEGER,
+	collector_id        TEXT,
+	proto               TEXT,
+	client_asn          TEXT,
+	client_cc           TEXT,
+	endpoint_asn        TEXT,
+	endpoint_cc         TEXT,
+	endpoint_port       INTEGER,
+	failure_op          TEXT,
+	failure_error       TEXT,
+	ooni_measurement_id TEXT,
+	data                TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS measurements_time ON measurements (time, uuid);
+`
+)
+
+// SQLStorage is a [model.Storage] backed by an embedded SQLite database in the
+// configured data dir. Besides the full report, the most relevant fields are
+// stored in their own columns, so that the database can be queried directly.
+type SQLStorage struct {
+	db  *sql.DB
+	dir string
+}
+
+// NewSQLStorage opens (or creates) the database for this collector under the configured data dir.
+func NewSQLStorage(cfg *config.Config) (*SQLStorage, error) {
+	if err := os.MkdirAll(cfg.DataDir, 0o750); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(cfg.DataDir, "tt-"+sanitizeCollectorName(cfg.CollectorID)+".db")
+	dsn := "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqlSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create schema: %w", err)
+	}
+	return &SQLStorage{db: db, dir: cfg.DataDir}, nil
+}
+
+// Save implements [model.Storage].
+func (s *SQLStorage) Save(m *model.Measurement) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var failureOp, failureError sql.NullString
+	if m.Failure != nil {
+		failureOp = sql.NullString{String: m.Failure.Op, Valid: true}
+		failureError = sql.NullString{String: m.Failure.Error, Valid: true}
+	}
+	res, err := s.db.Exec(`
+INSERT INTO measurements (
+	uuid, time, duration_ms, collector_id, proto, client_asn, client_cc,
+	endpoint_asn, endpoint_cc, endpoint_port, failure_op, failure_error,
+	ooni_measurement_id, data
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (uuid) DO NOTHING`,
+		m.UUID, formatSQLTime(m.TimeStart), m.DurationMS, m.CollectorID, m.Protocol,
+		m.ClientASN, m.ClientCC, m.EndpointASN, m.EndpointCC, m.EndpointPort,
+		failureOp, failureError, m.OOID, string(data),
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return model.ErrDuplicate
+	}
+	return nil
+}
+
+// SetOONIID implements [model.Storage].
+func (s *SQLStorage) SetOONIID(uuid, id, link string) error {
+	relayed := time.Now().UTC()
+	return s.update(uuid, func(m *model.Measurement) {
+		m.OOID, m.OOIDLink, m.TimeRelayed = id, link, &relayed
+	})
+}
+
+// SetPrivacy implements [model.Storage].
+func (s *SQLStorage) SetPrivacy(uuid, privacy string) error {
+	return s.update(uuid, func(m *model.Measurement) {
+		m.Privacy = privacy
+	})
+}
+
+// update changes a stored measurement with fn.
+func (s *SQLStorage) update(uuid string, fn func(m *model.Measurement)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var data string
+	err = tx.QueryRow(`SELECT data FROM measurements WHERE uuid = ?`, uuid).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	m := &model.Measurement{}
+	if err := json.Unmarshal([]byte(data), m); err != nil {
+		return err
+	}
+	fn(m)
+	updated, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE measurements SET ooni_measurement_id = ?, data = ? WHERE uuid = ?`,
+		m.OOID, string(updated), uuid)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get implements [model.Storage].
+func (s *SQLStorage) Get(uuid string) (*model.Measurement, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM measurements WHERE uuid = ?`, uuid).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, model.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &model.Measurement{}
+	if err := json.Unmarshal([]byte(data), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// List implements [model.Storage].
+func (s *SQLStorage) List(q *model.Query) ([]*model.Measurement, error) {
+	where := []string{}
+	args := []any{}
+	if q.Since != nil {
+		where = append(where, "time >= ?")
+		args = append(args, formatSQLTime(q.Since))
+	}
+	if q.Until != nil {
+		where = append(where, "time < ?")
+		args = append(args, formatSQLTime(q.Until))
+	}
+	for _, filter := range [][2]string{
+		{"proto", q.Protocol},
+		{"client_asn", q.ClientASN},
+		{"client_cc", q.ClientCC},
+		{"endpoint_asn", q.EndpointASN},
+	} {
+		if column, value := filter[0], filter[1]; value != "" {
+			where = append(where, column+" = ?")
+			args = append(args, value)
+		}
+	}
+	if q.EndpointPort != 0 {
+		where = append(where, "endpoint_port = ?")
+		args = append(args, q.EndpointPort)
+	}
+	if q.HasFailure != nil {
+		if *q.HasFailure {
+			where = append(where, "failure_op IS NOT NULL")
+		} else {
+			where = append(where, "failure_op IS NULL")
+		}
+	}
+	if q.After != nil {
+		ts := formatSQLTime(&q.After.Time)
+		where = append(where, "(time > ? OR (time = ? AND uuid > ?))")
+		args = append(args, ts, ts, q.After.UUID)
+	}
+
+	query := "SELECT data FROM measurements"
+	if len(where) != 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY time, uuid"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*model.Measurement{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		m := &model.Measurement{}
+		if err := json.Unmarshal([]byte(data), m); err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, rows.Err()
+}
+
+// Delete implements [model.Storage].
+func (s *SQLStorage) Delete(uuid string) error {
+	res, err := s.db.Exec(`DELETE FROM measurements WHERE uuid = ?`, uuid)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return model.ErrNotFound
+	}
+	return nil
+}
+
+// Check implements [model.Storage]. SQLite needs to write its journal next to the
+// database, so the data dir must be writable too.
+func (s *SQLStorage) Check() error {
+	if err := s.db.Ping(); err != nil {
+		return err
+	}
+	return checkWritable(s.dir)
+}
+
+// Close implements [model.Storage].
+func (s *SQLStorage) Close() error {
+	return s.db.Close()
+}
+
+func formatSQLTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(sqlTimeFormat)
+}
+
+// SQLStorage implements [model.Storage]
+var _ model.Storage = &SQLStorage{}
@@ -0,0 +1,53 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+)
+
+const (
+	// StorageFileSystem stores reports as JSON lines in daily files.
+	StorageFileSystem = "filesystem"
+
+	// StorageSQLite stores reports in an embedded SQLite database.
+	StorageSQLite = "sqlite"
+)
+
+// NewStorage returns the [model.Storage] selected in the config. It uses the filesystem
+// storage if no backend is explicitly configured.
+func NewStorage(cfg *config.Config) (model.Storage, error) {
+	if cfg.DataDir == "" {
+		return nil, errors.New("storage needs a data dir")
+	}
+	switch cfg.StorageBackend {
+	case "", StorageFileSystem:
+		return NewFileStorage(cfg), nil
+	case StorageSQLite:
+		return NewSQLStorage(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.StorageBackend)
+	}
+}
+
+// RelayQueueDir returns the dir, under the configured data dir, where this collector keeps the relay queue.
+func RelayQueueDir(cfg *config.Config) string {
+	return filepath.Join(cfg.DataDir, "tt-"+sanitizeCollectorName(cfg.CollectorID)+"-relay-queue")
+}
+
+// checkWritable checks that we can create files in the dir, creating it if needed.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".tt-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
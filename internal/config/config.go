@@ -1,9 +1,38 @@
 // Package config contains configuration options for the collector.
 package config
 
+import "time"
+
+const (
+	// RelayModeMeasurement relays every single measurement upstream.
+	RelayModeMeasurement = "measurement"
+
+	// RelayModeAggregate only relays periodic aggregates upstream.
+	RelayModeAggregate = "aggregate"
+)
+
+// APIKey is a key that an application uses to submit reports.
+type APIKey struct {
+	// App is the name of the application, which is stamped on its reports.
+	App string `mapstructure:"app"`
+
+	// Key is the secret that the application sends as a bearer token.
+	Key string `mapstructure:"key"`
+
+	// Disabled revokes the key.
+	Disabled bool `mapstructure:"disabled"`
+}
+
 // Config allows to customize the server's behavior.
 type Config struct {
 
+	// AggregateWindow is the length of the time window for aggregates, when relaying in aggregate mode.
+	AggregateWindow time.Duration
+
+	// APIKeys are keys for submitting reports, set in the config file. If there are
+	// any keys (here or in the KeyFile), clients must authenticate to submit reports.
+	APIKeys []APIKey
+
 	// AllowPublicEndpoint keeps the IP of the passed endpoint in the stored reports.
 	// When it's set to false (the default) the providers can avoid exposing the IP of
 	// the endpoint. For now, we'll be just storing the Port and the ASN of the target endpoint.
@@ -15,9 +44,27 @@ type Config struct {
 	// AutoTLSCache is the dir to cache LE TLS material.
 	AutoTLSCacheDir string
 
+	// BanDuration is how long an IP is banned after hitting its rate limit BanThreshold
+	// times. Bans are only kept in memory.
+	BanDuration time.Duration
+
+	// BanThreshold is the number of rate-limited requests after which an IP is banned.
+	// Zero disables bans.
+	BanThreshold int
+
+	// BatchMaxReports is the maximum number of reports that a client can send in a single batch.
+	BatchMaxReports int
+
+	// BatchMaxSizeKB is the maximum size, in kilobytes, of a batch of reports.
+	BatchMaxSizeKB int
+
 	// CollectorID is an optional ID to enrich the measurements with.
 	CollectorID string
 
+	// DataDir is the directory where the collector stores the measurements it accepts.
+	// If empty, measurements are not persisted.
+	DataDir string
+
 	// Debug sets the debug level in the logs.
 	Debug bool
 
@@ -25,25 +72,177 @@ type Config struct {
 	// they allow to spoof the RealIP from the headers.
 	DebugGeolocation bool
 
-	// Hostname is the domain used for AutoTLS.
-	Hostname string
+	// Hostnames are the domains that AutoTLS fetches certificates for, and the only ones
+	// that plain HTTP requests are redirected to.
+	Hostnames []string
+
+	// HTTPListen is an address to serve plain HTTP on, when serving TLS: it answers the
+	// ACME HTTP-01 challenges (with AutoTLS), and redirects everything else to HTTPS.
+	// Plain HTTP is not served if it's empty.
+	HTTPListen string
+
+	// KeyFile is a file with keys for submitting reports, managed with the
+	// `tt-server keys` command.
+	KeyFile string
 
 	// ListenAddr is the address where the server lsitens.
 	ListenAddr string
 
+	// LogFormat is the format of the logs: "json" (the default) or "text".
+	LogFormat string
+
+	// LogRedact is a list of field=mode entries, that sets how the IPs in each log field
+	// are written: "hash" (the default), "truncate", "drop" or "keep".
+	LogRedact []string
+
+	// MetricsListen is a separate address to serve the Prometheus metrics on. If empty,
+	// metrics are served on the main listener behind the QueryToken, or not at all if
+	// there's no token.
+	MetricsListen string
+
+	// PrivacyK is the number of distinct clients that must report from the same client
+	// network, endpoint network and protocol before their reports are relayed. Values
+	// lower than 2 disable the privacy gate.
+	PrivacyK int
+
+	// PrivacyPolicy decides what to do with the reports that did not reach PrivacyK
+	// contributors at the end of the window: "coarsen" (the default) relays them without
+	// their ASNs if that's enough to reach PrivacyK, and "drop" drops them.
+	PrivacyPolicy string
+
+	// PrivacyWindow is the time window in which distinct contributors are counted.
+	PrivacyWindow time.Duration
+
+	// ProxyProtocol enables the PROXY protocol (v1 and v2) on the listener, so that the
+	// collector sees the real client address when running behind a TCP load balancer.
+	ProxyProtocol bool
+
+	// QueryToken is the bearer token that grants access to the query API. The query API
+	// is disabled if it's empty.
+	QueryToken string
+
+	// RateLimitASN is the number of reports per minute accepted from the same client ASN.
+	// Zero disables the limit.
+	RateLimitASN int
+
+	// RateLimitIP is the number of reports per minute accepted from the same client IP (or
+	// IPv6 /64 prefix). Zero disables the limit.
+	RateLimitIP int
+
+	// ReadyMaxRelayQueue is the number of reports pending in the relay queue above which
+	// the collector reports that it's not ready. Zero disables the check.
+	ReadyMaxRelayQueue int
+
+	// ReadyMaxUpstreamOutage is how long the submissions to OONI can keep failing before
+	// the collector reports that it's not ready. Zero disables the check.
+	ReadyMaxUpstreamOutage time.Duration
+
+	// RelayBacklog is the number of reports that can wait for a relay worker. Clients
+	// are asked to retry later when the backlog is full.
+	RelayBacklog int
+
+	// RelayMaxAttempts is the number of failed attempts after which a pending relay
+	// goes to the dead-letter area.
+	RelayMaxAttempts int
+
+	// RelayMode selects whether to relay every measurement ("measurement", the default),
+	// or only periodic aggregates ("aggregate").
+	RelayMode string
+
+	// RelayReportMaxAge is how long the collector keeps an OONI report open, sending
+	// measurements into it, before closing it and opening a new one.
+	RelayReportMaxAge time.Duration
+
 	// RelayToOONI will relay reports to OONI if set.
 	RelayToOONI bool
+
+	// RelayWorkers is the number of workers that submit reports upstream in the background.
+	// If zero, reports are submitted before responding to clients.
+	RelayWorkers int
+
+	// ReportMaxSizeKB is the maximum size of a single report, in kilobytes.
+	ReportMaxSizeKB int
+
+	// StorageBackend selects where to store the measurements: "filesystem" (the default)
+	// or "sqlite".
+	StorageBackend string
+
+	// StrictDecoding rejects the reports with fields that are not part of a measurement,
+	// instead of ignoring them.
+	StrictDecoding bool
+
+	// RotateSizeMB is the size, in megabytes, after which the collector rotates the
+	// file it is writing to. Files are always rotated daily; zero disables rotation by size.
+	RotateSizeMB int
+
+	// TLSCertFile and TLSKeyFile are the files with a static certificate and its key, as an
+	// alternative to AutoTLS. They are reloaded when they change on disk.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSClientAuth is "optional" (the default) to verify client certificates only when
+	// clients send them, or "require" to reject clients without one.
+	TLSClientAuth string
+
+	// TLSClientCA is a bundle of CAs to verify client certificates with, e.g. for the
+	// links between collectors. Client certificates are not requested if it's empty.
+	TLSClientCA string
+
+	// TLSClientCertAuth accepts a verified client certificate instead of an API key (e.g.,
+	// from another collector), and uses its common name as the agent of the reports.
+	TLSClientCertAuth bool
+
+	// TrustedProxies is a list of CIDRs (or single IPs) for the reverse proxies that are
+	// trusted to pass the client IP in the X-Forwarded-For or X-Real-IP headers, or in
+	// the PROXY protocol header.
+	TrustedProxies []string
 }
 
 func NewConfig() *Config {
 	return &Config{
-		AllowPublicEndpoint: false,
-		AutoTLS:             false,
-		AutoTLSCacheDir:     "",
-		CollectorID:         "",
-		Debug:               false,
-		DebugGeolocation:    false,
-		Hostname:            "",
-		RelayToOONI:         false,
+		AggregateWindow:        time.Hour,
+		APIKeys:                nil,
+		AllowPublicEndpoint:    false,
+		AutoTLS:                false,
+		AutoTLSCacheDir:        "",
+		BanDuration:            time.Hour,
+		BanThreshold:           0,
+		BatchMaxReports:        0,
+		BatchMaxSizeKB:         0,
+		CollectorID:            "",
+		DataDir:                "",
+		Debug:                  false,
+		DebugGeolocation:       false,
+		Hostnames:              nil,
+		HTTPListen:             "",
+		KeyFile:                "",
+		LogFormat:              "json",
+		LogRedact:              nil,
+		MetricsListen:          "",
+		PrivacyK:               0,
+		PrivacyPolicy:          "coarsen",
+		PrivacyWindow:          time.Hour,
+		ProxyProtocol:          false,
+		QueryToken:             "",
+		RateLimitASN:           0,
+		RateLimitIP:            0,
+		ReadyMaxRelayQueue:     0,
+		ReadyMaxUpstreamOutage: 0,
+		RelayBacklog:           0,
+		RelayMaxAttempts:       10,
+		RelayMode:              RelayModeMeasurement,
+		RelayReportMaxAge:      time.Hour,
+		RelayToOONI:            false,
+		RelayWorkers:           0,
+		ReportMaxSizeKB:        0,
+		RotateSizeMB:           0,
+		StorageBackend:         "",
+		StrictDecoding:         false,
+		TLSCertFile:            "",
+		TLSClientAuth:          "optional",
+		TLSClientCA:            "",
+		TLSClientCertAuth:      false,
+		TLSKeyFile:             "",
+		TrustedProxies:         nil,
 	}
 }
@@ -0,0 +1,18 @@
+package config
+
+import (
+	"reflect"
+)
+
+// Diff returns the names of the fields that are different in a and b, in the order in
+// which they are declared.
+func Diff(a, b *Config) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	var changed []string
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, va.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
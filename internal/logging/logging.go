@@ -0,0 +1,145 @@
+// Package logging configures the structured logger for the collector, making sure
+// that client addresses are never written as they are.
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+)
+
+// Mode is how an IP field is written to the logs.
+type Mode string
+
+const (
+	// ModeDrop removes the field.
+	ModeDrop Mode = "drop"
+
+	// ModeHash replaces the IP with a keyed hash, which can only be correlated
+	// within the lifetime of the process.
+	ModeHash Mode = "hash"
+
+	// ModeTruncate keeps the network of the IP (/24 for IPv4, /48 for IPv6).
+	ModeTruncate Mode = "truncate"
+
+	// ModeKeep writes the IP as it is. Only meant for debugging.
+	ModeKeep Mode = "keep"
+)
+
+// Field names for IPs, used across the collector.
+const (
+	FieldClientIP   = "client_ip"
+	FieldEndpointIP = "endpoint_ip"
+	FieldPublicIP   = "public_ip"
+)
+
+var (
+	// defaultMode is the mode for the IP fields that are not configured.
+	defaultMode = ModeHash
+
+	// ipFields are the fields that always carry IPs.
+	ipFields = []string{FieldClientIP, FieldEndpointIP, FieldPublicIP}
+
+	// hashKey only lives in memory, so that hashes cannot be linked across restarts.
+	hashKey = func() []byte {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+		return key
+	}()
+)
+
+// ParseRedactions parses a list of field=mode entries. The fields that are not in the
+// list, and that are known to carry IPs, are hashed.
+func ParseRedactions(entries []string) (map[string]Mode, error) {
+	modes := make(map[string]Mode)
+	for _, field := range ipFields {
+		modes[field] = defaultMode
+	}
+	for _, entry := range entries {
+		field, mode, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || field == "" {
+			return nil, fmt.Errorf("expected field=mode: %q", entry)
+		}
+		switch Mode(mode) {
+		case ModeDrop, ModeHash, ModeTruncate, ModeKeep:
+			modes[field] = Mode(mode)
+		default:
+			return nil, fmt.Errorf("unknown mode for %s: %q", field, mode)
+		}
+	}
+	return modes, nil
+}
+
+// New returns a logger that writes to w, with the format, level and redactions in
+// the config. Invalid redactions are replaced by the defaults.
+func New(cfg *config.Config, w io.Writer) *slog.Logger {
+	modes, err := ParseRedactions(cfg.LogRedact)
+	if err != nil {
+		modes, _ = ParseRedactions(nil)
+	}
+	level := slog.LevelInfo
+	if cfg.Debug {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			mode, ok := modes[a.Key]
+			if !ok {
+				return a
+			}
+			if mode == ModeDrop {
+				return slog.Attr{}
+			}
+			return slog.String(a.Key, Redact(a.Value.String(), mode))
+		},
+	}
+	var handler slog.Handler
+	if cfg.LogFormat == "text" {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(handler)
+}
+
+// Redact returns the IP (or host:port) redacted according to the mode.
+func Redact(addr string, mode Mode) string {
+	switch mode {
+	case ModeKeep:
+		return addr
+	case ModeDrop:
+		return ""
+	case ModeTruncate:
+		host := addr
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			host = h
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return hashIP(addr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+		}
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+	default:
+		return hashIP(addr)
+	}
+}
+
+func hashIP(addr string) string {
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write([]byte(addr))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
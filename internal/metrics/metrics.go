@@ -0,0 +1,211 @@
+// Package metrics exposes the collector counters in the Prometheus text format.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/ainghazal/tunnel-telemetry/internal/relayqueue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "tt"
+
+	// labelNone is the label value for a missing value (e.g., a successful report has no failure op).
+	labelNone = "none"
+
+	// labelOther is the label value for the values that we do not track, to keep cardinality bounded.
+	labelOther = "other"
+
+	// RelayMeasurement and RelayAggregate are the kinds of relays.
+	RelayMeasurement = "measurement"
+	RelayAggregate   = "aggregate"
+)
+
+// Rejection reasons, besides the ones in [model.ValidationError].
+const (
+	RejectBadJSON        = "bad_json"
+	RejectBatchTooLarge  = "batch_too_large"
+	RejectBusy           = "busy"
+	RejectDuplicate      = "duplicate"
+	RejectRateLimitedASN = "rate_limited_asn"
+	RejectRateLimitedIP  = "rate_limited_ip"
+	RejectReportTooLarge = "report_too_large"
+	RejectStorage        = "storage"
+	RejectUnauthorized   = "unauthorized"
+)
+
+var (
+	// Registry holds all the collector metrics.
+	Registry = prometheus.NewRegistry()
+
+	factory = promauto.With(Registry)
+
+	// protocols and failureOps are the label values we track. Clients choose them, so
+	// anything else is counted as "other".
+	protocols = newLabelSet(
+		"http", "https", "hysteria", "hysteria2", "meek", "obfs4", "openvpn", "psiphon",
+		"shadowtls", "snowflake", "socks5", "ss", "tcp", "trojan", "tuic", "udp",
+		"vless", "vmess", "webtunnel", "wireguard",
+	)
+	failureOps = newLabelSet(model.Ops()...)
+
+	reportsReceived = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reports_received_total",
+		Help:      "Reports received by the report handlers.",
+	})
+
+	reportsAccepted = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reports_accepted_total",
+		Help:      "Reports accepted, by protocol and failure op.",
+	}, []string{"proto", "failure_op"})
+
+	reportsRejected = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reports_rejected_total",
+		Help:      "Reports (or requests, when rejected before parsing) rejected, by reason.",
+	}, []string{"reason"})
+
+	geolocationFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "geolocation_failures_total",
+		Help:      "Reports whose client or endpoint could not be geolocated.",
+	}, []string{"target"})
+
+	relays = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "relays_total",
+		Help:      "Relays to the upstream collector, by kind and result.",
+	}, []string{"kind", "result"})
+
+	aggregatesDropped = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "aggregates_dropped_total",
+		Help:      "Aggregates dropped after failing to relay them, when too many were pending.",
+	})
+
+	relayDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "relay_duration_seconds",
+		Help:      "Time to relay to the upstream collector, by kind and result.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"kind", "result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler returns the handler for the metrics endpoint.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// ReportsReceived counts reports that reached the handlers.
+func ReportsReceived(n int) {
+	reportsReceived.Add(float64(n))
+}
+
+// ReportAccepted counts an accepted report.
+func ReportAccepted(m *model.Measurement) {
+	op := ""
+	if m.Failure != nil {
+		op = m.Failure.Op
+	}
+	reportsAccepted.WithLabelValues(protocols.value(m.Protocol), failureOps.value(op)).Inc()
+}
+
+// ReportRejected counts a rejected report.
+func ReportRejected(reason string) {
+	reportsRejected.WithLabelValues(reason).Inc()
+}
+
+// ReportInvalid counts a report rejected by validation, using the reason in the error.
+func ReportInvalid(err error) {
+	var verr *model.ValidationError
+	if errors.As(err, &verr) {
+		ReportRejected(verr.Reason)
+		return
+	}
+	ReportRejected("invalid")
+}
+
+// GeolocationFailed counts a report whose target ("client" or "endpoint") could not be geolocated.
+func GeolocationFailed(target string) {
+	geolocationFailures.WithLabelValues(target).Inc()
+}
+
+// ObserveRelay counts a relay of the passed kind that started at start.
+func ObserveRelay(kind string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	relays.WithLabelValues(kind, result).Inc()
+	relayDuration.WithLabelValues(kind, result).Observe(time.Since(start).Seconds())
+}
+
+// AggregatesDropped counts aggregates that were dropped instead of retried.
+func AggregatesDropped(n int) {
+	aggregatesDropped.Add(float64(n))
+}
+
+// RegisterRelayQueue exposes the depth of the relay queue.
+func RegisterRelayQueue(q *relayqueue.Queue) {
+	stat := func(pending bool) func() float64 {
+		return func() float64 {
+			stats, err := q.Stats()
+			if err != nil {
+				return 0
+			}
+			if pending {
+				return float64(stats.Pending)
+			}
+			return float64(stats.Dead)
+		}
+	}
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "relay_queue_pending",
+		Help:      "Reports waiting in the relay queue to be retried.",
+	}, stat(true))
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "relay_queue_dead",
+		Help:      "Reports in the dead-letter area of the relay queue.",
+	}, stat(false))
+}
+
+// labelSet is a fixed set of label values. Anything else is counted as labelOther, so
+// that clients cannot add label values.
+type labelSet map[string]bool
+
+func newLabelSet(values ...string) labelSet {
+	ls := make(labelSet, len(values))
+	for _, v := range values {
+		ls[v] = true
+	}
+	return ls
+}
+
+// value returns v if it's in the set, and labelOther otherwise.
+func (ls labelSet) value(v string) string {
+	if v == "" {
+		return labelNone
+	}
+	if !ls[v] {
+		return labelOther
+	}
+	return v
+}
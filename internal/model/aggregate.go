@@ -0,0 +1,37 @@
+package model
+
+import (
+	"time"
+)
+
+// AggregateReportType is the report type for aggregates.
+const AggregateReportType = "tunnel-telemetry-aggregate"
+
+// Aggregate summarizes all the measurements in a time window that share the same
+// protocol, client network and endpoint network and port.
+type Aggregate struct {
+	Type         string              `json:"report-type"`
+	CollectorID  string              `json:"collector_id,omitempty"`
+	WindowStart  time.Time           `json:"window_start"`
+	WindowEnd    time.Time           `json:"window_end"`
+	Protocol     string              `json:"proto"`
+	ClientASN    string              `json:"client_asn"`
+	ClientCC     string              `json:"client_cc"`
+	EndpointASN  string              `json:"endpoint_asn"`
+	EndpointCC   string              `json:"endpoint_cc"`
+	EndpointPort int                 `json:"endpoint_port"`
+	Count        int                 `json:"count"`
+	Successes    int                 `json:"successes"`
+	Failures     int                 `json:"failures"`
+	FailureOps   map[string]int      `json:"failure_ops,omitempty"`
+	DurationMS   *DurationPercentile `json:"duration_ms,omitempty"`
+}
+
+// DurationPercentile summarizes the distribution of the durations reported in an aggregate.
+type DurationPercentile struct {
+	Min int64 `json:"min"`
+	P50 int64 `json:"p50"`
+	P90 int64 `json:"p90"`
+	P99 int64 `json:"p99"`
+	Max int64 `json:"max"`
+}
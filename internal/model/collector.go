@@ -2,8 +2,15 @@ package model
 
 // Collector receives measurements and stores them for later processing.
 type Collector interface {
-	// Save stores a valid Measurement in the internal store.
-	Save(m *Measurement) bool
+	// Save stores a valid Measurement in the internal store. It returns [ErrDuplicate] if
+	// a Measurement with the same UUID was already stored.
+	Save(m *Measurement) error
+
+	// Get returns a stored Measurement by its UUID, or [ErrNotFound].
+	Get(uuid string) (*Measurement, error)
+
+	// List returns the stored Measurements that match the query.
+	List(q *Query) ([]*Measurement, error)
 }
 
 // Geolocator is able to extract ASN and Country Code (CC) from the Real IP of the client
@@ -11,6 +18,10 @@ type Collector interface {
 type Geolocator interface {
 	// Geolocate adds geolocation metadata based on the real IP of the client submitting the report.
 	Geolocate(m *Measurement, ip string) error
+
+	// LookupASN returns the ASN of the IP (e.g. "AS3215"), or "AS0" if it's unknown. Unlike
+	// Geolocate, it never takes what the client reported.
+	LookupASN(ip string) string
 }
 
 type GeolocatingCollector interface {
@@ -23,3 +34,9 @@ type Submitter interface {
 	// Submit sends a collection of measurements to an upstream collector.
 	Submit(mm []*Measurement) bool
 }
+
+// AggregateSubmitter sends aggregates to an upstream collector.
+type AggregateSubmitter interface {
+	// SubmitAggregates sends a collection of aggregates to an upstream collector.
+	SubmitAggregates(aa []*Aggregate) error
+}
@@ -0,0 +1,252 @@
+package model
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Failure encapsulates an error reported by clients: the operation that failed, and
+// the class of the error. Both come from a fixed vocabulary, so that failures from
+// different clients can be aggregated.
+type Failure struct {
+	Op    string `json:"op"`
+	Error string `json:"error"`
+}
+
+// Operations that can fail while connecting to an endpoint. A [Failure] carries one of them.
+const (
+	OpDNSResolve     = "dns_resolve"
+	OpTCPConnect     = "tcp_connect"
+	OpUDPConnect     = "udp_connect"
+	OpTLSHandshake   = "tls_handshake"
+	OpQUICHandshake  = "quic_handshake"
+	OpProxyHandshake = "proxy_handshake"
+	OpRead           = "read"
+	OpWrite          = "write"
+)
+
+// Classes of errors, as the error of a [Failure]. They are the same strings that OONI
+// uses for its failures.
+const (
+	FailureConnectionAborted     = "connection_aborted"
+	FailureConnectionRefused     = "connection_refused"
+	FailureConnectionReset       = "connection_reset"
+	FailureDNSNXDomain           = "dns_nxdomain_error"
+	FailureDNSNoAnswer           = "dns_no_answer"
+	FailureDNSServerMisbehaving  = "dns_server_misbehaving"
+	FailureDNSTemporaryFailure   = "dns_temporary_failure"
+	FailureEOF                   = "eof_error"
+	FailureGenericTimeout        = "generic_timeout_error"
+	FailureHostUnreachable       = "host_unreachable"
+	FailureInterrupted           = "interrupted"
+	FailureNetworkUnreachable    = "network_unreachable"
+	FailureSSLFailedHandshake    = "ssl_failed_handshake"
+	FailureSSLInvalidCertificate = "ssl_invalid_certificate"
+	FailureSSLInvalidHostname    = "ssl_invalid_hostname"
+	FailureSSLUnknownAuthority   = "ssl_unknown_authority"
+	FailureUnknown               = "unknown_failure"
+)
+
+// knownOps are the operations in the vocabulary, and the names that some clients use
+// for them.
+var knownOps = map[string]string{
+	OpDNSResolve:     OpDNSResolve,
+	"dns":            OpDNSResolve,
+	"dns_lookup":     OpDNSResolve,
+	"lookup":         OpDNSResolve,
+	"resolve":        OpDNSResolve,
+	OpTCPConnect:     OpTCPConnect,
+	"connect":        OpTCPConnect,
+	"dial":           OpTCPConnect,
+	"tcp":            OpTCPConnect,
+	"tcp_dial":       OpTCPConnect,
+	OpUDPConnect:     OpUDPConnect,
+	"udp":            OpUDPConnect,
+	"udp_dial":       OpUDPConnect,
+	OpTLSHandshake:   OpTLSHandshake,
+	"tls":            OpTLSHandshake,
+	OpQUICHandshake:  OpQUICHandshake,
+	"quic":           OpQUICHandshake,
+	OpProxyHandshake: OpProxyHandshake,
+	"handshake":      OpProxyHandshake,
+	"proxy":          OpProxyHandshake,
+	OpRead:           OpRead,
+	OpWrite:          OpWrite,
+}
+
+// knownFailures are the classes of errors in the vocabulary, and the names that some
+// clients use for them.
+var knownFailures = map[string]string{
+	FailureConnectionAborted:     FailureConnectionAborted,
+	FailureConnectionRefused:     FailureConnectionRefused,
+	"econnrefused":               FailureConnectionRefused,
+	"refused":                    FailureConnectionRefused,
+	FailureConnectionReset:       FailureConnectionReset,
+	"econnreset":                 FailureConnectionReset,
+	"reset":                      FailureConnectionReset,
+	FailureDNSNXDomain:           FailureDNSNXDomain,
+	"nxdomain":                   FailureDNSNXDomain,
+	FailureDNSNoAnswer:           FailureDNSNoAnswer,
+	FailureDNSServerMisbehaving:  FailureDNSServerMisbehaving,
+	FailureDNSTemporaryFailure:   FailureDNSTemporaryFailure,
+	FailureEOF:                   FailureEOF,
+	"eof":                        FailureEOF,
+	FailureGenericTimeout:        FailureGenericTimeout,
+	"etimedout":                  FailureGenericTimeout,
+	"timeout":                    FailureGenericTimeout,
+	FailureHostUnreachable:       FailureHostUnreachable,
+	"ehostunreach":               FailureHostUnreachable,
+	FailureInterrupted:           FailureInterrupted,
+	FailureNetworkUnreachable:    FailureNetworkUnreachable,
+	"enetunreach":                FailureNetworkUnreachable,
+	FailureSSLFailedHandshake:    FailureSSLFailedHandshake,
+	FailureSSLInvalidCertificate: FailureSSLInvalidCertificate,
+	FailureSSLInvalidHostname:    FailureSSLInvalidHostname,
+	FailureSSLUnknownAuthority:   FailureSSLUnknownAuthority,
+	FailureUnknown:               FailureUnknown,
+}
+
+// failureMessages map the messages of Go errors (and other platforms) to classes of
+// errors. They are checked in order, so more specific messages come first.
+var failureMessages = []struct {
+	substring string
+	failure   string
+}{
+	{"no such host", FailureDNSNXDomain},
+	{"server misbehaving", FailureDNSServerMisbehaving},
+	{"no answer", FailureDNSNoAnswer},
+	{"connection refused", FailureConnectionRefused},
+	{"connection reset", FailureConnectionReset},
+	{"connection aborted", FailureConnectionAborted},
+	{"no route to host", FailureHostUnreachable},
+	{"host is unreachable", FailureHostUnreachable},
+	{"network is unreachable", FailureNetworkUnreachable},
+	{"certificate is valid for", FailureSSLInvalidHostname},
+	{"certificate signed by unknown authority", FailureSSLUnknownAuthority},
+	{"x509:", FailureSSLInvalidCertificate},
+	{"tls:", FailureSSLFailedHandshake},
+	{"context canceled", FailureInterrupted},
+	{"timeout", FailureGenericTimeout},
+	{"timed out", FailureGenericTimeout},
+	{"deadline exceeded", FailureGenericTimeout},
+	{"eof", FailureEOF},
+}
+
+// Ops returns the operations in the vocabulary.
+func Ops() []string {
+	ops := []string{}
+	for name, op := range knownOps {
+		if name == op {
+			ops = append(ops, op)
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// NormalizeOp returns the operation in the vocabulary for op, or an empty string if
+// there's none. Any detail after a dot (e.g. "proxy_handshake.obfs4") is dropped, and
+// the handshake of a tunnel protocol (e.g. "openvpn_handshake") is a proxy_handshake.
+func NormalizeOp(op string) string {
+	op = strings.ToLower(strings.TrimSpace(op))
+	op, _, _ = strings.Cut(op, ".")
+	op = strings.NewReplacer("-", "_", " ", "_").Replace(op)
+	if known, ok := knownOps[op]; ok {
+		return known
+	}
+	if proto, ok := strings.CutSuffix(op, "_handshake"); ok && proto != "" {
+		return OpProxyHandshake
+	}
+	return ""
+}
+
+// NormalizeError returns the class of error for a failure string, which can already
+// be a class, or the message of an error. It returns [FailureUnknown] for anything that
+// does not match a class.
+func NormalizeError(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if failure, ok := knownFailures[strings.NewReplacer("-", "_", " ", "_").Replace(s)]; ok {
+		return failure
+	}
+	for _, m := range failureMessages {
+		if strings.Contains(s, m.substring) {
+			return m.failure
+		}
+	}
+	return FailureUnknown
+}
+
+// ClassifyError returns the class of error for err. The message of the error is never
+// used as is, since it could carry addresses.
+func ClassifyError(err error) string {
+	var dnsErr *net.DNSError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certErr x509.CertificateInvalidError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return FailureInterrupted
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return FailureGenericTimeout
+	case errors.As(err, &dnsErr):
+		switch {
+		case dnsErr.IsNotFound:
+			return FailureDNSNXDomain
+		case dnsErr.IsTimeout:
+			return FailureGenericTimeout
+		case dnsErr.IsTemporary:
+			return FailureDNSTemporaryFailure
+		default:
+			return FailureDNSServerMisbehaving
+		}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return FailureConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return FailureConnectionReset
+	case errors.Is(err, syscall.ECONNABORTED):
+		return FailureConnectionAborted
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return FailureHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return FailureNetworkUnreachable
+	case errors.Is(err, syscall.ETIMEDOUT):
+		return FailureGenericTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return FailureEOF
+	case errors.As(err, &hostnameErr):
+		return FailureSSLInvalidHostname
+	case errors.As(err, &unknownAuthorityErr):
+		return FailureSSLUnknownAuthority
+	case errors.As(err, &certErr):
+		return FailureSSLInvalidCertificate
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return FailureGenericTimeout
+	}
+	// errors from other libraries (e.g. the tls handshake) only have a message.
+	return NormalizeError(err.Error())
+}
+
+// NewFailure returns the failure for an error in an operation.
+func NewFailure(op string, err error) *Failure {
+	return &Failure{Op: op, Error: ClassifyError(err)}
+}
+
+// Normalize maps the failure to the vocabulary. An operation that is not in the
+// vocabulary is kept, so that validation can reject it.
+func (f *Failure) Normalize() {
+	if op := NormalizeOp(f.Op); op != "" {
+		f.Op = op
+	}
+	f.Error = NormalizeError(f.Error)
+}
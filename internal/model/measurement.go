@@ -3,6 +3,7 @@ package model
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/ainghazal/tunnel-telemetry/internal/config"
@@ -19,37 +20,52 @@ var (
 
 	// AllowedLimitForOldReportsInDays makes server to reject reports with a timestamp older than this.
 	AllowedLimitForOldReportsInDays = 7
+
+	// MaxConfigKeys, MaxConfigKeyLength and MaxConfigValueLength limit the size of the
+	// connection config that clients can send.
+	MaxConfigKeys        = 32
+	MaxConfigKeyLength   = 64
+	MaxConfigValueLength = 256
 )
 
-// Failure encapsulates an error reported by clients.
-type Failure struct {
-	Op    string `json:"op"`
-	Error string `json:"error"`
-}
+const (
+	// PrivacyReleased marks a report whose bucket reached the privacy threshold, so it
+	// can be published as it is.
+	PrivacyReleased = "released"
+
+	// PrivacyCoarsened marks a report that was released without its ASNs, so it can only
+	// be published without them.
+	PrivacyCoarsened = "coarsened"
+)
 
 // Measurement is a single measurement reported by clients.
 type Measurement struct {
-	Type         string     `json:"report-type"`
-	UUID         string     `json:"uuid,omitempty"`
-	OOID         string     `json:"ooni-measurement-id,omitempty"`
-	OOIDLink     string     `json:"ooni-measurement-link,omitempty"`
-	TimeStart    *time.Time `json:"time"`
-	DurationMS   int64      `json:"duration_ms,omitempty"`
-	TimeReported *time.Time `json:"t_reported,omitempty"`
-	TimeRelayed  *time.Time `json:"t_relayed,omitempty"`
-	Agent        string     `json:"agent,omitempty"`
-	CollectorID  string     `json:"collector_id,omitempty"`
-	Endpoint     string     `json:"endpoint,omitempty"`
-	EndpointAddr string     `json:"endpoint_addr,omitempty"`
-	EndpointPort int        `json:"endpoint_port,omitempty"`
-	EndpointASN  string     `json:"endpoint_asn,omitempty"`
-	EndpointCC   string     `json:"endpoint_cc,omitempty"`
-	Protocol     string     `json:"proto,omitempty"`
-	Config       any        `json:"config,omitempty"`
-	ClientASN    string     `json:"client_asn"`
-	ClientCC     string     `json:"client_cc"`
-	Failure      *Failure   `json:"failure,omitempty"`
-	SamplingRate float32    `json:"sampling_rate"`
+	Type         string            `json:"report-type"`
+	UUID         string            `json:"uuid,omitempty"`
+	OOID         string            `json:"ooni-measurement-id,omitempty"`
+	OOIDLink     string            `json:"ooni-measurement-link,omitempty"`
+	TimeStart    *time.Time        `json:"time"`
+	DurationMS   int64             `json:"duration_ms,omitempty"`
+	TimeReported *time.Time        `json:"t_reported,omitempty"`
+	TimeRelayed  *time.Time        `json:"t_relayed,omitempty"`
+	Agent        string            `json:"agent,omitempty"`
+	CollectorID  string            `json:"collector_id,omitempty"`
+	Endpoint     string            `json:"endpoint,omitempty"`
+	EndpointAddr string            `json:"endpoint_addr,omitempty"`
+	EndpointPort int               `json:"endpoint_port,omitempty"`
+	EndpointASN  string            `json:"endpoint_asn,omitempty"`
+	EndpointCC   string            `json:"endpoint_cc,omitempty"`
+	Protocol     string            `json:"proto,omitempty"`
+	Config       map[string]string `json:"config,omitempty"`
+	ClientASN    string            `json:"client_asn"`
+	ClientCC     string            `json:"client_cc"`
+	Failure      *Failure          `json:"failure,omitempty"`
+	SamplingRate float32           `json:"sampling_rate"`
+	Privacy      string            `json:"privacy,omitempty"`
+
+	// Contributor is an opaque ID for the client that sent the measurement. It is only
+	// used to count distinct clients, and it's never stored or relayed.
+	Contributor string `json:"-"`
 }
 
 func NewMeasurement() *Measurement {
@@ -74,29 +90,98 @@ func NewMeasurement() *Measurement {
 	}
 }
 
+// ValidationError is returned when a measurement does not pass the sanity checks. It
+// wraps [ErrInvalidMeasurement].
+type ValidationError struct {
+	// Reason is a short, stable identifier for the check that failed (e.g., for metrics).
+	Reason string
+
+	// Msg is a human-readable explanation.
+	Msg string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrInvalidMeasurement, e.Msg)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidMeasurement
+}
+
+func invalid(reason, msg string) error {
+	return &ValidationError{Reason: reason, Msg: msg}
+}
+
 // Validate returns an error if the measurement does not pass sanity checks.
+// The error is always a [*ValidationError].
 // TODO(ain): pass time object for tests
 func (m *Measurement) Validate() error {
 	if m.Type == "" {
-		return fmt.Errorf("%w: %s", ErrInvalidMeasurement, "type cannot be empty")
+		return invalid("empty_type", "type cannot be empty")
 	}
 	if m.Type != "tunnel-telemetry" {
-		return fmt.Errorf("%w: %s", ErrInvalidMeasurement, "type should be 'tunnel-telemetry'")
+		return invalid("bad_type", "type should be 'tunnel-telemetry'")
 	}
 	if m.TimeStart == nil {
-		return fmt.Errorf("%w: %s", ErrInvalidMeasurement, "measurement must send time (t)")
+		return invalid("no_time", "measurement must send time (t)")
 	}
 	if m.TimeStart.UTC().After(time.Now().Add(time.Duration(AllowedClockSkewSeconds) * time.Second)) {
-		return fmt.Errorf("%w: %s", ErrInvalidMeasurement, "illegal time in the future (t)")
+		return invalid("time_in_future", "illegal time in the future (t)")
 	}
 	if m.TimeStart.UTC().Before(time.Now().Add(time.Duration(AllowedLimitForOldReportsInDays) * time.Hour * -24)) {
-		return fmt.Errorf("%w: %s", ErrInvalidMeasurement, "invalid time, report too old (t)")
+		return invalid("too_old", "invalid time, report too old (t)")
 	}
 	if m.DurationMS < 0 {
-		return fmt.Errorf("%w: %s", ErrInvalidMeasurement, "duration cannot be negative")
+		return invalid("negative_duration", "duration cannot be negative")
 	}
 	if m.Endpoint == "" {
-		return fmt.Errorf("%w: %s", ErrInvalidMeasurement, "endpoint cannot be empty")
+		return invalid("empty_endpoint", "endpoint cannot be empty")
+	}
+	if err := m.validateFailure(); err != nil {
+		return err
+	}
+	return m.validateConfig()
+}
+
+// Normalize maps the failure, if any, to the failure vocabulary (see [Failure]). It
+// should be called before Validate.
+func (m *Measurement) Normalize() {
+	if m.Failure != nil {
+		m.Failure.Normalize()
+	}
+}
+
+// validateFailure checks that the failure uses the vocabulary.
+func (m *Measurement) validateFailure() error {
+	if m.Failure == nil {
+		return nil
+	}
+	if m.Failure.Op == "" {
+		return invalid("failure_empty_op", "failure op cannot be empty")
+	}
+	// the error is not checked: Normalize maps anything it can't classify to
+	// unknown_failure, so that the report is kept.
+	if NormalizeOp(m.Failure.Op) != m.Failure.Op {
+		return invalid("unknown_failure_op", fmt.Sprintf("unknown failure op, expected one of: %s", strings.Join(Ops(), ", ")))
+	}
+	return nil
+}
+
+// validateConfig checks the limits for the connection config.
+func (m *Measurement) validateConfig() error {
+	if len(m.Config) > MaxConfigKeys {
+		return invalid("config_too_large", fmt.Sprintf("config cannot have more than %d keys", MaxConfigKeys))
+	}
+	for key, value := range m.Config {
+		if key == "" {
+			return invalid("config_empty_key", "config keys cannot be empty")
+		}
+		if len(key) > MaxConfigKeyLength {
+			return invalid("config_key_too_long", fmt.Sprintf("config keys cannot be longer than %d bytes", MaxConfigKeyLength))
+		}
+		if len(value) > MaxConfigValueLength {
+			return invalid("config_value_too_long", fmt.Sprintf("config value for %q cannot be longer than %d bytes", key, MaxConfigValueLength))
+		}
 	}
 	return nil
 }
@@ -108,6 +193,14 @@ func (m *Measurement) PreSave(cfg *config.Config) error {
 		// assign a UUID if the report did not have one.
 		m.UUID = uuid.New().String()
 	}
+	reported := time.Now().UTC()
+	m.TimeReported = &reported
+	// only the relay sets these, once the report is in OONI.
+	m.OOID = ""
+	m.OOIDLink = ""
+	m.TimeRelayed = nil
+	// and only the privacy gate sets this one.
+	m.Privacy = ""
 	if !cfg.AllowPublicEndpoint {
 		// scrub the endpoint IP Address.
 		m.Endpoint = ""
@@ -0,0 +1,171 @@
+package model
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by a [Storage] when there's no measurement for a given UUID.
+	ErrNotFound = errors.New("measurement not found")
+
+	// ErrInvalidCursor is returned when a pagination cursor cannot be parsed.
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	// ErrDuplicate is returned by a [Storage] when saving a measurement with the UUID of
+	// one that is already stored.
+	ErrDuplicate = errors.New("duplicate measurement")
+)
+
+// Storage persists measurements, and allows to query them later on.
+type Storage interface {
+	// Save stores a new measurement. Since UUIDs come from clients, a stored measurement
+	// is never replaced: Save returns [ErrDuplicate] if there's already one with the same UUID.
+	Save(m *Measurement) error
+
+	// SetOONIID records the OONI measurement ID (and its link) for the stored measurement
+	// with the given UUID, once it has been relayed, or returns [ErrNotFound]. It also sets
+	// the time it was relayed, and nothing else in the stored measurement changes.
+	SetOONIID(uuid, id, link string) error
+
+	// SetPrivacy records what the privacy gate decided for the stored measurement with the
+	// given UUID ([PrivacyReleased] or [PrivacyCoarsened]), or returns [ErrNotFound].
+	// Nothing else in the stored measurement changes.
+	SetPrivacy(uuid, privacy string) error
+
+	// Get returns the measurement with the given UUID, or [ErrNotFound].
+	Get(uuid string) (*Measurement, error)
+
+	// List returns the measurements that match the query, sorted by time and UUID.
+	List(q *Query) ([]*Measurement, error)
+
+	// Delete removes the measurement with the given UUID, or returns [ErrNotFound].
+	Delete(uuid string) error
+
+	// Check returns an error if the storage cannot store measurements right now.
+	Check() error
+
+	// Close releases any resources held by the storage.
+	Close() error
+}
+
+// Query selects measurements from a [Storage]. Empty fields do not filter.
+type Query struct {
+	// Since selects measurements with a start time equal or after this one.
+	Since *time.Time
+
+	// Until selects measurements with a start time before this one.
+	Until *time.Time
+
+	// Protocol selects measurements for endpoints using this protocol.
+	Protocol string
+
+	// ClientASN selects measurements from this client ASN (e.g., AS3215).
+	ClientASN string
+
+	// ClientCC selects measurements from this client country code.
+	ClientCC string
+
+	// EndpointASN selects measurements for endpoints in this ASN.
+	EndpointASN string
+
+	// EndpointPort selects measurements for endpoints on this port.
+	EndpointPort int
+
+	// HasFailure selects failed measurements if true, and successful ones if false.
+	HasFailure *bool
+
+	// After selects measurements that sort after this cursor.
+	After *Cursor
+
+	// Limit is the maximum number of measurements to return (zero means no limit).
+	Limit int
+}
+
+// Match returns true if the measurement is selected by the query filters.
+func (q *Query) Match(m *Measurement) bool {
+	// a measurement without a start time is not selected by any time filter, but the
+	// other filters still apply.
+	if m.TimeStart == nil && (q.Since != nil || q.Until != nil || q.After != nil) {
+		return false
+	}
+	if q.Since != nil && m.TimeStart.Before(*q.Since) {
+		return false
+	}
+	if q.Until != nil && !m.TimeStart.Before(*q.Until) {
+		return false
+	}
+	if q.Protocol != "" && m.Protocol != q.Protocol {
+		return false
+	}
+	if q.ClientASN != "" && m.ClientASN != q.ClientASN {
+		return false
+	}
+	if q.ClientCC != "" && m.ClientCC != q.ClientCC {
+		return false
+	}
+	if q.EndpointASN != "" && m.EndpointASN != q.EndpointASN {
+		return false
+	}
+	if q.EndpointPort != 0 && m.EndpointPort != q.EndpointPort {
+		return false
+	}
+	if q.HasFailure != nil && (m.Failure != nil) != *q.HasFailure {
+		return false
+	}
+	if q.After != nil && !q.After.Before(m) {
+		return false
+	}
+	return true
+}
+
+// Cursor is the position of a measurement in the (time, uuid) order used by [Storage.List].
+type Cursor struct {
+	Time time.Time
+	UUID string
+}
+
+// CursorFor returns the cursor pointing to the passed measurement.
+func CursorFor(m *Measurement) *Cursor {
+	c := &Cursor{UUID: m.UUID}
+	if m.TimeStart != nil {
+		c.Time = m.TimeStart.UTC()
+	}
+	return c
+}
+
+// Before returns true if the cursor sorts strictly before the measurement.
+func (c *Cursor) Before(m *Measurement) bool {
+	if m.TimeStart == nil {
+		return false
+	}
+	if !m.TimeStart.Equal(c.Time) {
+		return m.TimeStart.After(c.Time)
+	}
+	return m.UUID > c.UUID
+}
+
+// String returns an opaque representation of the cursor, suitable for URLs.
+func (c *Cursor) String() string {
+	s := c.Time.UTC().Format(time.RFC3339Nano) + "|" + c.UUID
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// ParseCursor parses a cursor returned by [Cursor.String].
+func ParseCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	ts, id, ok := strings.Cut(string(data), "|")
+	if !ok || id == "" {
+		return nil, ErrInvalidCursor
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{Time: t.UTC(), UUID: id}, nil
+}
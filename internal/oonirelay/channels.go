@@ -0,0 +1,290 @@
+package oonirelay
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+)
+
+var (
+	// DefaultChannelMaxAge is how long a report channel is kept open before rotating it.
+	DefaultChannelMaxAge = time.Hour
+
+	// rotateInterval is how often we look for channels to rotate.
+	rotateInterval = time.Minute
+)
+
+// channelKey identifies the measurements that go into the same report.
+type channelKey struct {
+	probeASN    string
+	probeCC     string
+	testVersion string
+}
+
+// channel is an open report. Measurements are sent into it concurrently, but opening
+// and closing the report wait for the sends, so that we never close a report while a
+// measurement is in flight.
+type channel struct {
+	// mu is held for reading while sending, and for writing while opening or closing.
+	mu     sync.RWMutex
+	rs     *ReportSubmitter
+	opened time.Time
+	closed bool
+}
+
+// ChannelManager keeps one open OONI report per probe ASN, probe CC and test version,
+// and sends many measurements into it, the same way a regular OONI probe does. Reports
+// are closed after they have been open for MaxAge, and when the manager is closed.
+type ChannelManager struct {
+	// API is the base URL for the OONI API.
+	API string
+
+	// Client is the HTTP client used for all the requests.
+	Client *http.Client
+
+	// MaxAge is how long a report is kept open. Use SetMaxAge to change it while the
+	// manager is running.
+	MaxAge time.Duration
+
+	now func() time.Time
+
+	mu       sync.Mutex
+	channels map[channelKey]*channel
+
+	// failingSince is when the submissions started failing (zero if the last one
+	// succeeded), and lastErr is the error of the last one.
+	failingSince time.Time
+	lastErr      error
+}
+
+// NewChannelManager returns a ChannelManager that rotates reports after maxAge.
+func NewChannelManager(maxAge time.Duration) *ChannelManager {
+	if maxAge <= 0 {
+		maxAge = DefaultChannelMaxAge
+	}
+	return &ChannelManager{
+		API:      defaultAPI,
+		Client:   &http.Client{Timeout: defaultTimeout},
+		MaxAge:   maxAge,
+		now:      time.Now,
+		channels: make(map[channelKey]*channel),
+	}
+}
+
+// SubmitMeasurement implements [Relay].
+func (cm *ChannelManager) SubmitMeasurement(mm *model.Measurement) error {
+	mmid, err := cm.send(newMeasurementBody(mm))
+	if err != nil {
+		return err
+	}
+	setMeasurementID(mm, mmid)
+	return nil
+}
+
+// SubmitAggregates implements [model.AggregateSubmitter]. It stops at the first error.
+func (cm *ChannelManager) SubmitAggregates(aa []*model.Aggregate) error {
+	for _, agg := range aa {
+		if _, err := cm.send(newAggregateBody(agg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run rotates the expired reports until the context is done. Callers should Close the
+// manager once nothing else is being sent.
+func (cm *ChannelManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(rotateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cm.Rotate()
+		}
+	}
+}
+
+// SetMaxAge changes how long reports are kept open. It applies to the reports that
+// are already open, too.
+func (cm *ChannelManager) SetMaxAge(maxAge time.Duration) {
+	if maxAge <= 0 {
+		maxAge = DefaultChannelMaxAge
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.MaxAge = maxAge
+}
+
+// Rotate closes the reports that have been open for longer than MaxAge. The next
+// measurement for the same key opens a new report.
+func (cm *ChannelManager) Rotate() {
+	cm.mu.Lock()
+	deadline := cm.now().Add(-cm.MaxAge)
+	cm.mu.Unlock()
+	for _, ch := range cm.detach(func(ch *channel) bool { return ch.opened.Before(deadline) }) {
+		ch.close()
+	}
+}
+
+// Close closes all the open reports. It returns the first error, if any.
+func (cm *ChannelManager) Close() error {
+	var firstErr error
+	for _, ch := range cm.detach(func(*channel) bool { return true }) {
+		if err := ch.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Open returns the number of open reports.
+func (cm *ChannelManager) Open() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return len(cm.channels)
+}
+
+// FailingSince returns when the submissions to OONI started failing, and the error of
+// the last one. The time is zero if the last submission succeeded, or if nothing has
+// been submitted yet.
+func (cm *ChannelManager) FailingSince() (time.Time, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.failingSince, cm.lastErr
+}
+
+// send sends the body into the report for its key, opening one if needed. If sending
+// fails, the report is discarded: the backend may have expired it, and the next
+// attempt will open a fresh one.
+func (cm *ChannelManager) send(body *measurementBody) (string, error) {
+	key := channelKey{
+		probeASN:    body.ProbeASN,
+		probeCC:     body.ProbeCC,
+		testVersion: body.TestVersion,
+	}
+	for {
+		ch := cm.channel(key)
+		ch.mu.RLock()
+		if ch.closed {
+			// it was rotated while we were waiting for it, so we get a new one.
+			ch.mu.RUnlock()
+			continue
+		}
+		if ch.rs.ReportID == "" {
+			ch.mu.RUnlock()
+			if err := cm.open(key, ch); err != nil {
+				cm.record(err)
+				return "", err
+			}
+			continue
+		}
+		reportID := ch.rs.ReportID
+		mmid, err := ch.rs.Send(body)
+		ch.mu.RUnlock()
+		if err != nil {
+			slog.Warn("discarding OONI report", "report_id", reportID, "error", err)
+			cm.forget(key, ch)
+			// the backend may still have the report open, so we try to close it.
+			if err := ch.close(); err != nil {
+				slog.Debug("cannot close OONI report", "report_id", reportID, "error", err)
+			}
+		}
+		cm.record(err)
+		return mmid, err
+	}
+}
+
+// open opens the report of the channel, unless another send has opened or closed it already.
+func (cm *ChannelManager) open(key channelKey, ch *channel) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.closed || ch.rs.ReportID != "" {
+		return nil
+	}
+	if err := ch.rs.Open(key.probeASN, key.probeCC, key.testVersion); err != nil {
+		slog.Warn("cannot open OONI report", "probe_asn", key.probeASN, "probe_cc", key.probeCC, "error", err)
+		cm.forget(key, ch)
+		ch.closed = true
+		return err
+	}
+	slog.Debug("opened OONI report", "report_id", ch.rs.ReportID, "probe_asn", key.probeASN, "probe_cc", key.probeCC)
+	return nil
+}
+
+// record records the result of a submission.
+func (cm *ChannelManager) record(err error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.lastErr = err
+	switch {
+	case err == nil:
+		cm.failingSince = time.Time{}
+	case cm.failingSince.IsZero():
+		cm.failingSince = cm.now()
+	}
+}
+
+// channel returns the channel for the key, creating it if needed.
+func (cm *ChannelManager) channel(key channelKey) *channel {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if ch, ok := cm.channels[key]; ok {
+		return ch
+	}
+	rs := NewReportSubmitter()
+	rs.API = cm.API
+	rs.Client = cm.Client
+	ch := &channel{rs: rs, opened: cm.now()}
+	cm.channels[key] = ch
+	return ch
+}
+
+// forget removes the channel for the key, unless it has been replaced already.
+func (cm *ChannelManager) forget(key channelKey, ch *channel) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.channels[key] == ch {
+		delete(cm.channels, key)
+	}
+}
+
+// detach removes the channels that match, and returns them.
+func (cm *ChannelManager) detach(match func(*channel) bool) []*channel {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	detached := []*channel{}
+	for key, ch := range cm.channels {
+		if match(ch) {
+			detached = append(detached, ch)
+			delete(cm.channels, key)
+		}
+	}
+	return detached
+}
+
+// close closes the report, once the measurements in flight have been sent.
+func (ch *channel) close() error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.closed {
+		return nil
+	}
+	ch.closed = true
+	if ch.rs.ReportID == "" {
+		return nil
+	}
+	slog.Debug("closing OONI report", "report_id", ch.rs.ReportID)
+	return ch.rs.Close()
+}
+
+// ChannelManager implements [Relay] and [model.AggregateSubmitter]
+var (
+	_ Relay                    = &ChannelManager{}
+	_ model.AggregateSubmitter = &ChannelManager{}
+)
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -12,6 +13,12 @@ import (
 )
 
 var (
+	// ErrUnexpectedStatus is returned when the OONI API does not respond with a 2xx status.
+	ErrUnexpectedStatus = errors.New("unexpected status")
+
+	// defaultTimeout is the timeout for every request to the OONI API.
+	defaultTimeout = 30 * time.Second
+
 	defaultAPI                       = "https://api.dev.ooni.io"
 	explorerBase                     = "https://explorer.ooni.org/m/"
 	timeFormat                       = "2006-01-02 15:04:05"
@@ -59,32 +66,32 @@ type reportResponse struct {
 }
 
 type testKeys struct {
-	Endpoint     string  `json:"endpoint,omitempty"`
-	EndpointPort int     `json:"endpoint_port"`
-	EndpointASN  string  `json:"endpoint_asn"`
-	EndpointCC   string  `json:"endpoint_cc"`
-	Protocol     string  `json:"protocol"`
-	Config       any     `json:"config,omitempty"`
-	SamplingRate float32 `json:"sampling_rate"`
+	Endpoint     string            `json:"endpoint,omitempty"`
+	EndpointPort int               `json:"endpoint_port"`
+	EndpointASN  string            `json:"endpoint_asn"`
+	EndpointCC   string            `json:"endpoint_cc"`
+	Protocol     string            `json:"protocol"`
+	Config       map[string]string `json:"config,omitempty"`
+	SamplingRate float32           `json:"sampling_rate"`
 }
 
 type measurementBody struct {
-	MeasurementStartTime string   `json:"measurement_start_time"`
-	ProbeASN             string   `json:"probe_asn"`
-	ProbeCC              string   `json:"probe_cc"`
-	ProbeNetworkName     string   `json:"probe_network_name"`
-	SoftwareName         string   `json:"software_name"`
-	SoftwareVersion      string   `json:"software_version"`
-	CollectorID          string   `json:"collector_id,omitempty"`
-	CollectorASN         string   `json:"collector_asn,omitempty"`
-	CollectorCC          string   `json:"collector_cc,omitempty"`
-	ReportID             string   `json:"report_id"`
-	ReportUUID           string   `json:"report_uuid,omitempty"`
-	TestKeys             testKeys `json:"test_keys"`
-	TestName             string   `json:"test_name"`
-	TestRuntime          float64  `json:"test_runtime"`
-	TestStartTime        string   `json:"test_start_time"`
-	TestVersion          string   `json:"test_version"`
+	MeasurementStartTime string  `json:"measurement_start_time"`
+	ProbeASN             string  `json:"probe_asn"`
+	ProbeCC              string  `json:"probe_cc"`
+	ProbeNetworkName     string  `json:"probe_network_name"`
+	SoftwareName         string  `json:"software_name"`
+	SoftwareVersion      string  `json:"software_version"`
+	CollectorID          string  `json:"collector_id,omitempty"`
+	CollectorASN         string  `json:"collector_asn,omitempty"`
+	CollectorCC          string  `json:"collector_cc,omitempty"`
+	ReportID             string  `json:"report_id"`
+	ReportUUID           string  `json:"report_uuid,omitempty"`
+	TestKeys             any     `json:"test_keys"`
+	TestName             string  `json:"test_name"`
+	TestRuntime          float64 `json:"test_runtime"`
+	TestStartTime        string  `json:"test_start_time"`
+	TestVersion          string  `json:"test_version"`
 }
 
 type OONIMeasurement struct {
@@ -105,7 +112,7 @@ type ReportSubmitter struct {
 func NewReportSubmitter() *ReportSubmitter {
 	return &ReportSubmitter{
 		API:    defaultAPI,
-		Client: &http.Client{},
+		Client: &http.Client{Timeout: defaultTimeout},
 	}
 }
 
@@ -121,6 +128,9 @@ func (rs *ReportSubmitter) doPostJSON(url string, data []byte, jd any) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%w: %s", ErrUnexpectedStatus, resp.Status)
+	}
 	if jd != nil {
 		if err := json.NewDecoder(resp.Body).Decode(jd); err != nil {
 			return err
@@ -163,6 +173,36 @@ func (rs *ReportSubmitter) SendMeasurement(m *OONIMeasurement) (string, error) {
 	return measurementData.MeasurementID, nil
 }
 
+// Open starts a report channel for the passed probe ASN, CC and test version.
+func (rs *ReportSubmitter) Open(probeASN, probeCC, testVersion string) error {
+	rr := NewReportRequest()
+
+	// this will silently fail to submit a working measurement if
+	// probeASN and ProbeCC were not properly set. We should take care
+	// to verify that we're logging the corner cases where we fail to geolocate here.
+	rr.ProbeASN = probeASN
+	rr.ProbeCC = probeCC
+	rr.TestVersion = testVersion
+
+	rr.TestStartTime = time.Now().UTC().Format(timeFormat)
+
+	data, err := rr.JSON()
+	if err != nil {
+		return err
+	}
+	return rs.Start(data)
+}
+
+// Send sends the measurement body in this report channel. Returns the measurement ID and any error.
+func (rs *ReportSubmitter) Send(body *measurementBody) (string, error) {
+	body.ReportID = rs.ReportID
+	m := &OONIMeasurement{
+		Format:  "json",
+		Content: *body,
+	}
+	return rs.SendMeasurement(m)
+}
+
 // Close sends the closing request for this report channel.
 func (rs *ReportSubmitter) Close() error {
 	url := rs.API + "/report/" + rs.ReportID + "/close"
@@ -172,69 +212,104 @@ func (rs *ReportSubmitter) Close() error {
 	return nil
 }
 
-// SubmitMeasurement takes a [model.Measurement] and submits a report to OONI.
-func SubmitMeasurement(mm *model.Measurement) error {
-	rs := NewReportSubmitter()
-	rr := NewReportRequest()
+// Relay submits single measurements to OONI.
+type Relay interface {
+	// SubmitMeasurement submits the measurement, and sets its OONI measurement ID.
+	SubmitMeasurement(mm *model.Measurement) error
+}
 
-	// this will silently fail to submit a working measurement if
-	// probeASN and ProbeCC were not properly set. We should take care
-	// to verify that we're logging the corner cases where we fail to geolocate here.
-	rr.ProbeASN = mm.ClientASN
-	rr.ProbeCC = mm.ClientCC
+// DirectRelay is a [Relay] that opens a new OONI report for every measurement.
+type DirectRelay struct{}
 
-	rr.TestStartTime = time.Now().UTC().Format(timeFormat)
+// SubmitMeasurement implements [Relay].
+func (DirectRelay) SubmitMeasurement(mm *model.Measurement) error {
+	return SubmitMeasurement(mm)
+}
 
-	data, err := rr.JSON()
+// SubmitMeasurement takes a [model.Measurement] and submits a report to OONI.
+func SubmitMeasurement(mm *model.Measurement) error {
+	mmid, err := submitBody(newMeasurementBody(mm))
 	if err != nil {
 		return err
 	}
+	setMeasurementID(mm, mmid)
+	return nil
+}
 
-	if err := rs.Start(data); err != nil {
-		return err
-	}
+func setMeasurementID(mm *model.Measurement, mmid string) {
+	mm.OOID = mmid
+	mm.OOIDLink = explorerBase + mmid
+}
+
+func newMeasurementBody(mm *model.Measurement) *measurementBody {
 	var runtimeSeconds float64
 	if mm.DurationMS != 0 {
 		runtimeSeconds = float64(mm.DurationMS) / 1e3
 	}
 
-	m := &OONIMeasurement{
-		Format: "json",
-		Content: measurementBody{
-			MeasurementStartTime: mm.TimeStart.UTC().Format(timeFormat),
-			ReportID:             rs.ReportID,
-			ReportUUID:           mm.UUID,
-			ProbeASN:             mm.ClientASN,
-			ProbeCC:              mm.ClientCC,
-			ProbeNetworkName:     "", // TODO: fill it in
-			CollectorID:          mm.CollectorID,
-			SoftwareName:         reporterSoftwareName,
-			SoftwareVersion:      reporterSoftwareVersion,
-			TestKeys: testKeys{
-				Endpoint:     mm.Endpoint,
-				EndpointPort: mm.EndpointPort,
-				EndpointASN:  mm.EndpointASN,
-				EndpointCC:   mm.EndpointCC,
-				Protocol:     mm.Protocol,
-				Config:       mm.Config,
-				SamplingRate: float32(mm.SamplingRate),
-			},
-			TestName:      tunnelTelemetryExperimentName,
-			TestRuntime:   runtimeSeconds,
-			TestStartTime: mm.TimeStart.UTC().Format(timeFormat),
-			TestVersion:   tunnelTelemetryExperimentVersion,
+	return &measurementBody{
+		MeasurementStartTime: mm.TimeStart.UTC().Format(timeFormat),
+		ReportUUID:           mm.UUID,
+		ProbeASN:             mm.ClientASN,
+		ProbeCC:              mm.ClientCC,
+		ProbeNetworkName:     "", // TODO: fill it in
+		CollectorID:          mm.CollectorID,
+		SoftwareName:         reporterSoftwareName,
+		SoftwareVersion:      reporterSoftwareVersion,
+		TestKeys: testKeys{
+			Endpoint:     mm.Endpoint,
+			EndpointPort: mm.EndpointPort,
+			EndpointASN:  mm.EndpointASN,
+			EndpointCC:   mm.EndpointCC,
+			Protocol:     mm.Protocol,
+			Config:       mm.Config,
+			SamplingRate: float32(mm.SamplingRate),
+		},
+		TestName:      tunnelTelemetryExperimentName,
+		TestRuntime:   runtimeSeconds,
+		TestStartTime: mm.TimeStart.UTC().Format(timeFormat),
+		TestVersion:   tunnelTelemetryExperimentVersion,
+	}
+}
+
+// aggregateTestKeys are the test keys for an aggregate, which replace the ones for single measurements.
+type aggregateTestKeys struct {
+	*model.Aggregate
+	IsAggregate bool `json:"is_aggregate"`
+}
+
+func newAggregateBody(agg *model.Aggregate) *measurementBody {
+	return &measurementBody{
+		MeasurementStartTime: agg.WindowStart.UTC().Format(timeFormat),
+		ProbeASN:             agg.ClientASN,
+		ProbeCC:              agg.ClientCC,
+		CollectorID:          agg.CollectorID,
+		SoftwareName:         reporterSoftwareName,
+		SoftwareVersion:      reporterSoftwareVersion,
+		TestKeys: aggregateTestKeys{
+			Aggregate:   agg,
+			IsAggregate: true,
 		},
+		TestName:      tunnelTelemetryExperimentName,
+		TestRuntime:   agg.WindowEnd.Sub(agg.WindowStart).Seconds(),
+		TestStartTime: agg.WindowStart.UTC().Format(timeFormat),
+		TestVersion:   tunnelTelemetryExperimentVersion,
 	}
+}
 
-	mmid, err := rs.SendMeasurement(m)
+// submitBody opens a report channel, sends the measurement body and closes the channel.
+// It returns the OONI measurement ID.
+func submitBody(body *measurementBody) (string, error) {
+	rs := NewReportSubmitter()
+	if err := rs.Open(body.ProbeASN, body.ProbeCC, body.TestVersion); err != nil {
+		return "", err
+	}
+	mmid, err := rs.Send(body)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if err := rs.Close(); err != nil {
-		return err
+		return "", err
 	}
-
-	mm.OOID = mmid
-	mm.OOIDLink = explorerBase + mmid
-	return nil
+	return mmid, nil
 }
@@ -0,0 +1,295 @@
+// Package privacy implements a k-anonymity gate that holds reports from rare
+// networks until enough distinct clients have reported from them.
+package privacy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+)
+
+const (
+	// PolicyCoarsen releases the held reports without their ASNs, if the coarser
+	// bucket (client CC and protocol) has enough contributors. Otherwise, they're dropped.
+	PolicyCoarsen = "coarsen"
+
+	// PolicyDrop drops the held reports.
+	PolicyDrop = "drop"
+
+	// coarseASN replaces the ASNs of the coarsened reports. It's what OONI expects for
+	// an unknown ASN.
+	coarseASN = "AS0"
+)
+
+var (
+	// DefaultMaxHeld is the maximum number of reports held in memory. Reports that would
+	// be held beyond it are dropped.
+	DefaultMaxHeld = 10000
+
+	// expireInterval is how often we look for windows that are over.
+	expireInterval = time.Minute
+
+	// contributorKey is the key for hashing client addresses. It only lives in memory,
+	// so that contributor IDs cannot be linked across restarts.
+	contributorKey = func() []byte {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+		return key
+	}()
+)
+
+// Contributor returns an opaque ID for the client address, so that we can count
+// distinct contributors without keeping their addresses around.
+func Contributor(ip string) string {
+	mac := hmac.New(sha256.New, contributorKey)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// bucketKey identifies the reports that can single out a client if there are too few of them.
+type bucketKey struct {
+	clientASN   string
+	clientCC    string
+	endpointASN string
+	protocol    string
+}
+
+// coarseKey is a bucketKey without the ASNs.
+type coarseKey struct {
+	clientCC string
+	protocol string
+}
+
+type bucket struct {
+	contributors map[string]struct{}
+	held         []*model.Measurement
+	released     bool
+}
+
+func keysFor(m *model.Measurement) (bucketKey, coarseKey) {
+	key := bucketKey{
+		clientASN:   m.ClientASN,
+		clientCC:    m.ClientCC,
+		endpointASN: m.EndpointASN,
+		protocol:    m.Protocol,
+	}
+	return key, coarseKey{clientCC: m.ClientCC, protocol: m.Protocol}
+}
+
+// coarsen returns a copy of the report without its ASNs.
+func coarsen(m *model.Measurement) *model.Measurement {
+	coarse := *m
+	coarse.ClientASN = coarseASN
+	coarse.EndpointASN = coarseASN
+	return &coarse
+}
+
+// Gate is a [model.Submitter] that only passes reports upstream once their bucket
+// (client ASN and CC, endpoint ASN and protocol) has k distinct contributors in the
+// current window. Until then, the reports are held in memory, up to MaxHeld. When the
+// window is over, the reports that are still held are coarsened or dropped, depending on
+// the policy. The gate also decides which stored reports can be published (see [Gate.Publish]).
+type Gate struct {
+	k      int
+	window time.Duration
+	policy string
+	next   model.Submitter
+	now    func() time.Time
+
+	// MaxHeld is the maximum number of reports held in memory.
+	MaxHeld int
+
+	// Store, if set, is where the gate records what it decided for the stored reports,
+	// so that they can be published after a restart.
+	Store model.Storage
+
+	mu          sync.Mutex
+	windowStart time.Time
+	buckets     map[bucketKey]*bucket
+	coarse      map[coarseKey]map[string]struct{}
+	held        int
+	dropped     int
+}
+
+// NewGate returns a Gate that submits the reports that pass the threshold to next.
+func NewGate(cfg *config.Config, next model.Submitter) *Gate {
+	window := cfg.PrivacyWindow
+	if window <= 0 {
+		window = time.Hour
+	}
+	policy := cfg.PrivacyPolicy
+	if policy == "" {
+		policy = PolicyCoarsen
+	}
+	g := &Gate{
+		k:       cfg.PrivacyK,
+		window:  window,
+		policy:  policy,
+		next:    next,
+		now:     time.Now,
+		MaxHeld: DefaultMaxHeld,
+	}
+	g.reset(g.now())
+	return g
+}
+
+// Submit implements [model.Submitter]. Reports in buckets that have reached k contributors
+// are passed upstream right away, together with the ones that were held for the same bucket.
+func (g *Gate) Submit(mm []*model.Measurement) bool {
+	g.mu.Lock()
+	release := []*model.Measurement{}
+	if g.now().Sub(g.windowStart) >= g.window {
+		release = g.expireLocked()
+	}
+	for _, m := range mm {
+		key, ck := keysFor(m)
+		b, ok := g.buckets[key]
+		if !ok {
+			b = &bucket{contributors: make(map[string]struct{})}
+			g.buckets[key] = b
+		}
+		b.contributors[m.Contributor] = struct{}{}
+
+		if g.coarse[ck] == nil {
+			g.coarse[ck] = make(map[string]struct{})
+		}
+		g.coarse[ck][m.Contributor] = struct{}{}
+
+		if b.released {
+			release = append(release, m)
+			continue
+		}
+		if len(b.contributors) >= g.k {
+			release = append(release, b.held...)
+			release = append(release, m)
+			g.held -= len(b.held)
+			b.held = nil
+			b.released = true
+			continue
+		}
+		if g.MaxHeld > 0 && g.held >= g.MaxHeld {
+			// the report still counts as a contributor, but it's never relayed.
+			g.dropped++
+			continue
+		}
+		b.held = append(b.held, m)
+		g.held++
+	}
+	g.mu.Unlock()
+
+	return g.submit(release, model.PrivacyReleased)
+}
+
+// Held returns the number of reports being held.
+func (g *Gate) Held() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.held
+}
+
+// Publish returns what can be published of a stored report (e.g., by the query API): the
+// report itself if it was released, a coarsened copy if it was coarsened, and nil
+// otherwise. It decides from what the gate recorded in the Store, so the reports that
+// were held, dropped, or never recorded are not published.
+func (g *Gate) Publish(m *model.Measurement) *model.Measurement {
+	switch m.Privacy {
+	case model.PrivacyReleased:
+		return m
+	case model.PrivacyCoarsened:
+		return coarsen(m)
+	default:
+		return nil
+	}
+}
+
+// Run expires the windows that are over, until the context is done. Before returning,
+// it applies the policy to all the reports that are still held.
+func (g *Gate) Run(ctx context.Context) {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			g.expire(true)
+			return
+		case <-ticker.C:
+			g.expire(false)
+		}
+	}
+}
+
+// Expire closes the current window, without waiting for it to be over.
+func (g *Gate) Expire() {
+	g.expire(true)
+}
+
+func (g *Gate) expire(force bool) {
+	g.mu.Lock()
+	var expired []*model.Measurement
+	if force || g.now().Sub(g.windowStart) >= g.window {
+		expired = g.expireLocked()
+	}
+	g.mu.Unlock()
+	g.submit(expired, model.PrivacyCoarsened)
+}
+
+// expireLocked starts a new window, and returns the held reports that can be released
+// according to the policy. The caller must hold the lock.
+func (g *Gate) expireLocked() []*model.Measurement {
+	release := []*model.Measurement{}
+	for key, b := range g.buckets {
+		if b.released {
+			continue
+		}
+		ck := coarseKey{clientCC: key.clientCC, protocol: key.protocol}
+		if g.policy != PolicyCoarsen || len(g.coarse[ck]) < g.k {
+			continue
+		}
+		for _, m := range b.held {
+			// the stored report, and anybody else holding it, keep the original.
+			release = append(release, coarsen(m))
+		}
+	}
+	if g.dropped > 0 {
+		slog.Warn("privacy gate dropped reports over the held limit", "dropped", g.dropped, "max_held", g.MaxHeld)
+	}
+	g.reset(g.now())
+	return release
+}
+
+func (g *Gate) reset(now time.Time) {
+	g.windowStart = now.UTC().Truncate(g.window)
+	g.buckets = make(map[bucketKey]*bucket)
+	g.coarse = make(map[coarseKey]map[string]struct{})
+	g.held = 0
+	g.dropped = 0
+}
+
+// submit records the decision for the released reports, and passes them upstream. The
+// decision is recorded first, so that the reports can be published once they're relayed.
+func (g *Gate) submit(mm []*model.Measurement, privacy string) bool {
+	if len(mm) == 0 {
+		return true
+	}
+	if g.Store != nil {
+		for _, m := range mm {
+			if err := g.Store.SetPrivacy(m.UUID, privacy); err != nil {
+				slog.Warn("cannot record the privacy decision", "uuid", m.UUID, "privacy", privacy, "error", err)
+			}
+		}
+	}
+	return g.next.Submit(mm)
+}
+
+// Gate implements [model.Submitter]
+var _ model.Submitter = &Gate{}
@@ -0,0 +1,274 @@
+// Package ratelimit implements token buckets keyed by client IP and by client ASN,
+// and temporary bans for the IPs that keep hitting their limit.
+package ratelimit
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"golang.org/x/time/rate"
+)
+
+var (
+	// DefaultBanDuration is how long an IP is banned, if the config does not set it.
+	DefaultBanDuration = time.Hour
+
+	// cleanupInterval is how often we forget about idle clients and expired bans.
+	cleanupInterval = time.Minute
+
+	// idleTimeout is how long a client must be idle before we forget its bucket.
+	idleTimeout = 10 * time.Minute
+
+	// unknownASN is the ASN of the clients that cannot be geolocated.
+	unknownASN = "AS0"
+)
+
+// Stats are the counters for the rejected requests.
+type Stats struct {
+	// RejectedIP is the number of requests rejected because of the per-IP limit.
+	RejectedIP int64 `json:"rejected_ip"`
+
+	// RejectedASN is the number of reports rejected because of the per-ASN limit.
+	RejectedASN int64 `json:"rejected_asn"`
+
+	// RejectedBanned is the number of requests rejected because the IP was banned.
+	RejectedBanned int64 `json:"rejected_banned"`
+
+	// Bans is the number of bans issued.
+	Bans int64 `json:"bans"`
+
+	// Banned is the number of IPs currently banned.
+	Banned int `json:"banned"`
+}
+
+type entry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type strikes struct {
+	count int
+	first time.Time
+}
+
+// Limiter keeps a token bucket per client IP and per client ASN. IPs that are rejected
+// too many times within the ban duration get banned for the ban duration. Nothing is
+// ever written to disk: bans and buckets are forgotten on restart.
+type Limiter struct {
+	ipRate       rate.Limit
+	ipBurst      int
+	asnRate      rate.Limit
+	asnBurst     int
+	banThreshold int
+	banDuration  time.Duration
+	now          func() time.Time
+
+	mu      sync.Mutex
+	ips     map[string]*entry
+	asns    map[string]*entry
+	strikes map[string]*strikes
+	bans    map[string]time.Time
+
+	rejectedIP     atomic.Int64
+	rejectedASN    atomic.Int64
+	rejectedBanned atomic.Int64
+	banCount       atomic.Int64
+}
+
+// NewLimiter returns a Limiter with the limits (in reports per minute) in the config.
+// A zero limit disables the corresponding check, and a zero ban threshold disables bans.
+func NewLimiter(cfg *config.Config) *Limiter {
+	banDuration := cfg.BanDuration
+	if banDuration <= 0 {
+		banDuration = DefaultBanDuration
+	}
+	return &Limiter{
+		ipRate:       perMinute(cfg.RateLimitIP),
+		ipBurst:      cfg.RateLimitIP,
+		asnRate:      perMinute(cfg.RateLimitASN),
+		asnBurst:     cfg.RateLimitASN,
+		banThreshold: cfg.BanThreshold,
+		banDuration:  banDuration,
+		now:          time.Now,
+		ips:          make(map[string]*entry),
+		asns:         make(map[string]*entry),
+		strikes:      make(map[string]*strikes),
+		bans:         make(map[string]time.Time),
+	}
+}
+
+func perMinute(n int) rate.Limit {
+	return rate.Limit(float64(n) / 60)
+}
+
+// AllowIP returns whether a report from the IP is allowed. If it's not, it also returns
+// how long the client should wait before retrying.
+func (l *Limiter) AllowIP(ip string) (bool, time.Duration) {
+	n, delay := l.AllowIPN(ip, 1)
+	return n == 1, delay
+}
+
+// AllowIPN charges the IP for n reports (e.g., a batch), and returns how many of them are
+// allowed: the first ones, as long as there are tokens left. If not all of them are, it
+// also returns how long the client should wait before retrying. IPv6 clients are limited
+// by their /64 prefix, since they usually get a whole prefix to pick addresses from.
+func (l *Limiter) AllowIPN(ip string, n int) (int, time.Duration) {
+	key := ipKey(ip)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	if until, ok := l.bans[key]; ok {
+		if now.Before(until) {
+			l.rejectedBanned.Add(int64(n))
+			return 0, until.Sub(now)
+		}
+		delete(l.bans, key)
+	}
+	if l.ipBurst <= 0 {
+		return n, 0
+	}
+	allowed, delay := takeN(l.ips, key, l.ipRate, l.ipBurst, n, now)
+	if allowed == n {
+		return n, 0
+	}
+	l.rejectedIP.Add(int64(n - allowed))
+	if l.strike(key, now) {
+		return allowed, l.banDuration
+	}
+	return allowed, delay
+}
+
+// ipKey returns the key of the bucket for the IP: the IP itself, or its /64 prefix for
+// IPv6 addresses.
+func ipKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Unmap().Is4() {
+		return ip
+	}
+	prefix, err := addr.Prefix(64)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// AllowASN returns whether a report from the ASN is allowed. If it's not, it also returns
+// how long the client should wait before retrying. Clients that cannot be geolocated are
+// not limited by ASN, since they would all share the same bucket.
+func (l *Limiter) AllowASN(asn string) (bool, time.Duration) {
+	if l.asnBurst <= 0 || asn == "" || asn == unknownASN {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ok, delay := take(l.asns, asn, l.asnRate, l.asnBurst, l.now())
+	if !ok {
+		l.rejectedASN.Add(1)
+	}
+	return ok, delay
+}
+
+// take consumes a token from the bucket for key, creating it if needed.
+func take(buckets map[string]*entry, key string, r rate.Limit, burst int, now time.Time) (bool, time.Duration) {
+	n, delay := takeN(buckets, key, r, burst, 1, now)
+	return n == 1, delay
+}
+
+// takeN consumes up to n tokens from the bucket for key, creating it if needed. It returns
+// how many tokens it consumed and, if fewer than n, how long until the next one.
+func takeN(buckets map[string]*entry, key string, r rate.Limit, burst, n int, now time.Time) (int, time.Duration) {
+	e, ok := buckets[key]
+	if !ok {
+		e = &entry{limiter: rate.NewLimiter(r, burst)}
+		buckets[key] = e
+	}
+	e.lastSeen = now
+	allowed := min(n, max(0, int(e.limiter.TokensAt(now))))
+	if allowed > 0 {
+		e.limiter.ReserveN(now, allowed)
+	}
+	if allowed == n {
+		return n, 0
+	}
+	res := e.limiter.ReserveN(now, 1)
+	delay := res.DelayFrom(now)
+	res.CancelAt(now)
+	return allowed, delay
+}
+
+// strike counts a rejection for the IP, and bans it if it reached the threshold.
+// It returns true if the IP has been banned.
+func (l *Limiter) strike(ip string, now time.Time) bool {
+	if l.banThreshold <= 0 {
+		return false
+	}
+	s, ok := l.strikes[ip]
+	if !ok || now.Sub(s.first) > l.banDuration {
+		s = &strikes{first: now}
+		l.strikes[ip] = s
+	}
+	s.count++
+	if s.count < l.banThreshold {
+		return false
+	}
+	delete(l.strikes, ip)
+	l.bans[ip] = now.Add(l.banDuration)
+	l.banCount.Add(1)
+	return true
+}
+
+// Stats returns the counters for the rejected requests.
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	banned := len(l.bans)
+	l.mu.Unlock()
+	return Stats{
+		RejectedIP:     l.rejectedIP.Load(),
+		RejectedASN:    l.rejectedASN.Load(),
+		RejectedBanned: l.rejectedBanned.Load(),
+		Bans:           l.banCount.Load(),
+		Banned:         banned,
+	}
+}
+
+// Run forgets idle clients and expired bans until the context is done.
+func (l *Limiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.cleanup()
+		}
+	}
+}
+
+func (l *Limiter) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for _, buckets := range []map[string]*entry{l.ips, l.asns} {
+		for key, e := range buckets {
+			if now.Sub(e.lastSeen) > idleTimeout {
+				delete(buckets, key)
+			}
+		}
+	}
+	for ip, s := range l.strikes {
+		if now.Sub(s.first) > l.banDuration {
+			delete(l.strikes, ip)
+		}
+	}
+	for ip, until := range l.bans {
+		if !now.Before(until) {
+			delete(l.bans, ip)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package relayqueue implements a persistent queue of measurements pending to be relayed upstream.
+package relayqueue
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/itemfile"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+)
+
+var (
+	// DefaultMaxAttempts is the number of attempts after which an item goes to the dead-letter area.
+	DefaultMaxAttempts = 10
+
+	// baseDelay is the delay after the first failed attempt; it doubles after every attempt.
+	baseDelay = 30 * time.Second
+
+	// maxDelay caps the delay between attempts.
+	maxDelay = 6 * time.Hour
+
+	// pollInterval is how often the worker looks for items that are due.
+	pollInterval = 5 * time.Second
+
+	pendingDir = "pending"
+	deadDir    = "dead"
+)
+
+// SubmitFunc relays a single measurement, and returns an error if it could not do it.
+type SubmitFunc func(m *model.Measurement) error
+
+// item is what we store on disk for every pending relay.
+type item struct {
+	Measurement *model.Measurement `json:"measurement"`
+	EnqueuedAt  time.Time          `json:"enqueued_at"`
+	Attempts    int                `json:"attempts"`
+	NextAttempt time.Time          `json:"next_attempt"`
+	LastError   string             `json:"last_error,omitempty"`
+}
+
+// Stats is the depth of the queue.
+type Stats struct {
+	Pending int `json:"pending"`
+	Dead    int `json:"dead"`
+}
+
+// Queue is a persistent queue of measurements pending to be relayed. Every item is a
+// file in the pending dir, so the queue survives restarts. Items that fail too many
+// times are moved to the dead dir, where they are kept for manual inspection.
+type Queue struct {
+	dir         string
+	maxAttempts atomic.Int64
+	paused      atomic.Bool
+	now         func() time.Time
+	wake        chan struct{}
+}
+
+// New returns a Queue that stores items under dir. Items are moved to the dead-letter
+// area after maxAttempts failed attempts.
+func New(dir string, maxAttempts int) (*Queue, error) {
+	for _, d := range []string{pendingDir, deadDir} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o750); err != nil {
+			return nil, err
+		}
+	}
+	q := &Queue{
+		dir:  dir,
+		now:  time.Now,
+		wake: make(chan struct{}, 1),
+	}
+	q.SetMaxAttempts(maxAttempts)
+	return q, nil
+}
+
+// SetMaxAttempts changes the number of failed attempts after which items are moved
+// to the dead-letter area. It can be called while the queue is running.
+func (q *Queue) SetMaxAttempts(maxAttempts int) {
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	q.maxAttempts.Store(int64(maxAttempts))
+}
+
+// SetPaused stops (or resumes) the processing of the items, which are kept as they
+// are in the meantime. It can be called while the queue is running.
+func (q *Queue) SetPaused(paused bool) {
+	q.paused.Store(paused)
+	if !paused {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Push adds a measurement to the queue. Pushing a measurement that is already
+// pending replaces the previous one, and resets its attempts.
+func (q *Queue) Push(m *model.Measurement) error {
+	it := &item{
+		Measurement: m,
+		EnqueuedAt:  q.now().UTC(),
+		NextAttempt: q.now().UTC(),
+	}
+	if err := q.write(pendingDir, itemfile.Name(m.UUID), it); err != nil {
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Stats returns the number of items pending, and in the dead-letter area.
+func (q *Queue) Stats() (Stats, error) {
+	pending, err := q.list(pendingDir)
+	if err != nil {
+		return Stats{}, err
+	}
+	dead, err := q.list(deadDir)
+	if err != nil {
+		return Stats{}, err
+	}
+	return Stats{Pending: len(pending), Dead: len(dead)}, nil
+}
+
+// Run processes the items that are due, until the context is done.
+func (q *Queue) Run(ctx context.Context, submit SubmitFunc) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		q.ProcessDue(ctx, submit)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// ProcessDue tries to submit all the items whose next attempt is due. Items that fail
+// are scheduled again with exponential backoff, or moved to the dead-letter area.
+func (q *Queue) ProcessDue(ctx context.Context, submit SubmitFunc) error {
+	if q.paused.Load() {
+		return nil
+	}
+	names, err := q.list(pendingDir)
+	if err != nil {
+		return err
+	}
+	now := q.now()
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if q.paused.Load() {
+			return nil
+		}
+		it, err := q.read(pendingDir, name)
+		if err != nil {
+			// a corrupted item is of no use to anybody.
+			os.Rename(q.path(pendingDir, name), q.path(deadDir, name))
+			continue
+		}
+		if it.NextAttempt.After(now) {
+			continue
+		}
+		err = submit(it.Measurement)
+		if err == nil {
+			os.Remove(q.path(pendingDir, name))
+			continue
+		}
+		it.LastError = err.Error()
+		it.Attempts++
+		if int64(it.Attempts) >= q.maxAttempts.Load() {
+			if err := q.write(deadDir, name, it); err == nil {
+				os.Remove(q.path(pendingDir, name))
+			}
+			continue
+		}
+		it.NextAttempt = q.now().UTC().Add(backoff(it.Attempts))
+		q.write(pendingDir, name, it)
+	}
+	return nil
+}
+
+// backoff returns the delay before the next attempt, with some jitter.
+func backoff(attempts int) time.Duration {
+	delay := baseDelay
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 5))
+	return delay - delay/10 + jitter
+}
+
+func (q *Queue) path(dir, name string) string {
+	return filepath.Join(q.dir, dir, name)
+}
+
+func (q *Queue) list(dir string) ([]string, error) {
+	return itemfile.List(filepath.Join(q.dir, dir))
+}
+
+func (q *Queue) read(dir, name string) (*item, error) {
+	it := &item{}
+	if err := itemfile.Read(filepath.Join(q.dir, dir), name, it); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+func (q *Queue) write(dir, name string, it *item) error {
+	return itemfile.Write(filepath.Join(q.dir, dir), name, it)
+}
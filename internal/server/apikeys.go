@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/apikeys"
+	"github.com/ainghazal/tunnel-telemetry/internal/metrics"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/labstack/echo/v4"
+)
+
+// contextKeyApp is where RequireAPIKey leaves the name of the authenticated application.
+const contextKeyApp = "tt.app"
+
+// RequireAPIKey returns a middleware that only lets through requests carrying an
+// enabled key from the keyring as a bearer token.
+func RequireAPIKey(k *apikeys.Keyring) echo.MiddlewareFunc {
+	return requireApp(k, false)
+}
+
+// RequireAPIKeyOrClientCert is like [RequireAPIKey], but it also lets through requests
+// with a verified client certificate (e.g., from another collector). It must only be
+// used when every certificate signed by the client CA identifies a trusted application.
+func RequireAPIKeyOrClientCert(k *apikeys.Keyring) echo.MiddlewareFunc {
+	return requireApp(k, true)
+}
+
+func requireApp(k *apikeys.Keyring, clientCerts bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			var app string
+			var ok bool
+			if clientCerts {
+				app, ok = clientCertApp(ctx.Request())
+			}
+			if !ok {
+				app, ok = k.Lookup(bearerToken(ctx.Request()))
+			}
+			if !ok {
+				metrics.ReportRejected(metrics.RejectUnauthorized)
+				ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				r := &Response{OK: false, Message: "unauthorized"}
+				return ctx.JSON(http.StatusUnauthorized, r)
+			}
+			ctx.Set(contextKeyApp, app)
+			return next(ctx)
+		}
+	}
+}
+
+// stampApp sets the agent of the measurement to the authenticated application, if any.
+func stampApp(ctx echo.Context, m *model.Measurement) {
+	if app, ok := ctx.Get(contextKeyApp).(string); ok {
+		m.Agent = app
+	}
+}
+
+// clientCertApp returns the common name of the client certificate, if the client sent
+// one and it was verified against the client CA bundle (e.g., another collector).
+func clientCertApp(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+}
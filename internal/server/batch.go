@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/metrics"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// DefaultBatchMaxReports is the maximum number of reports in a batch, if the handler does not set one.
+	DefaultBatchMaxReports = 500
+
+	// DefaultBatchMaxBytes is the maximum size of a batch body, if the handler does not set one.
+	DefaultBatchMaxBytes int64 = 1 << 20
+
+	// errTooManyReports is returned when a batch has more reports than allowed.
+	errTooManyReports = errors.New("too many reports")
+)
+
+// BatchItemResult is the outcome for a single report in a batch.
+type BatchItemResult struct {
+	// Index is the position of the report in the batch, starting at zero.
+	Index   int    `json:"index"`
+	UUID    string `json:"uuid,omitempty"`
+	OK      bool   `json:"ok"`
+	Message string `json:"msg,omitempty"`
+
+	// Retry is set when the report was not accepted for a reason that has nothing to
+	// do with the report itself, so that clients can send it again later.
+	Retry bool `json:"retry,omitempty"`
+}
+
+// BatchResult is returned by the server after processing a batch of reports.
+type BatchResult struct {
+	Accepted int                `json:"accepted"`
+	Rejected int                `json:"rejected"`
+	Results  []*BatchItemResult `json:"results"`
+}
+
+// CreateReportBatch creates many reports in a single request. The body is either a JSON
+// array of reports, or newline-delimited JSON (with the application/x-ndjson content type).
+// Every report is geolocated and validated on its own, and the response carries the
+// outcome for each of them.
+func (h *Handler) CreateReportBatch(ctx echo.Context) error {
+	limits := h.limits()
+	maxReports, maxBytes := limits.batchMaxReports, limits.batchMaxBytes
+
+	req := ctx.Request()
+	body := http.MaxBytesReader(ctx.Response(), req.Body, maxBytes)
+
+	var items []json.RawMessage
+	var err error
+	if strings.HasPrefix(req.Header.Get(echo.HeaderContentType), mimeNDJSON) {
+		items, err = readNDJSONItems(body, maxReports, maxBytes)
+	} else {
+		items, err = readJSONArrayItems(body, maxReports)
+	}
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		metrics.ReportRejected(metrics.RejectBatchTooLarge)
+		r := &Response{OK: false, Message: fmt.Sprintf("batch too large: max %d bytes", maxBytes)}
+		return ctx.JSON(http.StatusRequestEntityTooLarge, r)
+	case errors.Is(err, errTooManyReports):
+		metrics.ReportRejected(metrics.RejectBatchTooLarge)
+		r := &Response{OK: false, Message: fmt.Sprintf("batch too large: max %d reports", maxReports)}
+		return ctx.JSON(http.StatusRequestEntityTooLarge, r)
+	case err != nil:
+		metrics.ReportRejected(metrics.RejectBadJSON)
+		return ctx.String(http.StatusBadRequest, "bad request: cannot parse json")
+	}
+	metrics.ReportsReceived(len(items))
+
+	if h.Dispatcher != nil && h.Dispatcher.Busy() {
+		metrics.ReportRejected(metrics.RejectBusy)
+		ctx.Response().Header().Set(echo.HeaderRetryAfter, "5")
+		r := &Response{OK: false, Message: "server busy, try again later"}
+		return ctx.JSON(http.StatusServiceUnavailable, r)
+	}
+
+	// the middleware charged the client IP for the first report.
+	allowedByIP := 1 + h.allowIPN(ctx.RealIP(), len(items)-1)
+	clientASN := h.Collector.LookupASN(ctx.RealIP())
+
+	result := &BatchResult{Results: make([]*BatchItemResult, 0, len(items))}
+	accepted := []*model.Measurement{}
+	for idx, item := range items {
+		res := &BatchItemResult{Index: idx}
+		result.Results = append(result.Results, res)
+		reject := func(msg, reason string) {
+			metrics.ReportRejected(reason)
+			res.Message = msg
+			result.Rejected++
+		}
+
+		if idx >= allowedByIP {
+			reject("too many reports, try again later", metrics.RejectRateLimitedIP)
+			res.Retry = true
+			continue
+		}
+		if item == nil {
+			reject("cannot parse json", metrics.RejectBadJSON)
+			continue
+		}
+		if int64(len(item)) > limits.reportMaxBytes {
+			reject(fmt.Sprintf("report too large: max %d bytes", limits.reportMaxBytes), metrics.RejectReportTooLarge)
+			continue
+		}
+		m, err := decodeMeasurement(bytes.NewReader(item), limits.strictDecoding)
+		if err != nil {
+			reject(decodeErrorMessage(err), metrics.RejectBadJSON)
+			continue
+		}
+		stampApp(ctx, m)
+		h.geolocate(m, ctx.RealIP())
+		m.Normalize()
+		if err := m.Validate(); err != nil {
+			metrics.ReportInvalid(err)
+			res.Message = err.Error()
+			result.Rejected++
+			continue
+		}
+		if ok, _ := h.allowASN(clientASN); !ok {
+			reject("too many reports, try again later", metrics.RejectRateLimitedASN)
+			res.Retry = true
+			continue
+		}
+		err = h.Collector.Save(m)
+		if errors.Is(err, model.ErrDuplicate) {
+			reject("duplicate report", metrics.RejectDuplicate)
+			continue
+		}
+		if err != nil {
+			reject("cannot store report", metrics.RejectStorage)
+			res.Retry = true
+			continue
+		}
+		metrics.ReportAccepted(m)
+		res.OK = true
+		res.UUID = m.UUID
+		result.Accepted++
+		accepted = append(accepted, m)
+	}
+
+	// reports that do not fit in the dispatcher backlog are submitted before responding.
+	pending := []*model.Measurement{}
+	if limits.noRelay {
+		accepted = nil
+	}
+	for _, m := range accepted {
+		if h.Dispatcher == nil || h.Dispatcher.Dispatch(m) != nil {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) != 0 {
+		h.Submitter.Submit(pending)
+	}
+	requestLogger(ctx).Debug("batch processed", "accepted", result.Accepted, "rejected", result.Rejected)
+	return ctx.JSONPretty(http.StatusOK, result, "  ")
+}
+
+// readJSONArrayItems reads up to max items from a JSON array, without decoding them.
+func readJSONArrayItems(r io.Reader, max int) ([]json.RawMessage, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("expected a json array")
+	}
+	items := []json.RawMessage{}
+	for dec.More() {
+		if len(items) == max {
+			return nil, errTooManyReports
+		}
+		var item json.RawMessage
+		if err := dec.Decode(&item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, err
+		}
+		return nil, errTrailingData
+	}
+	return items, nil
+}
+
+// readNDJSONItems reads up to max non-empty lines, of at most maxBytes each. Lines that
+// are not valid JSON are returned as nil items, so that they can be rejected one by one.
+func readNDJSONItems(r io.Reader, max int, maxBytes int64) ([]json.RawMessage, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), int(maxBytes))
+	items := []json.RawMessage{}
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(items) == max {
+			return nil, errTooManyReports
+		}
+		if !json.Valid(line) {
+			items = append(items, nil)
+			continue
+		}
+		items = append(items, json.RawMessage(bytes.Clone(line)))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+)
+
+// DefaultReportMaxBytes is the maximum size of a single report.
+const DefaultReportMaxBytes = 64 * 1024
+
+// errTrailingData is returned when there's something else after the report.
+var errTrailingData = errors.New("unexpected data after the report")
+
+// decodeMeasurement decodes a single measurement. In strict mode, fields that are not
+// part of a measurement are rejected instead of ignored.
+func decodeMeasurement(r io.Reader, strict bool) (*model.Measurement, error) {
+	dec := json.NewDecoder(r)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	m := model.NewMeasurement()
+	if err := dec.Decode(m); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		// the body can also be over the limit after the report.
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, err
+		}
+		return nil, errTrailingData
+	}
+	return m, nil
+}
+
+// decodeErrorMessage returns a message that tells the client what's wrong with the report.
+func decodeErrorMessage(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var timeErr *time.ParseError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("cannot parse json: %s (at offset %d)", syntaxErr, syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Sprintf("cannot parse json: expected an object, got %s", typeErr.Value)
+		}
+		return fmt.Sprintf("cannot parse json: field %q must be %s, got %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind()), typeErr.Value)
+	case errors.As(err, &timeErr):
+		return fmt.Sprintf("cannot parse json: bad timestamp %s, expected RFC 3339", timeErr.Value)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "cannot parse json: unexpected end of input"
+	case errors.Is(err, errTrailingData):
+		return "cannot parse json: " + err.Error()
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// the decoder does not have a typed error for unknown fields.
+		return "unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	default:
+		return "cannot parse json"
+	}
+}
+
+// jsonTypeName returns the name of the JSON type for a Go kind.
+func jsonTypeName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	default:
+		return kind.String()
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+)
+
+var (
+	// ErrDispatcherBusy is returned when the dispatcher backlog is full.
+	ErrDispatcherBusy = errors.New("dispatcher is busy")
+)
+
+// Dispatcher submits measurements in the background, so that clients do not have
+// to wait for the upstream collector. It runs a fixed number of workers, and it
+// holds a bounded backlog of measurements waiting for a worker.
+type Dispatcher struct {
+	submitter model.Submitter
+	workers   int
+	jobs      chan *model.Measurement
+	once      sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewDispatcher returns a dispatcher that sends measurements to the passed submitter.
+func NewDispatcher(s model.Submitter, workers, backlog int) *Dispatcher {
+	if workers <= 0 {
+		workers = 1
+	}
+	if backlog <= 0 {
+		backlog = workers
+	}
+	return &Dispatcher{
+		submitter: s,
+		workers:   workers,
+		jobs:      make(chan *model.Measurement, backlog),
+	}
+}
+
+// Start launches the workers.
+func (d *Dispatcher) Start() {
+	for i := 0; i < d.workers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for m := range d.jobs {
+				d.submitter.Submit([]*model.Measurement{m})
+			}
+		}()
+	}
+}
+
+// Busy returns true if the backlog is full.
+func (d *Dispatcher) Busy() bool {
+	return len(d.jobs) >= cap(d.jobs)
+}
+
+// Dispatch queues a measurement for submission, without blocking. It returns
+// [ErrDispatcherBusy] if the backlog is full.
+func (d *Dispatcher) Dispatch(m *model.Measurement) error {
+	select {
+	case d.jobs <- m:
+		return nil
+	default:
+		return ErrDispatcherBusy
+	}
+}
+
+// Close stops accepting measurements, and waits for the workers to drain the backlog
+// or for the context to be done, whatever happens first. If the context is done first,
+// it returns the measurements left in the backlog, so that the caller can keep them
+// somewhere else. Dispatch must not be called after Close.
+func (d *Dispatcher) Close(ctx context.Context) ([]*model.Measurement, error) {
+	d.once.Do(func() { close(d.jobs) })
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil, nil
+	case <-ctx.Done():
+		// the workers may still take some, but none is taken twice.
+		var left []*model.Measurement
+		for m := range d.jobs {
+			left = append(left, m)
+		}
+		return left, ctx.Err()
+	}
+}
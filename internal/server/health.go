@@ -0,0 +1,93 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Paths for the liveness and readiness endpoints.
+const (
+	PathLive  = "/healthz"
+	PathReady = "/readyz"
+)
+
+// Check returns an error if a dependency of the collector is not healthy.
+type Check func() error
+
+// CheckResult is the result of a single readiness check. The error is only logged, since
+// the readiness endpoint is not authenticated.
+type CheckResult struct {
+	OK  bool  `json:"ok"`
+	Err error `json:"-"`
+}
+
+// Readiness is the response of the readiness endpoint.
+type Readiness struct {
+	OK     bool                    `json:"ok"`
+	Checks map[string]*CheckResult `json:"checks"`
+}
+
+// Health serves the liveness and readiness endpoints. The collector is ready when
+// all the checks pass.
+type Health struct {
+	mu     sync.Mutex
+	checks map[string]Check
+}
+
+// NewHealth returns a [Health] without any checks.
+func NewHealth() *Health {
+	return &Health{checks: make(map[string]Check)}
+}
+
+// Add adds a readiness check with the passed name, replacing any check with the same name.
+func (hh *Health) Add(name string, check Check) {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	hh.checks[name] = check
+}
+
+// Ready runs all the checks.
+func (hh *Health) Ready() *Readiness {
+	hh.mu.Lock()
+	checks := make(map[string]Check, len(hh.checks))
+	for name, check := range hh.checks {
+		checks[name] = check
+	}
+	hh.mu.Unlock()
+
+	r := &Readiness{OK: true, Checks: make(map[string]*CheckResult, len(checks))}
+	for name, check := range checks {
+		res := &CheckResult{OK: true}
+		if err := check(); err != nil {
+			res.OK = false
+			res.Err = err
+			r.OK = false
+		}
+		r.Checks[name] = res
+	}
+	return r
+}
+
+// HandleLive responds as long as the server is able to serve requests.
+func (hh *Health) HandleLive(ctx echo.Context) error {
+	r := &Response{OK: true, Message: "alive"}
+	return ctx.JSON(http.StatusOK, r)
+}
+
+// HandleReady responds with the name and the status of every check, with 503 if any of
+// them failed. The errors are logged instead.
+func (hh *Health) HandleReady(ctx echo.Context) error {
+	r := hh.Ready()
+	if !r.OK {
+		for name, res := range r.Checks {
+			if !res.OK {
+				slog.Warn("readiness check failed", "check", name, "error", res.Err)
+			}
+		}
+		return ctx.JSON(http.StatusServiceUnavailable, r)
+	}
+	return ctx.JSON(http.StatusOK, r)
+}
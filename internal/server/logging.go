@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/logging"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// AccessLog returns a middleware that logs every request with its request ID. The
+// client IP is logged as [logging.FieldClientIP], so that the logger redacts it; the
+// query string is never logged, since it can carry the query token. Health probes are
+// not logged, since orchestrators poll them all the time.
+func AccessLog(logger *slog.Logger) echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		Skipper: func(ctx echo.Context) bool {
+			path := ctx.Request().URL.Path
+			return path == PathLive || path == PathReady
+		},
+		HandleError:     true,
+		LogLatency:      true,
+		LogMethod:       true,
+		LogRemoteIP:     true,
+		LogRequestID:    true,
+		LogResponseSize: true,
+		LogStatus:       true,
+		LogURIPath:      true,
+		LogValuesFunc: func(ctx echo.Context, v middleware.RequestLoggerValues) error {
+			logger.LogAttrs(context.Background(), slog.LevelInfo, "request",
+				slog.String("request_id", v.RequestID),
+				slog.String("method", v.Method),
+				slog.String("path", v.URIPath),
+				slog.Int("status", v.Status),
+				slog.Duration("latency", v.Latency),
+				slog.Int64("size", v.ResponseSize),
+				slog.String(logging.FieldClientIP, v.RemoteIP),
+			)
+			return nil
+		},
+	})
+}
+
+// ErrorLog returns a logger for the ErrorLog of an [http.Server]. net/http writes the
+// client address in some of its errors (e.g., "http: TLS handshake error from
+// 1.2.3.4:5678: EOF"), so the address is taken out of the message and logged as
+// [logging.FieldClientIP], so that the logger redacts it.
+func ErrorLog(logger *slog.Logger) *log.Logger {
+	return log.New(&errorLogWriter{logger: logger}, "", 0)
+}
+
+type errorLogWriter struct {
+	logger *slog.Logger
+}
+
+func (w *errorLogWriter) Write(p []byte) (int, error) {
+	msg, clientIP := scrubAddrs(strings.TrimSpace(string(p)))
+	level := slog.LevelWarn
+	if strings.Contains(msg, "TLS handshake error") {
+		// scanners and broken clients cause plenty of these.
+		level = slog.LevelDebug
+	}
+	w.logger.LogAttrs(context.Background(), level, "http server error",
+		slog.String("error", msg),
+		slog.String(logging.FieldClientIP, clientIP),
+	)
+	return len(p), nil
+}
+
+// scrubAddrs replaces every IP (or host:port with an IP) in the message, and returns the
+// first one that it found.
+func scrubAddrs(msg string) (string, string) {
+	first := ""
+	words := strings.Split(msg, " ")
+	for i, word := range words {
+		addr := strings.TrimRight(word, ":,;")
+		host := addr
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			continue
+		}
+		if first == "" {
+			first = host
+		}
+		words[i] = strings.Replace(word, addr, "<"+logging.FieldClientIP+">", 1)
+	}
+	return strings.Join(words, " "), first
+}
+
+// requestLogger returns the default logger, annotated with the ID of the request.
+func requestLogger(ctx echo.Context) *slog.Logger {
+	return slog.With("request_id", ctx.Response().Header().Get(echo.HeaderXRequestID))
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/pires/go-proxyproto"
+)
+
+var (
+	// proxyHeaderTimeout is how long we wait for the PROXY protocol header.
+	proxyHeaderTimeout = 10 * time.Second
+)
+
+// ParseTrustedProxies parses a list of CIDRs. A single IP address is understood as
+// a range that only contains that address.
+func ParseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %q", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// trustedProxyExtractor returns an [echo.IPExtractor] that takes the client IP from the
+// X-Forwarded-For or X-Real-IP headers, but only if the request comes from one of the
+// trusted proxies. Otherwise, it uses the address of the peer.
+func trustedProxyExtractor(nets []*net.IPNet) echo.IPExtractor {
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, ipNet := range nets {
+		opts = append(opts, echo.TrustIPRange(ipNet))
+	}
+	fromXFF := echo.ExtractIPFromXFFHeader(opts...)
+	direct := echo.ExtractIPDirect()
+	return func(req *http.Request) string {
+		if req.Header.Get(echo.HeaderXForwardedFor) != "" {
+			return fromXFF(req)
+		}
+		// echo's X-Real-IP extractor checks the header, and not the peer, against the
+		// trusted ranges, so we do it ourselves.
+		directIP := direct(req)
+		realIP := strings.Trim(req.Header.Get(echo.HeaderXRealIP), "[]")
+		if realIP == "" || net.ParseIP(realIP) == nil || !containsIP(nets, directIP) {
+			return directIP
+		}
+		return realIP
+	}
+}
+
+func containsIP(nets []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrNoTrustedProxies is returned when the PROXY protocol is enabled without any trusted
+// proxies, since anybody could then pick their own client address.
+var ErrNoTrustedProxies = errors.New("the PROXY protocol needs trusted proxies")
+
+// NewListener returns a TCP listener for the configured address. If the config enables
+// the PROXY protocol, the listener takes the client address from the PROXY header (v1 or v2).
+// Only the trusted proxies can send the header; connections from anywhere else that send
+// it are rejected.
+func NewListener(cfg *config.Config) (net.Listener, error) {
+	var nets []*net.IPNet
+	if cfg.ProxyProtocol {
+		var err error
+		nets, err = ParseTrustedProxies(cfg.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		if len(nets) == 0 {
+			return nil, ErrNoTrustedProxies
+		}
+	}
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.ProxyProtocol {
+		return ln, nil
+	}
+	return &proxyproto.Listener{
+		Listener:          ln,
+		ConnPolicy:        proxyProtocolPolicy(nets),
+		ReadHeaderTimeout: proxyHeaderTimeout,
+	}, nil
+}
+
+// proxyProtocolPolicy uses the PROXY header from the trusted proxies, and rejects the
+// connections from any other peer that sends one.
+func proxyProtocolPolicy(nets []*net.IPNet) proxyproto.ConnPolicyFunc {
+	return func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+		addr, ok := opts.Upstream.(*net.TCPAddr)
+		if ok && containsIP(nets, addr.IP.String()) {
+			return proxyproto.USE, nil
+		}
+		return proxyproto.REJECT, nil
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// defaultQueryLimit is the page size when the client does not pass a limit.
+	defaultQueryLimit = 100
+
+	// maxQueryLimit is the biggest page size that we're willing to return.
+	maxQueryLimit = 1000
+
+	// headerNextCursor carries the cursor for the next page, if there's one.
+	headerNextCursor = "X-Next-Cursor"
+
+	// mimeNDJSON is the content type for newline-delimited JSON.
+	mimeNDJSON = "application/x-ndjson"
+)
+
+// ReportList is the JSON response for a query.
+type ReportList struct {
+	Reports    []*model.Measurement `json:"reports"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+}
+
+// RequireToken returns a middleware that only lets through requests carrying
+// the passed bearer token in the Authorization header.
+func RequireToken(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			key := bearerToken(ctx.Request())
+			if token == "" || subtle.ConstantTimeCompare([]byte(key), []byte(token)) != 1 {
+				ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				r := &Response{OK: false, Message: "unauthorized"}
+				return ctx.JSON(http.StatusUnauthorized, r)
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// bearerToken returns the token in the Authorization header, if any.
+func bearerToken(req *http.Request) string {
+	scheme, token, ok := strings.Cut(req.Header.Get(echo.HeaderAuthorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// ListReports returns the stored reports that match the filters passed in the query string.
+// Results are sorted by time, and paginated with an opaque cursor. The output is JSON by default,
+// or newline-delimited JSON if requested with format=ndjson or with an Accept header.
+func (h *Handler) ListReports(ctx echo.Context) error {
+	q, err := parseQuery(ctx)
+	if err != nil {
+		r := &Response{OK: false, Message: err.Error()}
+		return ctx.JSON(http.StatusBadRequest, r)
+	}
+
+	// we ask for one more item, to know if there's a next page.
+	limit := q.Limit
+	q.Limit = limit + 1
+	reports, err := h.Collector.List(q)
+	if err != nil {
+		r := &Response{OK: false, Message: "cannot query reports"}
+		return ctx.JSON(http.StatusInternalServerError, r)
+	}
+
+	result := &ReportList{Reports: reports}
+	if len(reports) > limit {
+		result.Reports = reports[:limit]
+		result.NextCursor = model.CursorFor(reports[limit-1]).String()
+		ctx.Response().Header().Set(headerNextCursor, result.NextCursor)
+	}
+	if h.Privacy != nil {
+		// pages can be shorter than the limit, but the cursor still moves forward.
+		result.Reports = h.publish(q, result.Reports)
+	}
+
+	if wantsNDJSON(ctx) {
+		return writeNDJSON(ctx, result.Reports)
+	}
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// publish returns what the privacy gate publishes of the reports. Coarsened reports are
+// left out when filtering by ASN, since the filter would reveal the ASNs they lost.
+func (h *Handler) publish(q *model.Query, reports []*model.Measurement) []*model.Measurement {
+	published := []*model.Measurement{}
+	for _, m := range reports {
+		p := h.Privacy.Publish(m)
+		if p == nil || (p != m && (q.ClientASN != "" || q.EndpointASN != "")) {
+			continue
+		}
+		published = append(published, p)
+	}
+	return published
+}
+
+func wantsNDJSON(ctx echo.Context) bool {
+	if format := ctx.QueryParam("format"); format != "" {
+		return format == "ndjson"
+	}
+	return strings.Contains(ctx.Request().Header.Get(echo.HeaderAccept), mimeNDJSON)
+}
+
+func writeNDJSON(ctx echo.Context, reports []*model.Measurement) error {
+	resp := ctx.Response()
+	resp.Header().Set(echo.HeaderContentType, mimeNDJSON)
+	resp.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(resp)
+	for _, m := range reports {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseQuery builds a [model.Query] from the query string.
+func parseQuery(ctx echo.Context) (*model.Query, error) {
+	q := &model.Query{
+		Protocol:    ctx.QueryParam("proto"),
+		ClientASN:   normalizeASN(ctx.QueryParam("client_asn")),
+		ClientCC:    strings.ToUpper(ctx.QueryParam("client_cc")),
+		EndpointASN: normalizeASN(ctx.QueryParam("endpoint_asn")),
+		Limit:       defaultQueryLimit,
+	}
+
+	var err error
+	if q.Since, err = parseTimeParam(ctx, "since"); err != nil {
+		return nil, err
+	}
+	if q.Until, err = parseTimeParam(ctx, "until"); err != nil {
+		return nil, err
+	}
+	if port := ctx.QueryParam("endpoint_port"); port != "" {
+		if q.EndpointPort, err = strconv.Atoi(port); err != nil || q.EndpointPort <= 0 || q.EndpointPort > 65535 {
+			return nil, errors.New("bad endpoint_port: must be a valid port number")
+		}
+	}
+	if failure := ctx.QueryParam("failure"); failure != "" {
+		hasFailure, err := strconv.ParseBool(failure)
+		if err != nil {
+			return nil, errors.New("bad failure: must be true or false")
+		}
+		q.HasFailure = &hasFailure
+	}
+	if limit := ctx.QueryParam("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit <= 0 {
+			return nil, errors.New("bad limit: must be a positive integer")
+		}
+		if q.Limit > maxQueryLimit {
+			q.Limit = maxQueryLimit
+		}
+	}
+	if cursor := ctx.QueryParam("cursor"); cursor != "" {
+		if q.After, err = model.ParseCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func parseTimeParam(ctx echo.Context, name string) (*time.Time, error) {
+	value := ctx.QueryParam(name)
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s: must be a RFC3339 timestamp", name)
+	}
+	return &t, nil
+}
+
+// normalizeASN accepts both AS3215 and 3215, and returns the former.
+func normalizeASN(asn string) string {
+	if asn == "" {
+		return ""
+	}
+	asn = strings.ToUpper(asn)
+	if !strings.HasPrefix(asn, "AS") {
+		asn = "AS" + asn
+	}
+	return asn
+}
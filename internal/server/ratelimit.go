@@ -0,0 +1,64 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/metrics"
+	"github.com/ainghazal/tunnel-telemetry/internal/ratelimit"
+	"github.com/labstack/echo/v4"
+)
+
+// RateLimit returns a middleware that rejects the requests from client IPs that
+// went over their limit, or that are banned. Every request is charged for one report;
+// batches are charged for the rest of their reports by the handler.
+func RateLimit(l *ratelimit.Limiter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if ok, retryAfter := l.AllowIP(ctx.RealIP()); !ok {
+				metrics.ReportRejected(metrics.RejectRateLimitedIP)
+				return tooManyReports(ctx, retryAfter)
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// allowASN checks the per-ASN limit for a report, if the handler has a limiter. The ASN
+// is the one we look up for the client IP, since clients could report any other.
+func (h *Handler) allowASN(asn string) (bool, time.Duration) {
+	if h.Limiter == nil {
+		return true, 0
+	}
+	return h.Limiter.AllowASN(asn)
+}
+
+// allowIPN charges the client IP for n more reports, if the handler has a limiter, and
+// returns how many of them are allowed.
+func (h *Handler) allowIPN(ip string, n int) int {
+	if h.Limiter == nil || n <= 0 {
+		return n
+	}
+	allowed, _ := h.Limiter.AllowIPN(ip, n)
+	return allowed
+}
+
+// tooManyReports responds with 429, asking the client to retry later.
+func tooManyReports(ctx echo.Context, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	ctx.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(seconds))
+	r := &Response{OK: false, Message: "too many reports, try again later"}
+	return ctx.JSON(http.StatusTooManyRequests, r)
+}
+
+// HandleRateLimitStats returns a handler that reports the rate limiting counters.
+func HandleRateLimitStats(l *ratelimit.Limiter) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, l.Stats())
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RedirectToHTTPS returns a handler that redirects every request to the same URL over
+// HTTPS, on the port of httpsAddr (e.g. ":8443"). The port is left out if it's 443.
+// Redirects keep the method, so that clients can send their reports again.
+//
+// The Host header comes from the client, so it's only used if it's one of hostnames;
+// otherwise, the request is redirected to the first one. Without hostnames, nothing is
+// redirected.
+func RedirectToHTTPS(httpsAddr string, hostnames []string) http.Handler {
+	_, port, err := net.SplitHostPort(httpsAddr)
+	if err != nil || port == "443" {
+		port = ""
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(hostnames) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		target := hostnames[0]
+		for _, name := range hostnames {
+			if strings.EqualFold(host, name) {
+				target = name
+				break
+			}
+		}
+		if port != "" {
+			target = net.JoinHostPort(target, port)
+		}
+		http.Redirect(w, r, "https://"+target+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -2,11 +2,20 @@
 package server
 
 import (
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/metrics"
 	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/ainghazal/tunnel-telemetry/internal/privacy"
+	"github.com/ainghazal/tunnel-telemetry/internal/ratelimit"
+	"github.com/ainghazal/tunnel-telemetry/internal/relayqueue"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
 )
 
@@ -19,13 +28,24 @@ type Response struct {
 // NewEchoServer returns a configured Echo server.
 func NewEchoServer(c *config.Config) *echo.Echo {
 	e := echo.New()
-	// We explicitely set IPExtractor to the direct IP Extractor.
-	// I will need to add the override ability in the case someone needs
-	// to setup the collector behind a proxy; debug mode should only be used for testing.
+	// We explicitely set IPExtractor to the direct IP Extractor, unless we're told
+	// to trust some proxies to tell us the client IP; debug mode (which trusts
+	// anybody's headers) should only be used for testing.
 	if !c.DebugGeolocation {
 		e.IPExtractor = echo.ExtractIPDirect()
+		if len(c.TrustedProxies) != 0 {
+			nets, err := ParseTrustedProxies(c.TrustedProxies)
+			if err != nil {
+				slog.Warn("not trusting any proxy", "error", err)
+			} else {
+				e.IPExtractor = trustedProxyExtractor(nets)
+			}
+		}
 	}
-	//e.Use(middleware.Logger())
+	// echo uses StdLogger as the ErrorLog of its servers.
+	e.StdLogger = ErrorLog(slog.Default())
+	e.Use(middleware.RequestID())
+	e.Use(AccessLog(slog.Default()))
 	//e.Use(middleware.Recover())
 	e.Logger.SetLevel(log.INFO)
 	return e
@@ -35,6 +55,79 @@ func NewEchoServer(c *config.Config) *echo.Echo {
 type Handler struct {
 	Collector model.GeolocatingCollector
 	Submitter model.Submitter
+
+	// Dispatcher, if set, submits reports in the background. Otherwise, reports
+	// are submitted before responding to the client.
+	Dispatcher *Dispatcher
+
+	// Limiter, if set, limits the reports per client ASN, and the reports in a batch per
+	// client IP. The limit per client IP is enforced by the [RateLimit] middleware.
+	Limiter *ratelimit.Limiter
+
+	// Privacy, if set, decides which stored reports can be published by the query API, and
+	// how.
+	Privacy *privacy.Gate
+
+	// BatchMaxReports is the maximum number of reports in a batch (DefaultBatchMaxReports if zero).
+	BatchMaxReports int
+
+	// BatchMaxBytes is the maximum size of a batch body (DefaultBatchMaxBytes if zero).
+	BatchMaxBytes int64
+
+	// ReportMaxBytes is the maximum size of a single report (DefaultReportMaxBytes if zero).
+	ReportMaxBytes int64
+
+	// StrictDecoding rejects reports with fields that are not part of a measurement.
+	StrictDecoding bool
+
+	// live holds the limits set with SetConfig, which take precedence over the fields above.
+	live atomic.Pointer[limits]
+}
+
+// limits are the settings of the handler that can change while it's serving.
+type limits struct {
+	batchMaxReports int
+	batchMaxBytes   int64
+	reportMaxBytes  int64
+	strictDecoding  bool
+
+	// noRelay makes the handler store the reports without submitting them.
+	noRelay bool
+}
+
+// SetConfig updates the limits, the decoding mode and whether reports are submitted
+// upstream from the config. It can be called while the handler is serving.
+func (h *Handler) SetConfig(cfg *config.Config) {
+	h.live.Store(&limits{
+		batchMaxReports: cfg.BatchMaxReports,
+		batchMaxBytes:   int64(cfg.BatchMaxSizeKB) * 1024,
+		reportMaxBytes:  int64(cfg.ReportMaxSizeKB) * 1024,
+		strictDecoding:  cfg.StrictDecoding,
+		noRelay:         !cfg.RelayToOONI,
+	})
+}
+
+// limits returns the current limits, with the defaults for the ones that are not set.
+func (h *Handler) limits() limits {
+	l := limits{
+		batchMaxReports: h.BatchMaxReports,
+		batchMaxBytes:   h.BatchMaxBytes,
+		reportMaxBytes:  h.ReportMaxBytes,
+		strictDecoding:  h.StrictDecoding,
+	}
+	if live := h.live.Load(); live != nil {
+		l = *live
+	}
+	if l.batchMaxReports <= 0 {
+		l.batchMaxReports = DefaultBatchMaxReports
+	}
+	if l.batchMaxBytes <= 0 {
+		l.batchMaxBytes = DefaultBatchMaxBytes
+	}
+	if l.reportMaxBytes <= 0 {
+		l.reportMaxBytes = DefaultReportMaxBytes
+	}
+	return l
 }
 
 func NewHandler(c model.GeolocatingCollector, s model.Submitter) *Handler {
@@ -46,22 +139,118 @@ func NewHandler(c model.GeolocatingCollector, s model.Submitter) *Handler {
 
 // CreateReport creates a new report from client submission.
 func (h *Handler) CreateReport(ctx echo.Context) error {
-	m := model.NewMeasurement()
-	if err := ctx.Bind(m); err != nil {
-		return ctx.String(http.StatusBadRequest, "bad request: cannot parse json")
+	metrics.ReportsReceived(1)
+	limits := h.limits()
+	maxBytes := limits.reportMaxBytes
+	body := http.MaxBytesReader(ctx.Response(), ctx.Request().Body, maxBytes)
+	m, err := decodeMeasurement(body, limits.strictDecoding)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		metrics.ReportRejected(metrics.RejectReportTooLarge)
+		r := &Response{OK: false, Message: fmt.Sprintf("report too large: max %d bytes", maxBytes)}
+		return ctx.JSON(http.StatusRequestEntityTooLarge, r)
+	case err != nil:
+		metrics.ReportRejected(metrics.RejectBadJSON)
+		r := &Response{OK: false, Message: decodeErrorMessage(err)}
+		return ctx.JSON(http.StatusBadRequest, r)
 	}
-	h.Collector.Geolocate(m, ctx.RealIP())
+	stampApp(ctx, m)
+	h.geolocate(m, ctx.RealIP())
+	m.Normalize()
 	if err := m.Validate(); err != nil {
+		metrics.ReportInvalid(err)
+		requestLogger(ctx).Debug("report rejected", "error", err)
 		r := &Response{OK: false, Message: err.Error()}
 		return ctx.JSON(http.StatusBadRequest, r)
 	}
-	h.Collector.Save(m)
-	// TODO(ain): we can configure the colector to either relay every measurement
-	// or submit daily/hourly aggregates only. This is the direct thing.
+	if ok, retryAfter := h.allowASN(h.Collector.LookupASN(ctx.RealIP())); !ok {
+		metrics.ReportRejected(metrics.RejectRateLimitedASN)
+		return tooManyReports(ctx, retryAfter)
+	}
+	if h.Dispatcher != nil && h.Dispatcher.Busy() {
+		metrics.ReportRejected(metrics.RejectBusy)
+		ctx.Response().Header().Set(echo.HeaderRetryAfter, "5")
+		r := &Response{OK: false, Message: "server busy, try again later"}
+		return ctx.JSON(http.StatusServiceUnavailable, r)
+	}
+	err = h.Collector.Save(m)
+	if errors.Is(err, model.ErrDuplicate) {
+		metrics.ReportRejected(metrics.RejectDuplicate)
+		r := &Response{OK: false, Message: "duplicate report"}
+		return ctx.JSON(http.StatusConflict, r)
+	}
+	if err != nil {
+		metrics.ReportRejected(metrics.RejectStorage)
+		requestLogger(ctx).Warn("cannot store report", "uuid", m.UUID, "error", err)
+		r := &Response{OK: false, Message: "cannot store report"}
+		return ctx.JSON(http.StatusInternalServerError, r)
+	}
+	metrics.ReportAccepted(m)
+	requestLogger(ctx).Debug("report accepted", "uuid", m.UUID, "proto", m.Protocol)
+	if limits.noRelay {
+		// without relaying, reports are final as soon as they're stored.
+		return ctx.JSONPretty(http.StatusCreated, m, "  ")
+	}
+	// depending on the relay mode, the submitter either relays this measurement
+	// or adds it to the hourly/daily aggregates.
+	if h.Dispatcher != nil {
+		// the workers will modify the measurement, so we respond with a copy.
+		accepted := *m
+		if err := h.Dispatcher.Dispatch(m); err == nil {
+			// the OONI measurement ID can be looked up later, with the report UUID.
+			return ctx.JSONPretty(http.StatusAccepted, &accepted, "  ")
+		}
+	}
 	h.Submitter.Submit([]*model.Measurement{m})
 	return ctx.JSONPretty(http.StatusCreated, m, "  ")
 }
 
+// geolocate geolocates the client and the endpoint, and counts the failures.
+func (h *Handler) geolocate(m *model.Measurement, ip string) {
+	if err := h.Collector.Geolocate(m, ip); err != nil {
+		metrics.GeolocationFailed("endpoint")
+	}
+	if m.ClientASN == "" || m.ClientCC == "" {
+		metrics.GeolocationFailed("client")
+	}
+	m.Contributor = privacy.Contributor(ip)
+}
+
+// GetReport returns a stored report by its UUID. The report has been scrubbed before
+// storing, and it includes the OONI measurement ID if it has been relayed. Reports that
+// the privacy gate does not publish are not found.
+func (h *Handler) GetReport(ctx echo.Context) error {
+	m, err := h.Collector.Get(ctx.Param("uuid"))
+	if errors.Is(err, model.ErrNotFound) {
+		r := &Response{OK: false, Message: "report not found"}
+		return ctx.JSON(http.StatusNotFound, r)
+	}
+	if err != nil {
+		r := &Response{OK: false, Message: "cannot retrieve report"}
+		return ctx.JSON(http.StatusInternalServerError, r)
+	}
+	if h.Privacy != nil {
+		if m = h.Privacy.Publish(m); m == nil {
+			r := &Response{OK: false, Message: "report not found"}
+			return ctx.JSON(http.StatusNotFound, r)
+		}
+	}
+	return ctx.JSONPretty(http.StatusOK, m, "  ")
+}
+
 func HandleRootDecoy(c echo.Context) error {
 	return c.HTML(http.StatusOK, decoyBanner)
 }
+
+// HandleRelayQueueStats returns a handler that reports the depth of the relay queue.
+func HandleRelayQueueStats(q *relayqueue.Queue) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		stats, err := q.Stats()
+		if err != nil {
+			r := &Response{OK: false, Message: "cannot read relay queue"}
+			return ctx.JSON(http.StatusInternalServerError, r)
+		}
+		return ctx.JSON(http.StatusOK, stats)
+	}
+}
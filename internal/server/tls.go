@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+)
+
+const (
+	// ClientAuthOptional verifies the client certificates, but does not require them.
+	ClientAuthOptional = "optional"
+
+	// ClientAuthRequire rejects the connections without a valid client certificate.
+	ClientAuthRequire = "require"
+)
+
+// certReloadInterval is how often we check if the certificate files have changed.
+var certReloadInterval = 10 * time.Second
+
+// CertReloader serves a certificate from a pair of files, and reloads it when the
+// files change on disk, so that renewed certificates are picked up without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads the certificate and key in the passed files.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload loads the certificate files again. The current certificate is kept if the
+// files cannot be loaded (e.g., because only one of them has been replaced so far).
+func (cr *CertReloader) Reload() error {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// GetCertificate can be used as [tls.Config.GetCertificate].
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// Run reloads the certificate whenever the files change, until the context is done.
+func (cr *CertReloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			modTime, err := cr.lastModified()
+			if err != nil {
+				continue
+			}
+			cr.mu.RLock()
+			changed := !modTime.Equal(cr.modTime)
+			cr.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := cr.Reload(); err != nil {
+				slog.Warn("cannot reload certificate", "error", err)
+				continue
+			}
+			slog.Info("reloaded certificate", "file", cr.certFile)
+		}
+	}
+}
+
+// lastModified returns the latest modification time of the certificate and key files.
+func (cr *CertReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ConfigureClientAuth sets up the verification of client certificates in tlsConfig,
+// according to the config. It does nothing if there's no client CA bundle.
+func ConfigureClientAuth(tlsConfig *tls.Config, cfg *config.Config) error {
+	if cfg.TLSClientCA == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.TLSClientCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return errors.New("no certificates in the client CA bundle")
+	}
+	tlsConfig.ClientCAs = pool
+	switch cfg.TLSClientAuth {
+	case "", ClientAuthOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("unknown client auth: %s", cfg.TLSClientAuth)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net/http"
 )
@@ -39,21 +40,21 @@ func AttemptFetchingPublicIP() (string, error) {
 	for _, server := range stunServers {
 		ip, err := FetchIPFromSTUNCall(server)
 		if err != nil {
-			fmt.Printf("%v\n", err)
+			slog.Debug("cannot fetch public IP", "via", server, "error", err)
 			continue
 		}
-		fmt.Printf("IP: %s (via %s)\n", ip, server)
+		slog.Debug("fetched public IP", "public_ip", ip, "via", server)
 		return ip, nil
 	}
 
 	shuffleServers(httpsServers)
 	for _, provider := range httpsServers {
-		fmt.Printf("%s: ", provider)
 		ip, err := FetchIPFromHTTPSAPICall(provider)
 		if err != nil {
-			fmt.Printf("%v\n", err)
+			slog.Debug("cannot fetch public IP", "via", provider, "error", err)
 			continue
 		} else {
+			slog.Debug("fetched public IP", "public_ip", ip, "via", provider)
 			return ip, nil
 		}
 	}
@@ -0,0 +1,125 @@
+package tests
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/aggregate"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockAggregateSubmitter struct {
+	err        error
+	aggregates []*model.Aggregate
+}
+
+func (ms *mockAggregateSubmitter) SubmitAggregates(aa []*model.Aggregate) error {
+	if ms.err != nil {
+		return ms.err
+	}
+	ms.aggregates = append(ms.aggregates, aa...)
+	return nil
+}
+
+func TestAggregatorBucketsMeasurements(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.CollectorID = "test"
+	upstream := &mockAggregateSubmitter{}
+	agg := aggregate.NewAggregator(cfg, upstream)
+
+	// measurements are bucketed by the time they're received, so a late report never
+	// opens a window that is over.
+	window := time.Now().UTC().Truncate(time.Hour)
+	taken := window.Add(-2 * time.Hour)
+	mm := []*model.Measurement{}
+	for i := 1; i <= 10; i++ {
+		m := makeStoredMeasurement(taken.Add(time.Duration(i) * time.Minute))
+		m.DurationMS = int64(i * 100)
+		if i%5 == 0 {
+			m.Failure = &model.Failure{Op: "tls_handshake", Error: "connection_reset"}
+		}
+		mm = append(mm, m)
+	}
+	other := makeStoredMeasurement(taken.Add(time.Hour))
+	other.ClientASN = "AS13335"
+	mm = append(mm, other)
+
+	assert.True(t, agg.Submit(mm))
+	assert.Empty(t, upstream.aggregates)
+	assert.NoError(t, agg.FlushAll())
+
+	sort.Slice(upstream.aggregates, func(i, j int) bool {
+		return upstream.aggregates[i].Count > upstream.aggregates[j].Count
+	})
+	if assert.Len(t, upstream.aggregates, 2) {
+		a := upstream.aggregates[0]
+		assert.Equal(t, model.AggregateReportType, a.Type)
+		assert.Equal(t, "test", a.CollectorID)
+		assert.Equal(t, window, a.WindowStart)
+		assert.Equal(t, window.Add(time.Hour), a.WindowEnd)
+		assert.Equal(t, "AS3215", a.ClientASN)
+		assert.Equal(t, 10, a.Count)
+		assert.Equal(t, 8, a.Successes)
+		assert.Equal(t, 2, a.Failures)
+		assert.Equal(t, map[string]int{"tls_handshake": 2}, a.FailureOps)
+		assert.Equal(t, &model.DurationPercentile{Min: 100, P50: 500, P90: 900, P99: 1000, Max: 1000}, a.DurationMS)
+
+		b := upstream.aggregates[1]
+		assert.Equal(t, "AS13335", b.ClientASN)
+		assert.Equal(t, window, b.WindowStart)
+		assert.Equal(t, 1, b.Count)
+		assert.Nil(t, b.DurationMS)
+	}
+}
+
+func TestAggregatorRetriesFailedSubmissions(t *testing.T) {
+	upstream := &mockAggregateSubmitter{err: errors.New("upstream is down")}
+	agg := aggregate.NewAggregator(config.NewConfig(), upstream)
+
+	agg.Submit([]*model.Measurement{makeStoredMeasurement(time.Now())})
+	assert.Error(t, agg.FlushAll())
+	assert.Empty(t, upstream.aggregates)
+
+	upstream.err = nil
+	assert.NoError(t, agg.FlushAll())
+	assert.Len(t, upstream.aggregates, 1)
+}
+
+func TestAggregatorDropsOldestPending(t *testing.T) {
+	upstream := &mockAggregateSubmitter{err: errors.New("upstream is down")}
+	agg := aggregate.NewAggregator(config.NewConfig(), upstream)
+	agg.MaxPending = 2
+
+	for _, asn := range []string{"AS1", "AS2", "AS3"} {
+		m := makeStoredMeasurement(time.Now())
+		m.ClientASN = asn
+		agg.Submit([]*model.Measurement{m})
+		assert.Error(t, agg.FlushAll())
+	}
+
+	upstream.err = nil
+	assert.NoError(t, agg.FlushAll())
+	if assert.Len(t, upstream.aggregates, 2) {
+		assert.Equal(t, "AS2", upstream.aggregates[0].ClientASN)
+		assert.Equal(t, "AS3", upstream.aggregates[1].ClientASN)
+	}
+}
+
+func TestAggregatorPaused(t *testing.T) {
+	upstream := &mockAggregateSubmitter{}
+	agg := aggregate.NewAggregator(config.NewConfig(), upstream)
+	agg.SetPaused(true)
+
+	// the aggregates are kept until the aggregator is resumed.
+	agg.Submit([]*model.Measurement{makeStoredMeasurement(time.Now())})
+	assert.NoError(t, agg.FlushAll())
+	assert.Empty(t, upstream.aggregates)
+
+	agg.SetPaused(false)
+	assert.NoError(t, agg.FlushAll())
+	assert.Len(t, upstream.aggregates, 1)
+}
@@ -2,11 +2,15 @@ package tests
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"text/template"
 	"time"
@@ -211,7 +215,8 @@ func TestReportWithFailure(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			assert.Equal(t, &model.Failure{Op: "dns", Error: "dns.cannot_resolve"}, m.Failure)
+			// the failure is mapped to the vocabulary.
+			assert.Equal(t, &model.Failure{Op: "dns_resolve", Error: "unknown_failure"}, m.Failure)
 		}
 	}
 }
@@ -338,3 +343,249 @@ func TestReportWithDuration(t *testing.T) {
 		}
 	}
 }
+
+func TestReportIsPersistedToDataDir(t *testing.T) {
+	dataDir := t.TempDir()
+	report := makeReport(&reportData{
+		Type:      "tunnel-telemetry",
+		Timestamp: makeTimestampForYesterday(),
+		Endpoint:  "ss://1.1.1.1:443",
+	})
+
+	ctx, hdlr, rec := testFileSystemCollectorWithPayload(
+		"/report",
+		report,
+		&config.Config{
+			CollectorID: "test/collector",
+			DataDir:     dataDir,
+		},
+		&mockRequest{},
+	)
+	if assert.NoError(t, hdlr.CreateReport(ctx)) {
+		if assert.Equal(t, http.StatusCreated, rec.Code) {
+			m, err := parseMeasurementResponse(rec.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := filepath.Glob(filepath.Join(dataDir, "tt-test_collector-*.0.jsonl"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, files, 1) {
+				data, err := os.ReadFile(files[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+				if assert.Len(t, lines, 1) {
+					stored, err := parseMeasurementResponse([]byte(lines[0]))
+					if err != nil {
+						t.Fatal(err)
+					}
+					assert.Equal(t, m.UUID, stored.UUID)
+					assert.Equal(t, "test/collector", stored.CollectorID)
+					// the stored report must be scrubbed too.
+					assert.Equal(t, "", stored.Endpoint)
+				}
+			}
+		}
+	}
+}
+
+func TestGetStoredReport(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	cfg.DataDir = t.TempDir()
+
+	col := collector.NewFileSystemCollector(cfg)
+	defer col.Close()
+	h := server.NewHandler(col, col)
+
+	e := server.NewEchoServer(cfg)
+	e.POST("/report", h.CreateReport)
+	e.GET("/report/:uuid", h.GetReport)
+
+	report := makeReport(&reportData{
+		Type:      "tunnel-telemetry",
+		Timestamp: makeTimestampForYesterday(),
+		Endpoint:  "ss://1.1.1.1:443",
+	})
+	req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(report))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if !assert.Equal(t, http.StatusCreated, rec.Code) {
+		t.Fatal(rec.Body.String())
+	}
+	created, err := parseMeasurementResponse(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/report/"+created.UUID, nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		m, err := parseMeasurementResponse(rec.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, created.UUID, m.UUID)
+		assert.Equal(t, "ss", m.Protocol)
+		assert.Equal(t, "", m.Endpoint)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/report/"+uuid.New().String(), nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestDuplicateReportIsRejected(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	cfg.DataDir = t.TempDir()
+
+	col := collector.NewFileSystemCollector(cfg)
+	defer col.Close()
+	h := server.NewHandler(col, &mockSubmitter{})
+
+	e := server.NewEchoServer(cfg)
+	e.POST("/report", h.CreateReport)
+	e.GET("/report/:uuid", h.GetReport)
+
+	id := uuid.New().String()
+	post := func(endpoint string) *httptest.ResponseRecorder {
+		report := makeReport(&reportData{
+			Type:      "tunnel-telemetry",
+			Timestamp: makeTimestampForYesterday(),
+			Endpoint:  endpoint,
+		})
+		report = strings.Replace(report, "{", `{"uuid": "`+id+`",`, 1)
+		req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(report))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(t, http.StatusCreated, post("ss://1.1.1.1:443").Code)
+
+	// nobody can overwrite a stored report by reusing its UUID.
+	assert.Equal(t, http.StatusConflict, post("obfs4://1.1.1.1:443").Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/report/"+id, nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		m, err := parseMeasurementResponse(rec.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "ss", m.Protocol)
+	}
+}
+
+func TestClientCannotSetOONIFields(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	cfg.DataDir = t.TempDir()
+
+	col := collector.NewFileSystemCollector(cfg)
+	defer col.Close()
+	h := server.NewHandler(col, &mockSubmitter{})
+
+	e := server.NewEchoServer(cfg)
+	e.POST("/report", h.CreateReport)
+	e.GET("/report/:uuid", h.GetReport)
+
+	id := uuid.New().String()
+	report := makeReport(&reportData{
+		Type:      "tunnel-telemetry",
+		Timestamp: makeTimestampForYesterday(),
+		Endpoint:  "ss://1.1.1.1:443",
+	})
+	report = strings.Replace(report, "{", `{"uuid": "`+id+`",
+		"ooni-measurement-id": "20240422144155.458035_IT_tunneltelemetry_84954cf1a5baeb91",
+		"ooni-measurement-link": "https://phishing.example.org/",
+		"t_relayed": "2024-04-22T14:41:55Z",
+		"privacy": "released",`, 1)
+	req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(report))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/report/"+id, nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		m, err := parseMeasurementResponse(rec.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Empty(t, m.OOID)
+		assert.Empty(t, m.OOIDLink)
+		assert.Nil(t, m.TimeRelayed)
+		assert.Empty(t, m.Privacy)
+	}
+}
+
+type mockSubmitter struct {
+	mu        sync.Mutex
+	submitted []*model.Measurement
+}
+
+func (ms *mockSubmitter) Submit(mm []*model.Measurement) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.submitted = append(ms.submitted, mm...)
+	return true
+}
+
+func TestAsyncReportIsAccepted(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	col := collector.NewFileSystemCollector(cfg)
+	submitter := &mockSubmitter{}
+	h := server.NewHandler(col, submitter)
+	h.Dispatcher = server.NewDispatcher(submitter, 1, 1)
+
+	e := server.NewEchoServer(cfg)
+	e.POST("/report", h.CreateReport)
+
+	post := func() *httptest.ResponseRecorder {
+		report := makeReport(&reportData{
+			Type:      "tunnel-telemetry",
+			Timestamp: makeTimestampForYesterday(),
+			Endpoint:  "ss://1.1.1.1:443",
+		})
+		req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(report))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the workers are not running yet, so the second report finds the backlog full.
+	rec := post()
+	if !assert.Equal(t, http.StatusAccepted, rec.Code) {
+		t.Fatal(rec.Body.String())
+	}
+	accepted, err := parseMeasurementResponse(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, isValidUUID(accepted.UUID))
+
+	rec = post()
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get(echo.HeaderRetryAfter))
+
+	h.Dispatcher.Start()
+	left, err := h.Dispatcher.Close(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, left)
+	if assert.Len(t, submitter.submitted, 1) {
+		assert.Equal(t, accepted.UUID, submitter.submitted[0].UUID)
+	}
+}
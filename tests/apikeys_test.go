@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/apikeys"
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	key, entry, err := apikeys.Generate("vpn-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, apikeys.SaveFile(keyFile, []*apikeys.Entry{entry}))
+
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	cfg.KeyFile = keyFile
+	cfg.APIKeys = []config.APIKey{{App: "proxy-app", Key: "static-key"}}
+	assert.True(t, apikeys.Enabled(cfg))
+	keyring, err := apikeys.NewKeyring(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	col := collector.NewFileSystemCollector(cfg)
+	h := server.NewHandler(col, &mockSubmitter{})
+	e := server.NewEchoServer(cfg)
+	e.POST("/report", h.CreateReport, server.RequireAPIKey(keyring))
+
+	post := func(token string) *httptest.ResponseRecorder {
+		report := makeReport(&reportData{
+			Type:      "tunnel-telemetry",
+			Timestamp: makeTimestampForYesterday(),
+			Endpoint:  "ss://1.1.1.1:443",
+		})
+		req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(report))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post("").Code)
+	assert.Equal(t, http.StatusUnauthorized, post("tt_wrong").Code)
+
+	for token, app := range map[string]string{key: "vpn-app", "static-key": "proxy-app"} {
+		rec := post(token)
+		if !assert.Equal(t, http.StatusCreated, rec.Code) {
+			t.Fatal(rec.Body.String())
+		}
+		m, err := parseMeasurementResponse(rec.Body.Bytes())
+		if assert.NoError(t, err) {
+			assert.Equal(t, app, m.Agent)
+		}
+	}
+
+	// disabling the key in the key file revokes it.
+	entries, err := apikeys.LoadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, apikeys.SetDisabled(entries, entry.ID, true))
+	assert.NoError(t, apikeys.SaveFile(keyFile, entries))
+	assert.NoError(t, keyring.Reload())
+	assert.Equal(t, http.StatusUnauthorized, post(key).Code)
+	assert.ErrorIs(t, apikeys.SetDisabled(entries, "unknown", true), apikeys.ErrUnknownKey)
+}
+
+func TestAPIKeysFileChanges(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	key, entry, err := apikeys.Generate("vpn-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, otherEntry, err := apikeys.Generate("proxy-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, apikeys.SaveFile(keyFile, []*apikeys.Entry{entry, otherEntry}))
+
+	cfg := config.NewConfig()
+	cfg.KeyFile = keyFile
+	cfg.APIKeys = []config.APIKey{{App: "static-app", Key: "static-key"}}
+	keyring, err := apikeys.NewKeyring(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.POST("/report", func(c echo.Context) error {
+		return c.NoContent(http.StatusCreated)
+	}, server.RequireAPIKey(keyring))
+	post := func(token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/report", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusCreated, post(key))
+	assert.Equal(t, http.StatusCreated, post(other))
+
+	// a key removed from the file is revoked. We move the modification time forward,
+	// in case the file system does not tell the two writes apart.
+	assert.NoError(t, apikeys.SaveFile(keyFile, []*apikeys.Entry{otherEntry}))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(keyFile, later, later))
+	assert.NoError(t, keyring.ReloadIfChanged())
+	assert.Equal(t, http.StatusUnauthorized, post(key))
+	assert.Equal(t, http.StatusCreated, post(other))
+
+	// without the file, only the keys in the config are left.
+	assert.NoError(t, os.Remove(keyFile))
+	assert.NoError(t, keyring.ReloadIfChanged())
+	assert.Equal(t, http.StatusUnauthorized, post(other))
+	assert.Equal(t, http.StatusCreated, post("static-key"))
+}
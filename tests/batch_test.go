@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func postBatch(h *server.Handler, contentType, body string) *httptest.ResponseRecorder {
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	e := server.NewEchoServer(cfg)
+	e.POST("/report/batch", h.CreateReportBatch)
+
+	req := httptest.NewRequest(http.MethodPost, "/report/batch", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, contentType)
+	req.Header.Set(echo.HeaderXForwardedFor, "2.3.4.5")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func makeBatchReports() []string {
+	good := makeReport(&reportData{
+		Type:      "tunnel-telemetry",
+		Timestamp: makeTimestampForYesterday(),
+		Endpoint:  "ss://1.1.1.1:443",
+	})
+	tooOld := makeReport(&reportData{
+		Type:      "tunnel-telemetry",
+		Timestamp: makeTimestampForOneMonthAgo(),
+		Endpoint:  "ss://1.1.1.1:443",
+	})
+	reports := []string{}
+	for _, report := range []string{good, tooOld, good} {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(report)); err != nil {
+			panic(err)
+		}
+		reports = append(reports, compact.String())
+	}
+	return reports
+}
+
+func assertBatchResult(t *testing.T, rec *httptest.ResponseRecorder, submitter *mockSubmitter) {
+	if !assert.Equal(t, http.StatusOK, rec.Code) {
+		t.Fatal(rec.Body.String())
+	}
+	result := &server.BatchResult{}
+	if err := json.Unmarshal(rec.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, result.Accepted)
+	assert.Equal(t, 1, result.Rejected)
+	if assert.Len(t, result.Results, 3) {
+		assert.True(t, result.Results[0].OK)
+		assert.True(t, isValidUUID(result.Results[0].UUID))
+		assert.False(t, result.Results[1].OK)
+		assert.Equal(t, "bad measurement: invalid time, report too old (t)", result.Results[1].Message)
+		assert.Equal(t, 2, result.Results[2].Index)
+		assert.True(t, result.Results[2].OK)
+	}
+	if assert.Len(t, submitter.submitted, 2) {
+		assert.Equal(t, "AS3215", submitter.submitted[0].ClientASN)
+	}
+}
+
+func TestBatchReportAsJSONArray(t *testing.T) {
+	submitter := &mockSubmitter{}
+	h := server.NewHandler(collector.NewFileSystemCollector(config.NewConfig()), submitter)
+
+	body := "[" + strings.Join(makeBatchReports(), ",") + "]"
+	rec := postBatch(h, echo.MIMEApplicationJSON, body)
+	assertBatchResult(t, rec, submitter)
+}
+
+func TestBatchReportAsNDJSON(t *testing.T) {
+	submitter := &mockSubmitter{}
+	h := server.NewHandler(collector.NewFileSystemCollector(config.NewConfig()), submitter)
+
+	body := strings.Join(makeBatchReports(), "\n") + "\n"
+	rec := postBatch(h, "application/x-ndjson", body)
+	assertBatchResult(t, rec, submitter)
+}
+
+func TestBatchReportRejectsMalformedLines(t *testing.T) {
+	submitter := &mockSubmitter{}
+	h := server.NewHandler(collector.NewFileSystemCollector(config.NewConfig()), submitter)
+
+	body := makeBatchReports()[0] + "\n{not json\n"
+	rec := postBatch(h, "application/x-ndjson", body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	result := &server.BatchResult{}
+	if err := json.Unmarshal(rec.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, result.Accepted)
+	if assert.Equal(t, 1, result.Rejected) {
+		assert.Equal(t, "cannot parse json", result.Results[1].Message)
+	}
+}
+
+func TestBatchReportLimits(t *testing.T) {
+	submitter := &mockSubmitter{}
+	h := server.NewHandler(collector.NewFileSystemCollector(config.NewConfig()), submitter)
+	h.BatchMaxReports = 2
+
+	body := "[" + strings.Join(makeBatchReports(), ",") + "]"
+	rec := postBatch(h, echo.MIMEApplicationJSON, body)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	h.BatchMaxReports = 0
+	h.BatchMaxBytes = 100
+	rec = postBatch(h, echo.MIMEApplicationJSON, body)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = postBatch(h, echo.MIMEApplicationJSON, `{"report-type": "tunnel-telemetry"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// nothing can follow the array.
+	h.BatchMaxBytes = 0
+	rec = postBatch(h, echo.MIMEApplicationJSON, body+` {"report-type": "tunnel-telemetry"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Empty(t, submitter.submitted)
+
+	// every report in the batch has the same size limit as a single one.
+	h.ReportMaxBytes = 200
+	large := strings.Replace(makeBatchReports()[0], "{", `{"config": {"prefix": "`+strings.Repeat("x", 200)+`"},`, 1)
+	for _, tc := range []struct {
+		contentType string
+		body        string
+	}{
+		{contentType: echo.MIMEApplicationJSON, body: "[" + large + "]"},
+		{contentType: "application/x-ndjson", body: large + "\n"},
+	} {
+		rec = postBatch(h, tc.contentType, tc.body)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		result := &server.BatchResult{}
+		if err := json.Unmarshal(rec.Body.Bytes(), result); err != nil {
+			t.Fatal(err)
+		}
+		if assert.Equal(t, 1, result.Rejected) {
+			assert.Equal(t, "report too large: max 200 bytes", result.Results[0].Message)
+		}
+	}
+	assert.Empty(t, submitter.submitted)
+}
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/client"
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMeasurements(t *testing.T) {
+	report := func(endpoint string) string {
+		return fmt.Sprintf(`{"report-type": "tunnel-telemetry", "time": "%s", "endpoint": "%s"}`, makeTimestampForYesterday(), endpoint)
+	}
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{name: "object", input: report("ss://1.1.1.1:443"), want: []string{"ss://1.1.1.1:443"}},
+		{name: "array", input: "[" + report("ss://1.1.1.1:443") + ", " + report("ss://2.2.2.2:443") + "]", want: []string{"ss://1.1.1.1:443", "ss://2.2.2.2:443"}},
+		{name: "ndjson", input: report("ss://1.1.1.1:443") + "\n" + report("ss://2.2.2.2:443") + "\n", want: []string{"ss://1.1.1.1:443", "ss://2.2.2.2:443"}},
+		{name: "empty", input: "\n", want: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mm, err := client.ReadMeasurements(strings.NewReader(tc.input))
+			if !assert.NoError(t, err) {
+				return
+			}
+			var got []string
+			for _, m := range mm {
+				got = append(got, m.Endpoint)
+				assert.Equal(t, float32(1.0), m.SamplingRate)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+
+	_, err := client.ReadMeasurements(strings.NewReader(report("ss://1.1.1.1:443") + "\n{"))
+	assert.ErrorContains(t, err, "report 2")
+}
+
+// newTestCollector returns a collector server that accepts reports.
+func newTestCollector(t *testing.T) *httptest.Server {
+	srv, _ := newRecordingCollector(t)
+	return srv
+}
+
+// newRecordingCollector returns a collector server that accepts reports, and the
+// submitter that gets the reports it accepts.
+func newRecordingCollector(t *testing.T) (*httptest.Server, *mockSubmitter) {
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	submitter := &mockSubmitter{}
+	h := server.NewHandler(collector.NewFileSystemCollector(cfg), submitter)
+	e := server.NewEchoServer(cfg)
+	e.POST("/report", h.CreateReport)
+	e.POST("/report/batch", h.CreateReportBatch)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return srv, submitter
+}
+
+// newFailingCollector returns a collector server that always responds with the status code.
+func newFailingCollector(t *testing.T, code int) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"ok": false, "msg": "status %d"}`, code)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestMeasurement(endpoint string) *model.Measurement {
+	start := time.Now().Add(-time.Minute)
+	m := model.NewMeasurement()
+	m.Type = "tunnel-telemetry"
+	m.TimeStart = &start
+	m.Endpoint = endpoint
+	return m
+}
+
+func TestClientSubmit(t *testing.T) {
+	srv := newTestCollector(t)
+	c := &client.Client{Collectors: []string{srv.URL + "/"}, ClientASN: "AS3352", ClientCC: "ES"}
+	res, err := c.Submit(context.Background(), newTestMeasurement("ss://1.1.1.1:443"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, srv.URL+"/", res.Collector)
+		assert.NotEmpty(t, res.Report.UUID)
+		assert.Equal(t, "AS3352", res.Report.ClientASN)
+		// the client network does not keep the collector from parsing the endpoint.
+		assert.Equal(t, "ss", res.Report.Protocol)
+		assert.Equal(t, 443, res.Report.EndpointPort)
+		assert.Equal(t, "AS13335", res.Report.EndpointASN)
+		// the collector scrubs the endpoint.
+		assert.Empty(t, res.Report.Endpoint)
+	}
+
+	_, err = c.Submit(context.Background(), newTestMeasurement(""))
+	assert.True(t, errors.Is(err, client.ErrRejected))
+	assert.ErrorContains(t, err, "endpoint cannot be empty")
+}
+
+func TestClientFailover(t *testing.T) {
+	good := newTestCollector(t)
+	broken := newFailingCollector(t, http.StatusBadGateway)
+	rejecting := newFailingCollector(t, http.StatusUnauthorized)
+	unblock := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer slow.Close()
+	defer close(unblock)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	// every collector before the good one fails in a different way.
+	c := &client.Client{
+		Collectors: []string{down.URL, slow.URL, broken.URL, rejecting.URL, good.URL, broken.URL},
+		Timeout:    100 * time.Millisecond,
+	}
+	res, err := c.Submit(context.Background(), newTestMeasurement("ss://1.1.1.1:443"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, good.URL, res.Collector)
+		assert.Len(t, res.Attempts, 5)
+		var collectorErr *client.CollectorError
+		if assert.True(t, errors.As(res.Attempts[2].Err, &collectorErr)) {
+			assert.Equal(t, http.StatusBadGateway, collectorErr.StatusCode)
+			assert.False(t, errors.Is(collectorErr, client.ErrRejected))
+		}
+		assert.True(t, errors.Is(res.Attempts[3].Err, client.ErrRejected))
+		assert.NoError(t, res.Attempts[4].Err)
+	}
+
+	// all the collectors get the report when fanning out.
+	c.FanOut = true
+	res, err = c.Submit(context.Background(), newTestMeasurement("ss://1.1.1.1:443"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, good.URL, res.Collector)
+		assert.Len(t, res.Attempts, 6)
+	}
+
+	// the error has every failure, but it's not a rejection unless all of them are.
+	c = &client.Client{Collectors: []string{rejecting.URL, broken.URL}}
+	_, err = c.Submit(context.Background(), newTestMeasurement("ss://1.1.1.1:443"))
+	assert.ErrorContains(t, err, "status 401")
+	assert.ErrorContains(t, err, "status 502")
+	assert.False(t, errors.Is(err, client.ErrRejected))
+	c = &client.Client{Collectors: []string{rejecting.URL, rejecting.URL}}
+	_, err = c.Submit(context.Background(), newTestMeasurement("ss://1.1.1.1:443"))
+	assert.True(t, errors.Is(err, client.ErrRejected))
+}
@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrictDecoding(t *testing.T) {
+	ts := makeTimestampForYesterday()
+	report := func(extra string) string {
+		return fmt.Sprintf(`{"report-type": "tunnel-telemetry", "time": "%s", "endpoint": "ss://1.1.1.1:443"%s}`, ts, extra)
+	}
+	longValue := strings.Repeat("x", 300)
+	manyKeys := []string{}
+	for i := 0; i < 40; i++ {
+		manyKeys = append(manyKeys, fmt.Sprintf(`"k%d": "v"`, i))
+	}
+
+	for _, tc := range []struct {
+		name    string
+		body    string
+		strict  bool
+		code    int
+		message string
+	}{
+		{name: "valid", body: report(`, "config": {"prefix": "xx"}`), code: http.StatusCreated},
+		{name: "unknown field, lax", body: report(`, "color": "blue"`), code: http.StatusCreated},
+		{name: "unknown field, strict", body: report(`, "color": "blue"`), strict: true, code: http.StatusBadRequest, message: `unknown field "color"`},
+		{name: "nested config", body: report(`, "config": {"prefix": {"a": "b"}}`), code: http.StatusBadRequest, message: `cannot parse json: field "config.prefix" must be a string, got object`},
+		{name: "wrong type", body: report(`, "duration_ms": "slow"`), code: http.StatusBadRequest, message: `cannot parse json: field "duration_ms" must be a number, got string`},
+		{name: "bad time", body: `{"report-type": "tunnel-telemetry", "time": "yesterday"}`, code: http.StatusBadRequest, message: "expected RFC 3339"},
+		{name: "syntax", body: `{"report-type": }`, code: http.StatusBadRequest, message: "at offset 17"},
+		{name: "trailing data", body: report("") + ` {}`, code: http.StatusBadRequest, message: "unexpected data after the report"},
+		{name: "long config value", body: report(`, "config": {"prefix": "` + longValue + `"}`), code: http.StatusBadRequest, message: `config value for "prefix" cannot be longer than 256 bytes`},
+		{name: "too many config keys", body: report(`, "config": {` + strings.Join(manyKeys, ", ") + `}`), code: http.StatusBadRequest, message: "config cannot have more than 32 keys"},
+		{name: "too large after the report", body: report("") + strings.Repeat(" ", 70*1024) + "{}", code: http.StatusRequestEntityTooLarge, message: "report too large"},
+		{name: "too large", body: report(`, "config": {"prefix": "` + strings.Repeat("x", 70*1024) + `"}`), code: http.StatusRequestEntityTooLarge, message: "report too large"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.NewConfig()
+			cfg.DebugGeolocation = true
+			h := server.NewHandler(collector.NewFileSystemCollector(cfg), &mockSubmitter{})
+			h.StrictDecoding = tc.strict
+			e := server.NewEchoServer(cfg)
+			e.POST("/report", h.CreateReport)
+
+			req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(tc.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, tc.code, rec.Code)
+			if tc.message != "" {
+				r := &server.Response{}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), r))
+				assert.Contains(t, r.Message, tc.message)
+			}
+		})
+	}
+}
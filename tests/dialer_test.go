@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/client"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	var emitted []*model.Measurement
+	d := &client.Dialer{
+		Protocol: "ss",
+		Config:   map[string]string{"prefix": "xx"},
+		Emit:     func(m *model.Measurement) { emitted = append(emitted, m) },
+	}
+
+	conn, err := d.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	_, err = d.DialContext(context.Background(), "tcp", closed.Addr().String())
+	assert.Error(t, err)
+
+	// the server closes the connection before the handshake is done.
+	d.Handshake = func(ctx context.Context, conn net.Conn) (net.Conn, error) {
+		_, err := conn.Read(make([]byte, 1))
+		return conn, err
+	}
+	_, err = d.DialContext(context.Background(), "tcp", ln.Addr().String())
+	assert.ErrorIs(t, err, io.EOF)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	err = d.Measure(ctx, "1.1.1.1:1194", "openvpn_handshake", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.Error(t, err)
+
+	if !assert.Len(t, emitted, 4) {
+		return
+	}
+	for _, m := range emitted {
+		assert.NoError(t, m.Validate())
+		assert.NotEmpty(t, m.UUID)
+		assert.Equal(t, "xx", m.Config["prefix"])
+	}
+	assert.Equal(t, "ss://"+ln.Addr().String(), emitted[0].Endpoint)
+	assert.Nil(t, emitted[0].Failure)
+	assert.Equal(t, &model.Failure{Op: "tcp_connect", Error: "connection_refused"}, emitted[1].Failure)
+	assert.Equal(t, &model.Failure{Op: "proxy_handshake", Error: "eof_error"}, emitted[2].Failure)
+	assert.Equal(t, "ss://1.1.1.1:1194", emitted[3].Endpoint)
+	assert.Equal(t, &model.Failure{Op: "proxy_handshake", Error: "generic_timeout_error"}, emitted[3].Failure)
+}
+
+func TestDialerSkipsCanceledAttempts(t *testing.T) {
+	var emitted []*model.Measurement
+	d := &client.Dialer{
+		Protocol: "ss",
+		Emit:     func(m *model.Measurement) { emitted = append(emitted, m) },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := d.DialContext(ctx, "tcp", "127.0.0.1:1")
+	assert.ErrorIs(t, err, context.Canceled)
+	err = d.Measure(ctx, "1.1.1.1:1194", model.OpProxyHandshake, func(ctx context.Context) error {
+		return ctx.Err()
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, emitted)
+
+	// a function that gives up with context.Canceled on its own is still measured.
+	err = d.Measure(context.Background(), "1.1.1.1:1194", model.OpProxyHandshake, func(ctx context.Context) error {
+		return context.Canceled
+	})
+	assert.Error(t, err)
+	assert.Len(t, emitted, 1)
+}
+
+func TestDialerEmitsToOutbox(t *testing.T) {
+	outbox, err := client.NewOutbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &client.Dialer{Protocol: "ss", Emit: outbox.Emit}
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	d.DialContext(context.Background(), "tcp", closed.Addr().String())
+	n, err := outbox.Len()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
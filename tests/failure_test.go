@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{err: nil, want: ""},
+		{err: context.Canceled, want: model.FailureInterrupted},
+		{err: fmt.Errorf("dial: %w", context.DeadlineExceeded), want: model.FailureGenericTimeout},
+		{err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, want: model.FailureGenericTimeout},
+		{err: &net.DNSError{Err: "no such host", Name: "example.org", IsNotFound: true}, want: model.FailureDNSNXDomain},
+		{err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, want: model.FailureConnectionRefused},
+		{err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, want: model.FailureConnectionReset},
+		{err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, want: model.FailureNetworkUnreachable},
+		{err: io.ErrUnexpectedEOF, want: model.FailureEOF},
+		{err: errors.New("tls: handshake failure"), want: model.FailureSSLFailedHandshake},
+		{err: errors.New("something went wrong with 1.2.3.4"), want: model.FailureUnknown},
+	} {
+		assert.Equal(t, tc.want, model.ClassifyError(tc.err), "%v", tc.err)
+	}
+}
+
+func TestNormalizeFailure(t *testing.T) {
+	for _, tc := range []struct {
+		in   model.Failure
+		want model.Failure
+	}{
+		{in: model.Failure{Op: "tcp_connect", Error: "connection_refused"}, want: model.Failure{Op: "tcp_connect", Error: "connection_refused"}},
+		{in: model.Failure{Op: "connect", Error: "ECONNREFUSED"}, want: model.Failure{Op: "tcp_connect", Error: "connection_refused"}},
+		{in: model.Failure{Op: "TLS-Handshake", Error: "read tcp 10.0.0.1:5555->1.1.1.1:443: i/o timeout"}, want: model.Failure{Op: "tls_handshake", Error: "generic_timeout_error"}},
+		{in: model.Failure{Op: "proxy_handshake.obfs4", Error: "EOF"}, want: model.Failure{Op: "proxy_handshake", Error: "eof_error"}},
+		{in: model.Failure{Op: "dns", Error: "lookup example.org: no such host"}, want: model.Failure{Op: "dns_resolve", Error: "dns_nxdomain_error"}},
+		{in: model.Failure{Op: "openvpn_handshake", Error: "timeout"}, want: model.Failure{Op: "proxy_handshake", Error: "generic_timeout_error"}},
+		{in: model.Failure{Op: "wormhole", Error: "it broke"}, want: model.Failure{Op: "wormhole", Error: "unknown_failure"}},
+	} {
+		f := tc.in
+		f.Normalize()
+		assert.Equal(t, tc.want, f, "%v", tc.in)
+	}
+}
+
+func TestValidateFailure(t *testing.T) {
+	m := newTestMeasurement("ss://1.1.1.1:443")
+	m.Failure = &model.Failure{Op: "connect", Error: "timeout"}
+	assert.Error(t, m.Validate())
+	m.Normalize()
+	assert.NoError(t, m.Validate())
+
+	m.Failure = &model.Failure{Op: "wormhole", Error: "timeout"}
+	m.Normalize()
+	var verr *model.ValidationError
+	if assert.ErrorAs(t, m.Validate(), &verr) {
+		assert.Equal(t, "unknown_failure_op", verr.Reason)
+	}
+}
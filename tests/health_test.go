@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	store, err := collector.NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	fb, cm := newFakeOONIBackend(t)
+
+	health := server.NewHealth()
+	health.Add("geoip", collector.CheckGeoIP)
+	health.Add("storage", store.Check)
+	outage := time.Hour
+	health.Add("upstream", func() error {
+		since, err := cm.FailingSince()
+		if !since.IsZero() && time.Since(since) > outage {
+			return err
+		}
+		return nil
+	})
+	e := echo.New()
+	e.GET(server.PathLive, health.HandleLive)
+	e.GET(server.PathReady, health.HandleReady)
+
+	var body string
+	get := func(path string) (int, *server.Readiness) {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		body = rec.Body.String()
+		r := &server.Readiness{}
+		json.Unmarshal(rec.Body.Bytes(), r)
+		return rec.Code, r
+	}
+
+	code, _ := get(server.PathLive)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, r := get(server.PathReady)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, r.OK)
+	assert.Len(t, r.Checks, 3)
+
+	// a failed submission does not make the collector unready.
+	fb.fail = true
+	assert.Error(t, cm.SubmitMeasurement(makeStoredMeasurement(time.Now())))
+	code, _ = get(server.PathReady)
+	assert.Equal(t, http.StatusOK, code)
+
+	// but an outage does, until a submission succeeds.
+	outage = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	code, r = get(server.PathReady)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, r.OK)
+	assert.False(t, r.Checks["upstream"].OK)
+	assert.True(t, r.Checks["storage"].OK)
+	// the error is not served to unauthenticated callers.
+	assert.NotContains(t, body, "status")
+	assert.NotContains(t, body, "msg")
+
+	fb.fail = false
+	assert.NoError(t, cm.SubmitMeasurement(makeStoredMeasurement(time.Now())))
+	code, _ = get(server.PathReady)
+	assert.Equal(t, http.StatusOK, code)
+
+	// a data dir that cannot be created is not writable.
+	file := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(file, nil, 0o600))
+	cfg.DataDir = filepath.Join(file, "data")
+	assert.Error(t, collector.NewFileStorage(cfg).Check())
+}
@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/logging"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	assert.Equal(t, "1.2.3.0/24", logging.Redact("1.2.3.4", logging.ModeTruncate))
+	assert.Equal(t, "1.2.3.0/24", logging.Redact("1.2.3.4:443", logging.ModeTruncate))
+	assert.Equal(t, "2001:db8:1::/48", logging.Redact("2001:db8:1:2::1", logging.ModeTruncate))
+	assert.Equal(t, "1.2.3.4", logging.Redact("1.2.3.4", logging.ModeKeep))
+
+	hashed := logging.Redact("1.2.3.4", logging.ModeHash)
+	assert.NotContains(t, hashed, "1.2.3")
+	assert.Equal(t, hashed, logging.Redact("1.2.3.4", logging.ModeHash))
+	assert.NotEqual(t, hashed, logging.Redact("1.2.3.5", logging.ModeHash))
+
+	_, err := logging.ParseRedactions([]string{"client_ip=scramble"})
+	assert.Error(t, err)
+	_, err = logging.ParseRedactions([]string{"client_ip"})
+	assert.Error(t, err)
+}
+
+func TestAccessLog(t *testing.T) {
+	for _, tc := range []struct {
+		redact []string
+		want   string
+	}{
+		{redact: nil, want: ""},
+		{redact: []string{"client_ip=truncate"}, want: "2.3.4.0/24"},
+		{redact: []string{"client_ip=drop"}, want: ""},
+	} {
+		var buf bytes.Buffer
+		cfg := config.NewConfig()
+		cfg.DebugGeolocation = true
+		cfg.Debug = true
+		cfg.LogRedact = tc.redact
+		defaultLogger := slog.Default()
+		slog.SetDefault(logging.New(cfg, &buf))
+		e := server.NewEchoServer(cfg)
+		slog.SetDefault(defaultLogger)
+
+		col := collector.NewFileSystemCollector(cfg)
+		h := server.NewHandler(col, &mockSubmitter{})
+		e.POST("/report", h.CreateReport)
+
+		report := makeReport(&reportData{
+			Type:      "tunnel-telemetry",
+			Timestamp: makeTimestampForYesterday(),
+			Endpoint:  "ss://1.1.1.1:443",
+		})
+		req := httptest.NewRequest(http.MethodPost, "/report?token=secret", strings.NewReader(report))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderXForwardedFor, "2.3.4.5")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		logs := buf.String()
+		assert.NotContains(t, logs, "2.3.4.5")
+		assert.NotContains(t, logs, "secret")
+
+		var entry map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+			var e map[string]any
+			if assert.NoError(t, json.Unmarshal([]byte(line), &e)) && e["msg"] == "request" {
+				entry = e
+			}
+		}
+		if !assert.NotNil(t, entry) {
+			continue
+		}
+		assert.Equal(t, rec.Header().Get(echo.HeaderXRequestID), entry["request_id"])
+		assert.Equal(t, "/report", entry["path"])
+		assert.EqualValues(t, http.StatusCreated, entry["status"])
+		switch {
+		case tc.redact == nil:
+			assert.NotEmpty(t, entry[logging.FieldClientIP])
+		case tc.want == "":
+			assert.NotContains(t, entry, logging.FieldClientIP)
+		default:
+			assert.Equal(t, tc.want, entry[logging.FieldClientIP])
+		}
+	}
+}
+
+// lockedBuffer is a buffer that a server can write to while the test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServerErrorLog(t *testing.T) {
+	var buf lockedBuffer
+	cfg := config.NewConfig()
+	cfg.Debug = true
+	cfg.LogRedact = []string{"client_ip=truncate"}
+	logger := logging.New(cfg, &buf)
+
+	cert := newTestCert(t, "collector", nil, false)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   http.NotFoundHandler(),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert.tlsCertificate(t)}},
+		ErrorLog:  server.ErrorLog(logger),
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	// a client that does not speak TLS makes the handshake fail.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	io.Copy(io.Discard, conn)
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(buf.String(), "TLS handshake error") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	logs := buf.String()
+	assert.Contains(t, logs, "TLS handshake error")
+	assert.Contains(t, logs, `"client_ip":"127.0.0.0/24"`)
+	assert.NotContains(t, logs, "127.0.0.1")
+}
@@ -0,0 +1,52 @@
+package tests
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/metrics"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	col := collector.NewFileSystemCollector(cfg)
+	h := server.NewHandler(col, &mockSubmitter{})
+	e := server.NewEchoServer(cfg)
+	e.POST("/report", h.CreateReport)
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+
+	failure := `{"op": "tls_handshake", "error": "connection_reset"}`
+	for _, rd := range []*reportData{
+		{Type: "tunnel-telemetry", Timestamp: makeTimestampForYesterday(), Endpoint: "ss://1.1.1.1:443", Failure: &failure},
+		{Type: "tunnel-telemetry", Timestamp: makeTimestampForOneMonthAgo(), Endpoint: "ss://1.1.1.1:443"},
+		{Type: "tunnel-telemetry", Timestamp: makeTimestampForYesterday(), Endpoint: "made-up-proto://1.1.1.1:443"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(makeReport(rd)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderXForwardedFor, "2.3.4.5")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body, _ := io.ReadAll(rec.Body)
+	text := string(body)
+
+	assert.Contains(t, text, "tt_reports_received_total")
+	assert.Contains(t, text, `tt_reports_accepted_total{failure_op="tls_handshake",proto="ss"}`)
+	assert.Contains(t, text, `tt_reports_accepted_total{failure_op="none",proto="other"}`)
+	assert.NotContains(t, text, "made-up-proto")
+	assert.Contains(t, text, `tt_reports_rejected_total{reason="too_old"}`)
+	assert.Contains(t, text, "go_goroutines")
+}
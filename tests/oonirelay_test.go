@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/oonirelay"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOONIBackend counts the reports that are opened and closed, and the measurements sent into them.
+type fakeOONIBackend struct {
+	mu           sync.Mutex
+	opened       int
+	closed       int
+	measurements map[string]int
+	fail         bool
+	failSend     bool
+
+	// if hold is set, measurements wait for it to be closed before being accepted.
+	hold     chan struct{}
+	inFlight atomic.Int32
+}
+
+func (fb *fakeOONIBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if fb.hold != nil && strings.Count(strings.Trim(r.URL.Path, "/"), "/") == 1 {
+		fb.inFlight.Add(1)
+		<-fb.hold
+	}
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if fb.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1:
+		fb.opened++
+		fmt.Fprintf(w, `{"report_id": "report-%d"}`, fb.opened)
+	case len(parts) == 3 && parts[2] == "close":
+		fb.closed++
+	case len(parts) == 2 && fb.failSend:
+		w.WriteHeader(http.StatusInternalServerError)
+	case len(parts) == 2:
+		fb.measurements[parts[1]]++
+		fmt.Fprintf(w, `{"measurement_uid": "%s-%d"}`, parts[1], fb.measurements[parts[1]])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newFakeOONIBackend(t *testing.T) (*fakeOONIBackend, *oonirelay.ChannelManager) {
+	fb := &fakeOONIBackend{measurements: map[string]int{}}
+	srv := httptest.NewServer(fb)
+	t.Cleanup(srv.Close)
+	cm := oonirelay.NewChannelManager(time.Hour)
+	cm.API = srv.URL
+	return fb, cm
+}
+
+func TestChannelManagerReusesReports(t *testing.T) {
+	fb, cm := newFakeOONIBackend(t)
+
+	for i := 0; i < 3; i++ {
+		m := makeStoredMeasurement(time.Now())
+		assert.NoError(t, cm.SubmitMeasurement(m))
+		assert.Equal(t, fmt.Sprintf("report-1-%d", i+1), m.OOID)
+	}
+	other := makeStoredMeasurement(time.Now())
+	other.ClientCC = "NO"
+	assert.NoError(t, cm.SubmitMeasurement(other))
+	assert.Equal(t, "report-2-1", other.OOID)
+
+	assert.Equal(t, 2, fb.opened)
+	assert.Equal(t, 2, cm.Open())
+
+	assert.NoError(t, cm.Close())
+	assert.Equal(t, 2, fb.closed)
+	assert.Equal(t, 0, cm.Open())
+}
+
+func TestChannelManagerRotatesReports(t *testing.T) {
+	fb, cm := newFakeOONIBackend(t)
+	cm.MaxAge = time.Millisecond
+
+	assert.NoError(t, cm.SubmitMeasurement(makeStoredMeasurement(time.Now())))
+	time.Sleep(5 * time.Millisecond)
+	cm.Rotate()
+	assert.Equal(t, 1, fb.closed)
+
+	assert.NoError(t, cm.SubmitMeasurement(makeStoredMeasurement(time.Now())))
+	assert.Equal(t, 2, fb.opened)
+}
+
+func TestChannelManagerDiscardsFailingReports(t *testing.T) {
+	fb, cm := newFakeOONIBackend(t)
+
+	assert.NoError(t, cm.SubmitMeasurement(makeStoredMeasurement(time.Now())))
+	fb.fail = true
+	assert.ErrorIs(t, cm.SubmitMeasurement(makeStoredMeasurement(time.Now())), oonirelay.ErrUnexpectedStatus)
+	assert.Equal(t, 0, cm.Open())
+
+	fb.fail = false
+	assert.NoError(t, cm.SubmitMeasurement(makeStoredMeasurement(time.Now())))
+	assert.Equal(t, 2, fb.opened)
+}
+
+func TestChannelManagerClosesFailingReports(t *testing.T) {
+	fb, cm := newFakeOONIBackend(t)
+
+	fb.failSend = true
+	assert.ErrorIs(t, cm.SubmitMeasurement(makeStoredMeasurement(time.Now())), oonirelay.ErrUnexpectedStatus)
+	assert.Equal(t, 0, cm.Open())
+	assert.Equal(t, 1, fb.closed)
+}
+
+func TestChannelManagerSendsConcurrently(t *testing.T) {
+	fb, cm := newFakeOONIBackend(t)
+	assert.NoError(t, cm.SubmitMeasurement(makeStoredMeasurement(time.Now())))
+
+	// both measurements are in flight in the same report at the same time.
+	fb.hold = make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, cm.SubmitMeasurement(makeStoredMeasurement(time.Now())))
+		}()
+	}
+	assert.Eventually(t, func() bool { return fb.inFlight.Load() == 2 }, 5*time.Second, time.Millisecond)
+	close(fb.hold)
+	wg.Wait()
+	assert.Equal(t, 1, fb.opened)
+	assert.Equal(t, 3, fb.measurements["report-1"])
+}
+
+func TestRelayIsNotRetriedWhenStoringTheIDFails(t *testing.T) {
+	fb, cm := newFakeOONIBackend(t)
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	store, err := collector.NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	col := collector.NewCollector(cfg, store)
+	col.SetRelay(cm)
+
+	// the measurement is not in the store, so its OONI ID cannot be stored.
+	m := makeStoredMeasurement(time.Now())
+	assert.NoError(t, col.Relay(m))
+	assert.Equal(t, "report-1-1", m.OOID)
+	assert.Equal(t, 1, fb.opened)
+}
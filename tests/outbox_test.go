@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	outbox, err := client.NewOutbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.MaxReports = 3
+	outbox.BatchSize = 2
+
+	// the same report is only kept once.
+	m := newTestMeasurement("ss://1.1.1.1:443")
+	assert.NoError(t, outbox.Add(m))
+	assert.NotEmpty(t, m.UUID)
+	assert.NoError(t, outbox.Add(m))
+	n, _ := outbox.Len()
+	assert.Equal(t, 1, n)
+
+	// collectors would not accept this one.
+	old := newTestMeasurement("ss://1.1.1.1:443")
+	longAgo := time.Now().Add(-8 * 24 * time.Hour)
+	old.TimeStart = &longAgo
+	assert.ErrorIs(t, outbox.Add(old), client.ErrTooOld)
+
+	// when the outbox is full, the oldest reports are dropped.
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, outbox.Add(newTestMeasurement("ss://1.1.1.1:443")))
+	}
+	n, _ = outbox.Len()
+	assert.Equal(t, 3, n)
+
+	// nothing is lost while there's no collector to take the reports.
+	down := client.Client{Collectors: []string{"http://127.0.0.1:1"}}
+	res, err := outbox.Flush(context.Background(), &down)
+	assert.Error(t, err)
+	assert.Equal(t, 3, res.Pending)
+
+	invalid := newTestMeasurement("")
+	assert.NoError(t, outbox.Add(invalid))
+
+	srv := newTestCollector(t)
+	up := client.Client{Collectors: []string{srv.URL}}
+	res, err = outbox.Flush(context.Background(), &up)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &client.FlushResult{Submitted: 2, Rejected: 1, Pending: 0}, res)
+	}
+}
+
+func TestOutboxStampsTheNetwork(t *testing.T) {
+	outbox, err := client.NewOutbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.ClientASN, outbox.ClientCC = "AS3215", "FR"
+
+	// a report without a time would be dropped when flushing.
+	m := newTestMeasurement("ss://1.1.1.1:443")
+	m.TimeStart = nil
+	assert.ErrorIs(t, outbox.Add(m), client.ErrNoTime)
+
+	m = newTestMeasurement("ss://1.1.1.1:443")
+	m.ClientASN, m.ClientCC = "", ""
+	assert.NoError(t, outbox.Add(m))
+	assert.Equal(t, "AS3215", m.ClientASN)
+	assert.Equal(t, "FR", m.ClientCC)
+
+	// the network the report already has is kept.
+	m = newTestMeasurement("ss://1.1.1.1:443")
+	m.ClientASN, m.ClientCC = "AS13335", "US"
+	assert.NoError(t, outbox.Add(m))
+	assert.Equal(t, "AS13335", m.ClientASN)
+
+	// the collector still parses the endpoint of the stamped reports.
+	srv, submitter := newRecordingCollector(t)
+	res, err := outbox.Flush(context.Background(), &client.Client{Collectors: []string{srv.URL}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, res.Submitted)
+	}
+	if assert.Len(t, submitter.submitted, 2) {
+		for _, stored := range submitter.submitted {
+			assert.Equal(t, "ss", stored.Protocol)
+			assert.Equal(t, 443, stored.EndpointPort)
+			assert.Equal(t, "AS13335", stored.EndpointASN)
+		}
+	}
+}
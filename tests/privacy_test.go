@@ -0,0 +1,218 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/aggregate"
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/ainghazal/tunnel-telemetry/internal/privacy"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeContributedMeasurement(ip string) *model.Measurement {
+	now := time.Now()
+	m := makeStoredMeasurement(now)
+	m.TimeReported = &now
+	m.Contributor = privacy.Contributor(ip)
+	return m
+}
+
+// newPrivacyStorage returns a storage with the measurements in it.
+func newPrivacyStorage(t *testing.T, mm ...*model.Measurement) model.Storage {
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	store, err := collector.NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	for _, m := range mm {
+		if err := store.Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+// getStored returns the stored version of the measurement.
+func getStored(t *testing.T, store model.Storage, m *model.Measurement) *model.Measurement {
+	stored, err := store.Get(m.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestPrivacyGateHoldsUntilK(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.PrivacyK = 3
+	upstream := &mockSubmitter{}
+	gate := privacy.NewGate(cfg, upstream)
+
+	// the same client reporting many times is still a single contributor.
+	for i := 0; i < 5; i++ {
+		gate.Submit([]*model.Measurement{makeContributedMeasurement("2.3.4.5")})
+	}
+	gate.Submit([]*model.Measurement{makeContributedMeasurement("2.3.4.6")})
+	assert.Empty(t, upstream.submitted)
+	assert.Equal(t, 6, gate.Held())
+
+	gate.Submit([]*model.Measurement{makeContributedMeasurement("2.3.4.7")})
+	assert.Len(t, upstream.submitted, 7)
+	assert.Equal(t, 0, gate.Held())
+
+	// once the bucket has been released, new reports go through right away.
+	gate.Submit([]*model.Measurement{makeContributedMeasurement("2.3.4.8")})
+	assert.Len(t, upstream.submitted, 8)
+}
+
+func TestPrivacyGateCoarsensRareBuckets(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.PrivacyK = 2
+	upstream := &mockSubmitter{}
+	gate := privacy.NewGate(cfg, upstream)
+
+	// two clients in the same country, but from different networks.
+	held := []*model.Measurement{}
+	for i, asn := range []string{"AS3215", "AS12322"} {
+		m := makeContributedMeasurement(fmt.Sprintf("2.3.4.%d", i))
+		m.ClientASN = asn
+		m.EndpointASN = "AS13335"
+		gate.Submit([]*model.Measurement{m})
+		held = append(held, m)
+	}
+	// and a single client from another country.
+	lonely := makeContributedMeasurement("5.6.7.8")
+	lonely.ClientCC = "NO"
+	gate.Store = newPrivacyStorage(t, held[0], held[1], lonely)
+	gate.Submit([]*model.Measurement{lonely})
+	assert.Empty(t, upstream.submitted)
+
+	gate.Expire()
+	assert.Equal(t, 0, gate.Held())
+	if assert.Len(t, upstream.submitted, 2) {
+		for _, m := range upstream.submitted {
+			assert.Equal(t, "FR", m.ClientCC)
+			assert.Equal(t, "AS0", m.ClientASN)
+			assert.Equal(t, "AS0", m.EndpointASN)
+		}
+	}
+	// the stored reports keep their ASNs.
+	assert.Equal(t, "AS3215", held[0].ClientASN)
+	assert.Equal(t, "AS13335", held[0].EndpointASN)
+
+	// and they're only published coarsened.
+	stored := getStored(t, gate.Store, held[0])
+	assert.Equal(t, "AS3215", stored.ClientASN)
+	published := gate.Publish(stored)
+	if assert.NotNil(t, published) {
+		assert.Equal(t, "AS0", published.ClientASN)
+	}
+	assert.Nil(t, gate.Publish(getStored(t, gate.Store, lonely)))
+}
+
+func TestPrivacyGateDropsRareBuckets(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.PrivacyK = 2
+	cfg.PrivacyPolicy = privacy.PolicyDrop
+	upstream := &mockSubmitter{}
+	gate := privacy.NewGate(cfg, upstream)
+
+	for i, asn := range []string{"AS3215", "AS12322"} {
+		m := makeContributedMeasurement(fmt.Sprintf("2.3.4.%d", i))
+		m.ClientASN = asn
+		gate.Submit([]*model.Measurement{m})
+	}
+	gate.Expire()
+	assert.Empty(t, upstream.submitted)
+	assert.Equal(t, 0, gate.Held())
+}
+
+func TestPrivacyGatePublish(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.PrivacyK = 2
+	first, second := makeContributedMeasurement("2.3.4.5"), makeContributedMeasurement("2.3.4.6")
+	store := newPrivacyStorage(t, first, second)
+	gate := privacy.NewGate(cfg, &mockSubmitter{})
+	gate.Store = store
+
+	gate.Submit([]*model.Measurement{first})
+	assert.Nil(t, gate.Publish(getStored(t, store, first)))
+
+	gate.Submit([]*model.Measurement{second})
+	stored := getStored(t, store, first)
+	assert.Equal(t, model.PrivacyReleased, stored.Privacy)
+	assert.Equal(t, stored, gate.Publish(stored))
+
+	// the decision is stored, so it's still published once the window is over, or by
+	// another gate (e.g., after a restart).
+	gate.Expire()
+	assert.Equal(t, stored, gate.Publish(stored))
+	assert.Equal(t, stored, privacy.NewGate(cfg, &mockSubmitter{}).Publish(stored))
+
+	// reports without a decision are not published.
+	assert.Nil(t, gate.Publish(makeContributedMeasurement("2.3.4.5")))
+}
+
+func TestPrivacyGateMaxHeld(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.PrivacyK = 3
+	upstream := &mockSubmitter{}
+	gate := privacy.NewGate(cfg, upstream)
+	gate.MaxHeld = 2
+
+	for i := 0; i < 3; i++ {
+		gate.Submit([]*model.Measurement{makeContributedMeasurement("2.3.4.5")})
+	}
+	assert.Equal(t, 2, gate.Held())
+
+	// reports over the limit still count as contributors.
+	gate.Submit([]*model.Measurement{makeContributedMeasurement("2.3.4.6")})
+	gate.Submit([]*model.Measurement{makeContributedMeasurement("2.3.4.7")})
+	assert.Len(t, upstream.submitted, 3)
+	assert.Equal(t, 0, gate.Held())
+}
+
+func TestPrivacyGateFlushesIntoAggregatorOnShutdown(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.PrivacyK = 2
+	upstream := &mockAggregateSubmitter{}
+	agg := aggregate.NewAggregator(cfg, upstream)
+	gate := privacy.NewGate(cfg, agg)
+
+	run := func(fn func(ctx context.Context)) func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			fn(ctx)
+		}()
+		return func() {
+			cancel()
+			<-done
+		}
+	}
+	stopAggregator := run(agg.Run)
+	stopGate := run(gate.Run)
+
+	for i, asn := range []string{"AS3215", "AS12322"} {
+		m := makeContributedMeasurement(fmt.Sprintf("2.3.4.%d", i))
+		m.ClientASN = asn
+		gate.Submit([]*model.Measurement{m})
+	}
+	assert.Equal(t, 2, gate.Held())
+
+	// the gate releases what it holds on its way out, and only then the aggregator
+	// flushes everything.
+	stopGate()
+	stopAggregator()
+	if assert.Len(t, upstream.aggregates, 1) {
+		assert.Equal(t, "AS0", upstream.aggregates[0].ClientASN)
+		assert.Equal(t, 2, upstream.aggregates[0].Count)
+	}
+}
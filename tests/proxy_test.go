@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func realIPServer(cfg *config.Config) *echo.Echo {
+	e := server.NewEchoServer(cfg)
+	e.GET("/ip", func(c echo.Context) error {
+		return c.String(http.StatusOK, c.RealIP())
+	})
+	return e
+}
+
+func TestTrustedProxyHeaders(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	e := realIPServer(cfg)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		value      string
+		want       string
+	}{
+		{"xff from trusted proxy", "10.1.2.3:1234", echo.HeaderXForwardedFor, "2.3.4.5", "2.3.4.5"},
+		{"real ip from trusted proxy", "192.0.2.1:1234", echo.HeaderXRealIP, "2.3.4.5", "2.3.4.5"},
+		{"chained proxies", "10.1.2.3:1234", echo.HeaderXForwardedFor, "2.3.4.5, 10.9.9.9", "2.3.4.5"},
+		{"xff from untrusted peer", "198.51.100.1:1234", echo.HeaderXForwardedFor, "2.3.4.5", "198.51.100.1"},
+		{"real ip from untrusted peer", "127.0.0.1:1234", echo.HeaderXRealIP, "2.3.4.5", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/ip", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set(tt.header, tt.value)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, tt.want, rec.Body.String())
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := server.ParseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1", " "})
+	if assert.NoError(t, err) && assert.Len(t, nets, 2) {
+		assert.Equal(t, "2001:db8::1/128", nets[1].String())
+	}
+	_, err = server.ParseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+	_, err = server.ParseTrustedProxies([]string{"not-an-ip"})
+	assert.Error(t, err)
+}
+
+// proxyProtocolRequest sends a request to ln, with a PROXY header from a spoofed address
+// if header is set, and returns the status and the body of the response.
+func proxyProtocolRequest(t *testing.T, ln net.Listener, header bool) (int, string) {
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if header {
+		fmt.Fprint(conn, "PROXY TCP4 2.3.4.5 192.0.2.10 40000 443\r\n")
+	}
+	fmt.Fprint(conn, "GET /ip HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		// the connection was closed before responding.
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.ProxyProtocol = true
+	cfg.TrustedProxies = []string{"127.0.0.1"}
+	ln, err := server.NewListener(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: realIPServer(cfg)}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	status, body := proxyProtocolRequest(t, ln, true)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "2.3.4.5", body)
+}
+
+func TestProxyProtocolFromUntrustedPeer(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.ProxyProtocol = true
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	ln, err := server.NewListener(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: realIPServer(cfg)}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// the request is rejected, so the spoofed address never reaches the handler.
+	status, body := proxyProtocolRequest(t, ln, true)
+	assert.NotEqual(t, http.StatusOK, status)
+	assert.NotContains(t, body, "2.3.4.5")
+
+	// untrusted peers can still connect without the header.
+	status, body = proxyProtocolRequest(t, ln, false)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "127.0.0.1", body)
+}
+
+func TestProxyProtocolNeedsTrustedProxies(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.ProxyProtocol = true
+	_, err := server.NewListener(cfg)
+	assert.ErrorIs(t, err, server.ErrNoTrustedProxies)
+}
@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+var testQueryToken = "s3cr3t"
+
+func newQueryServer(t *testing.T, backend string, mm []*model.Measurement) *echo.Echo {
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.StorageBackend = backend
+
+	store, err := collector.NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	for _, m := range mm {
+		if err := store.Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	col := collector.NewCollector(cfg, store)
+	h := server.NewHandler(col, col)
+
+	e := server.NewEchoServer(cfg)
+	e.GET("/reports", h.ListReports, server.RequireToken(testQueryToken))
+	return e
+}
+
+func doQuery(e *echo.Echo, params url.Values, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/reports?"+params.Encode(), nil)
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func seedQueryMeasurements() []*model.Measurement {
+	now := time.Now().UTC().Truncate(time.Second)
+	mm := []*model.Measurement{}
+	for i := 0; i < 5; i++ {
+		m := makeStoredMeasurement(now.Add(time.Duration(-i) * time.Hour))
+		if i%2 == 0 {
+			m.Failure = &model.Failure{Op: "tcp_connect", Error: "generic_timeout_error"}
+		}
+		mm = append(mm, m)
+	}
+	mm[4].ClientASN = "AS13335"
+	mm[4].Protocol = "obfs4"
+	return mm
+}
+
+func testQueryAPI(t *testing.T, backend string) {
+	e := newQueryServer(t, backend, seedQueryMeasurements())
+
+	rec := doQuery(e, url.Values{}, "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = doQuery(e, url.Values{}, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = doQuery(e, url.Values{"endpoint_port": {"99999"}}, testQueryToken)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	list := &server.ReportList{}
+	rec = doQuery(e, url.Values{"failure": {"true"}}, testQueryToken)
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), list))
+		assert.Len(t, list.Reports, 3)
+		assert.Empty(t, list.NextCursor)
+	}
+
+	rec = doQuery(e, url.Values{"client_asn": {"13335"}, "proto": {"obfs4"}}, testQueryToken)
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), list))
+		assert.Len(t, list.Reports, 1)
+	}
+
+	since := time.Now().Add(-150 * time.Minute).UTC().Format(time.RFC3339)
+	rec = doQuery(e, url.Values{"since": {since}, "failure": {"false"}}, testQueryToken)
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), list))
+		assert.Len(t, list.Reports, 1)
+	}
+
+	// walk all the pages, two reports at a time.
+	seen := []string{}
+	params := url.Values{"limit": {"2"}}
+	for i := 0; i < 5; i++ {
+		rec = doQuery(e, params, testQueryToken)
+		if !assert.Equal(t, http.StatusOK, rec.Code) {
+			break
+		}
+		page := &server.ReportList{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), page))
+		for _, m := range page.Reports {
+			seen = append(seen, m.UUID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		params.Set("cursor", page.NextCursor)
+	}
+	assert.Len(t, seen, 5)
+
+	rec = doQuery(e, url.Values{"format": {"ndjson"}}, testQueryToken)
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		lines := 0
+		scanner := bufio.NewScanner(rec.Body)
+		for scanner.Scan() {
+			m := &model.Measurement{}
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), m))
+			lines++
+		}
+		assert.Equal(t, 5, lines)
+	}
+}
+
+func TestQueryAPIWithFileSystemStorage(t *testing.T) {
+	testQueryAPI(t, collector.StorageFileSystem)
+}
+
+func TestQueryAPIWithSQLiteStorage(t *testing.T) {
+	testQueryAPI(t, collector.StorageSQLite)
+}
+
+func TestQueryMatchWithoutStartTime(t *testing.T) {
+	m := makeStoredMeasurement(time.Now())
+	m.TimeStart = nil
+
+	assert.True(t, (&model.Query{}).Match(m))
+	assert.True(t, (&model.Query{ClientASN: m.ClientASN}).Match(m))
+	assert.False(t, (&model.Query{ClientASN: "AS13335"}).Match(m))
+	assert.False(t, (&model.Query{Protocol: "obfs4"}).Match(m))
+	since := time.Now().Add(-time.Hour)
+	assert.False(t, (&model.Query{Since: &since}).Match(m))
+}
@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/ratelimit"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitPerIP(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.RateLimitIP = 2
+	cfg.BanThreshold = 3
+	l := ratelimit.NewLimiter(cfg)
+
+	for i := 0; i < 2; i++ {
+		ok, _ := l.AllowIP("2.3.4.5")
+		assert.True(t, ok)
+	}
+	ok, retryAfter := l.AllowIP("2.3.4.5")
+	assert.False(t, ok)
+	assert.Greater(t, retryAfter.Seconds(), 0.0)
+
+	// other IPs have their own bucket.
+	ok, _ = l.AllowIP("2.3.4.6")
+	assert.True(t, ok)
+
+	// after enough rejections, the IP is banned.
+	l.AllowIP("2.3.4.5")
+	ok, retryAfter = l.AllowIP("2.3.4.5")
+	assert.False(t, ok)
+	assert.Equal(t, cfg.BanDuration, retryAfter)
+
+	stats := l.Stats()
+	assert.Equal(t, int64(3), stats.RejectedIP)
+	assert.Equal(t, int64(1), stats.Bans)
+	assert.Equal(t, 1, stats.Banned)
+
+	l.AllowIP("2.3.4.5")
+	assert.Equal(t, int64(1), l.Stats().RejectedBanned)
+}
+
+func TestRateLimitSkipsUnknownASN(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.RateLimitASN = 1
+	l := ratelimit.NewLimiter(cfg)
+
+	// the clients that cannot be geolocated do not share a bucket.
+	for i := 0; i < 3; i++ {
+		ok, _ := l.AllowASN("AS0")
+		assert.True(t, ok)
+	}
+	ok, _ := l.AllowASN("AS3352")
+	assert.True(t, ok)
+	ok, _ = l.AllowASN("AS3352")
+	assert.False(t, ok)
+	assert.Equal(t, int64(1), l.Stats().RejectedASN)
+}
+
+func TestRateLimitPerASN(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	cfg.RateLimitASN = 1
+	col := collector.NewFileSystemCollector(cfg)
+	h := server.NewHandler(col, &mockSubmitter{})
+	h.Limiter = ratelimit.NewLimiter(cfg)
+
+	e := server.NewEchoServer(cfg)
+	e.POST("/report", h.CreateReport, server.RateLimit(h.Limiter))
+
+	post := func(ip, clientASN string) *httptest.ResponseRecorder {
+		report := makeReport(&reportData{
+			Type:      "tunnel-telemetry",
+			Timestamp: makeTimestampForYesterday(),
+			Endpoint:  "ss://1.1.1.1:443",
+		})
+		if clientASN != "" {
+			report = strings.Replace(report, "{", `{"client_asn": "`+clientASN+`", "client_cc": "IT",`, 1)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(report))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderXForwardedFor, ip)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusCreated, post("2.3.4.5", "").Code)
+
+	// a different IP in the same ASN hits the limit.
+	rec := post("2.3.4.6", "")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get(echo.HeaderRetryAfter))
+	assert.Equal(t, int64(1), h.Limiter.Stats().RejectedASN)
+
+	// reporting another ASN does not escape the limit.
+	rec = post("2.3.4.7", "AS1234")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, int64(2), h.Limiter.Stats().RejectedASN)
+}
+
+func TestRateLimitIPv6Prefix(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.RateLimitIP = 1
+	l := ratelimit.NewLimiter(cfg)
+
+	ok, _ := l.AllowIP("2001:db8:1:2::1")
+	assert.True(t, ok)
+
+	// another address in the same /64 shares the bucket.
+	ok, _ = l.AllowIP("2001:db8:1:2::2")
+	assert.False(t, ok)
+
+	ok, _ = l.AllowIP("2001:db8:1:3::1")
+	assert.True(t, ok)
+}
+
+func TestRateLimitBatchPerReport(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	cfg.RateLimitIP = 2
+	submitter := &mockSubmitter{}
+	h := server.NewHandler(collector.NewFileSystemCollector(cfg), submitter)
+	h.Limiter = ratelimit.NewLimiter(cfg)
+
+	e := server.NewEchoServer(cfg)
+	e.POST("/report/batch", h.CreateReportBatch, server.RateLimit(h.Limiter))
+
+	reports := makeBatchReports()
+	body := strings.Join([]string{reports[0], reports[0], reports[0]}, "\n")
+	req := httptest.NewRequest(http.MethodPost, "/report/batch", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, "application/x-ndjson")
+	req.Header.Set(echo.HeaderXForwardedFor, "2.3.4.5")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if !assert.Equal(t, http.StatusOK, rec.Code) {
+		return
+	}
+
+	// every report in the batch is charged to the client IP.
+	result := &server.BatchResult{}
+	if err := json.Unmarshal(rec.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, result.Accepted)
+	assert.Equal(t, 1, result.Rejected)
+	assert.True(t, result.Results[2].Retry)
+	assert.Equal(t, int64(1), h.Limiter.Stats().RejectedIP)
+}
@@ -0,0 +1,198 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/ainghazal/tunnel-telemetry/internal/relayqueue"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayQueueRetriesWithBackoff(t *testing.T) {
+	dir := t.TempDir()
+	q, err := relayqueue.New(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := makeStoredMeasurement(time.Now())
+	assert.NoError(t, q.Push(m))
+
+	calls := 0
+	failing := func(*model.Measurement) error {
+		calls++
+		return errors.New("upstream is down")
+	}
+	assert.NoError(t, q.ProcessDue(context.Background(), failing))
+	assert.Equal(t, 1, calls)
+
+	// the item is not due again until the backoff expires.
+	assert.NoError(t, q.ProcessDue(context.Background(), failing))
+	assert.Equal(t, 1, calls)
+
+	stats, err := q.Stats()
+	if assert.NoError(t, err) {
+		assert.Equal(t, relayqueue.Stats{Pending: 1, Dead: 0}, stats)
+	}
+
+	// a new queue on the same dir resumes the pending items.
+	q, err = relayqueue.New(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = q.Stats()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, stats.Pending)
+	}
+}
+
+func TestRelayQueueSubmitsPendingItems(t *testing.T) {
+	q, err := relayqueue.New(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := makeStoredMeasurement(time.Now())
+	assert.NoError(t, q.Push(m))
+
+	var relayed *model.Measurement
+	assert.NoError(t, q.ProcessDue(context.Background(), func(m *model.Measurement) error {
+		relayed = m
+		return nil
+	}))
+	if assert.NotNil(t, relayed) {
+		assert.Equal(t, m.UUID, relayed.UUID)
+	}
+	stats, err := q.Stats()
+	if assert.NoError(t, err) {
+		assert.Equal(t, relayqueue.Stats{Pending: 0, Dead: 0}, stats)
+	}
+}
+
+func TestRelayQueueMovesToDeadLetter(t *testing.T) {
+	q, err := relayqueue.New(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, q.Push(makeStoredMeasurement(time.Now())))
+	assert.NoError(t, q.ProcessDue(context.Background(), func(*model.Measurement) error {
+		return errors.New("rejected")
+	}))
+	stats, err := q.Stats()
+	if assert.NoError(t, err) {
+		assert.Equal(t, relayqueue.Stats{Pending: 0, Dead: 1}, stats)
+	}
+}
+
+func TestRelayQueuePaused(t *testing.T) {
+	q, err := relayqueue.New(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, q.Push(makeStoredMeasurement(time.Now())))
+
+	// the items are kept as they are, without counting an attempt.
+	calls := 0
+	submit := func(*model.Measurement) error {
+		calls++
+		return nil
+	}
+	q.SetPaused(true)
+	assert.NoError(t, q.ProcessDue(context.Background(), submit))
+	assert.Equal(t, 0, calls)
+	stats, err := q.Stats()
+	if assert.NoError(t, err) {
+		assert.Equal(t, relayqueue.Stats{Pending: 1, Dead: 0}, stats)
+	}
+
+	q.SetPaused(false)
+	assert.NoError(t, q.ProcessDue(context.Background(), submit))
+	assert.Equal(t, 1, calls)
+}
+
+func TestCollectorQueuesEveryFailedRelay(t *testing.T) {
+	fb, cm := newFakeOONIBackend(t)
+	fb.fail = true
+	cfg := config.NewConfig()
+	cfg.RelayToOONI = true
+	q, err := relayqueue.New(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	col := collector.NewCollector(cfg, nil)
+	col.SetRelay(cm)
+	col.SetRelayQueue(q)
+
+	// the first report cannot be encoded, so it cannot be queued either.
+	broken := makeStoredMeasurement(time.Now())
+	broken.SamplingRate = float32(math.NaN())
+	assert.False(t, col.Submit([]*model.Measurement{
+		broken,
+		makeStoredMeasurement(time.Now()),
+		makeStoredMeasurement(time.Now()),
+	}))
+	stats, err := q.Stats()
+	if assert.NoError(t, err) {
+		assert.Equal(t, relayqueue.Stats{Pending: 2, Dead: 0}, stats)
+	}
+}
+
+func TestCollectorQueuesWhileRelayingIsOff(t *testing.T) {
+	fb, cm := newFakeOONIBackend(t)
+	cfg := config.NewConfig()
+	q, err := relayqueue.New(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.SetPaused(true)
+	col := collector.NewCollector(cfg, nil)
+	col.SetRelay(cm)
+	col.SetRelayQueue(q)
+
+	// the reports that were on their way upstream wait in the queue.
+	assert.True(t, col.Submit([]*model.Measurement{makeStoredMeasurement(time.Now())}))
+	assert.Equal(t, 0, fb.opened)
+	stats, err := q.Stats()
+	if assert.NoError(t, err) {
+		assert.Equal(t, relayqueue.Stats{Pending: 1, Dead: 0}, stats)
+	}
+
+	// without a queue, there's nowhere to keep them.
+	assert.False(t, collector.NewCollector(cfg, nil).Submit([]*model.Measurement{makeStoredMeasurement(time.Now())}))
+}
+
+func TestUndrainedBacklogIsQueued(t *testing.T) {
+	fb, cm := newFakeOONIBackend(t)
+	cfg := config.NewConfig()
+	cfg.RelayToOONI = true
+	q, err := relayqueue.New(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	col := collector.NewCollector(cfg, nil)
+	col.SetRelay(cm)
+	col.SetRelayQueue(q)
+
+	// the workers are never started, so nothing is drained before the deadline.
+	d := server.NewDispatcher(col, 1, 2)
+	assert.NoError(t, d.Dispatch(makeStoredMeasurement(time.Now())))
+	assert.NoError(t, d.Dispatch(makeStoredMeasurement(time.Now())))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	left, err := d.Close(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, left, 2)
+
+	col.DeferRelays()
+	assert.True(t, col.Submit(left))
+	assert.Equal(t, 0, fb.opened)
+	stats, err := q.Stats()
+	if assert.NoError(t, err) {
+		assert.Equal(t, relayqueue.Stats{Pending: 2, Dead: 0}, stats)
+	}
+}
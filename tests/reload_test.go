@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigDiff(t *testing.T) {
+	a := config.NewConfig()
+	b := config.NewConfig()
+	assert.Empty(t, config.Diff(a, b))
+
+	b.CollectorID = "collector-b"
+	b.ListenAddr = ":9090"
+	b.RelayReportMaxAge = 2 * time.Hour
+	b.TrustedProxies = []string{"10.0.0.0/8"}
+	assert.Equal(t, []string{"CollectorID", "ListenAddr", "RelayReportMaxAge", "TrustedProxies"}, config.Diff(a, b))
+}
+
+func TestHandlerSetConfig(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	h := server.NewHandler(collector.NewFileSystemCollector(cfg), &mockSubmitter{})
+	h.SetConfig(cfg)
+	e := server.NewEchoServer(cfg)
+	e.POST("/report", h.CreateReport)
+
+	post := func() int {
+		report := makeReport(&reportData{
+			Type:      "tunnel-telemetry",
+			Timestamp: makeTimestampForYesterday(),
+			Endpoint:  "ss://1.1.1.1:443",
+		})
+		report = strings.Replace(report, "{", `{"color": "blue", `, 1)
+		req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(report))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusCreated, post())
+
+	// the new config applies to the next requests.
+	strict := *cfg
+	strict.StrictDecoding = true
+	h.SetConfig(&strict)
+	assert.Equal(t, http.StatusBadRequest, post())
+}
+
+func TestRelayIsLive(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	cfg.RelayToOONI = true
+	col := collector.NewFileSystemCollector(cfg)
+	submitter := &mockSubmitter{}
+	h := server.NewHandler(col, submitter)
+	h.SetConfig(cfg)
+	e := server.NewEchoServer(cfg)
+	e.POST("/report", h.CreateReport)
+
+	post := func() {
+		report := makeReport(&reportData{
+			Type:      "tunnel-telemetry",
+			Timestamp: makeTimestampForYesterday(),
+			Endpoint:  "ss://1.1.1.1:443",
+		})
+		req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(report))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if !assert.Equal(t, http.StatusCreated, rec.Code) {
+			t.Fatal(rec.Body.String())
+		}
+	}
+	post()
+	assert.Len(t, submitter.submitted, 1)
+
+	// reports are only stored while relaying is off.
+	next := *cfg
+	next.RelayToOONI = false
+	col.SetConfig(&next)
+	h.SetConfig(&next)
+	post()
+	assert.Len(t, submitter.submitted, 1)
+
+	next.RelayToOONI = true
+	h.SetConfig(&next)
+	post()
+	assert.Len(t, submitter.submitted, 2)
+}
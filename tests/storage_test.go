@@ -0,0 +1,219 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeStoredMeasurement(ts time.Time) *model.Measurement {
+	m := model.NewMeasurement()
+	m.Type = "tunnel-telemetry"
+	m.UUID = uuid.New().String()
+	m.TimeStart = &ts
+	m.Protocol = "ss"
+	m.EndpointPort = 443
+	m.ClientASN = "AS3215"
+	m.ClientCC = "FR"
+	return m
+}
+
+func testStorageBackend(t *testing.T, backend string) {
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.StorageBackend = backend
+
+	store, err := collector.NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	m1 := makeStoredMeasurement(now.Add(-2 * time.Hour))
+	m2 := makeStoredMeasurement(now.Add(-1 * time.Hour))
+	m3 := makeStoredMeasurement(now)
+	for _, m := range []*model.Measurement{m3, m1, m2} {
+		assert.NoError(t, store.Save(m))
+	}
+
+	// a stored measurement cannot be replaced.
+	dup := *m2
+	dup.ClientASN = "AS1234"
+	assert.ErrorIs(t, store.Save(&dup), model.ErrDuplicate)
+
+	// but the OONI measurement ID can be set once it's relayed.
+	ooid := "20240422144155.458035_FR_tunneltelemetry_84954cf1a5baeb91"
+	assert.NoError(t, store.SetOONIID(m2.UUID, ooid, "https://explorer.ooni.org/m/"+ooid))
+	assert.ErrorIs(t, store.SetOONIID(uuid.New().String(), ooid, ""), model.ErrNotFound)
+
+	got, err := store.Get(m2.UUID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ooid, got.OOID)
+		assert.Equal(t, "https://explorer.ooni.org/m/"+ooid, got.OOIDLink)
+		if assert.NotNil(t, got.TimeRelayed) {
+			assert.WithinDuration(t, time.Now(), *got.TimeRelayed, time.Minute)
+		}
+		assert.Equal(t, "AS3215", got.ClientASN)
+	}
+
+	_, err = store.Get(uuid.New().String())
+	assert.ErrorIs(t, err, model.ErrNotFound)
+
+	all, err := store.List(&model.Query{})
+	if assert.NoError(t, err) && assert.Len(t, all, 3) {
+		assert.Equal(t, m1.UUID, all[0].UUID)
+		assert.Equal(t, m2.UUID, all[1].UUID)
+		assert.Equal(t, m3.UUID, all[2].UUID)
+	}
+
+	since := now.Add(-90 * time.Minute)
+	until := now
+	window, err := store.List(&model.Query{Since: &since, Until: &until})
+	if assert.NoError(t, err) && assert.Len(t, window, 1) {
+		assert.Equal(t, m2.UUID, window[0].UUID)
+	}
+
+	limited, err := store.List(&model.Query{Limit: 2})
+	if assert.NoError(t, err) {
+		assert.Len(t, limited, 2)
+	}
+
+	assert.NoError(t, store.Delete(m1.UUID))
+	assert.ErrorIs(t, store.Delete(m1.UUID), model.ErrNotFound)
+	_, err = store.Get(m1.UUID)
+	assert.ErrorIs(t, err, model.ErrNotFound)
+
+	// we can keep writing after a delete.
+	m4 := makeStoredMeasurement(now)
+	assert.NoError(t, store.Save(m4))
+	all, err = store.List(&model.Query{})
+	if assert.NoError(t, err) {
+		assert.Len(t, all, 3)
+	}
+}
+
+func TestFileSystemStorage(t *testing.T) {
+	testStorageBackend(t, collector.StorageFileSystem)
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	testStorageBackend(t, collector.StorageSQLite)
+}
+
+func TestUnknownStorageBackendFails(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.StorageBackend = "mongodb"
+	_, err := collector.NewStorage(cfg)
+	assert.Error(t, err)
+}
+
+func TestCollectorsWithSimilarIDsDoNotShareStorage(t *testing.T) {
+	dataDir := t.TempDir()
+	for _, backend := range []string{collector.StorageFileSystem, collector.StorageSQLite} {
+		open := func(id string) model.Storage {
+			cfg := config.NewConfig()
+			cfg.DataDir = dataDir
+			cfg.StorageBackend = backend
+			cfg.CollectorID = id
+			store, err := collector.NewStorage(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		}
+		// both IDs are "eu_1" once sanitized.
+		eu1, other := open("eu/1"), open("eu.1")
+		m := makeStoredMeasurement(time.Now())
+		assert.NoError(t, eu1.Save(m))
+		_, err := other.Get(m.UUID)
+		assert.ErrorIs(t, err, model.ErrNotFound, backend)
+	}
+}
+
+func TestFileSystemStorageRecoversFromTruncatedLine(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.StorageBackend = collector.StorageFileSystem
+
+	store, err := collector.NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1 := makeStoredMeasurement(time.Now())
+	assert.NoError(t, store.Save(m1))
+	store.Close()
+
+	// a crash cut the last line short.
+	files, err := filepath.Glob(filepath.Join(cfg.DataDir, "*.jsonl"))
+	if err != nil || len(files) != 1 {
+		t.Fatal("expected a single file", files, err)
+	}
+	f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"report-type": "tunnel-tel`)
+	f.Close()
+
+	store, err = collector.NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	m2 := makeStoredMeasurement(time.Now())
+	assert.NoError(t, store.Save(m2))
+	for _, m := range []*model.Measurement{m1, m2} {
+		_, err := store.Get(m.UUID)
+		assert.NoError(t, err)
+	}
+}
+
+func TestFileSystemStorageGetsTheLastVersion(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.StorageBackend = collector.StorageFileSystem
+
+	store, err := collector.NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1, m2 := makeStoredMeasurement(time.Now()), makeStoredMeasurement(time.Now())
+	assert.NoError(t, store.Save(m1))
+	assert.NoError(t, store.Save(m2))
+	assert.NoError(t, store.SetOONIID(m2.UUID, "first", ""))
+	assert.NoError(t, store.SetOONIID(m2.UUID, "second", ""))
+	store.Close()
+
+	// the index is loaded again from the files.
+	store, err = collector.NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	got, err := store.Get(m2.UUID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "second", got.OOID)
+	}
+
+	// deleting a report moves the lines after it.
+	assert.NoError(t, store.Delete(m1.UUID))
+	got, err = store.Get(m2.UUID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "second", got.OOID)
+	}
+	assert.NoError(t, store.SetOONIID(m2.UUID, "third", ""))
+	got, err = store.Get(m2.UUID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "third", got.OOID)
+	}
+}
@@ -0,0 +1,271 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ainghazal/tunnel-telemetry/internal/apikeys"
+	"github.com/ainghazal/tunnel-telemetry/internal/collector"
+	"github.com/ainghazal/tunnel-telemetry/internal/config"
+	"github.com/ainghazal/tunnel-telemetry/internal/server"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCert is a certificate, signed by parent (or self-signed, if parent is nil).
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (tc *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.cert.Raw})
+}
+
+func (tc *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(tc.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (tc *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(tc.certPEM(), tc.keyPEM(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeTestCert(t *testing.T, tc *testCert, certFile, keyFile string, modTime time.Time) {
+	assert.NoError(t, os.WriteFile(certFile, tc.certPEM(), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, tc.keyPEM(t), 0o600))
+	assert.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	assert.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, newTestCert(t, "first", nil, false), certFile, keyFile, time.Now().Add(-time.Minute))
+
+	certs, err := server.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		cert, err := certs.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	assert.Equal(t, "first", served())
+
+	writeTestCert(t, newTestCert(t, "second", nil, false), certFile, keyFile, time.Now())
+	assert.NoError(t, certs.Reload())
+	assert.Equal(t, "second", served())
+
+	// a broken file does not replace the current certificate.
+	assert.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	assert.Error(t, certs.Reload())
+	assert.Equal(t, "second", served())
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "collectors CA", nil, true)
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, ca.certPEM(), 0o600))
+
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	cfg.TLSClientCA = caFile
+	cfg.TLSClientAuth = server.ClientAuthOptional
+	cfg.APIKeys = []config.APIKey{{App: "vpn-app", Key: "static-key"}}
+	keyring, err := apikeys.NewKeyring(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	col := collector.NewFileSystemCollector(cfg)
+	h := server.NewHandler(col, &mockSubmitter{})
+	e := server.NewEchoServer(cfg)
+	e.POST("/report", h.CreateReport, server.RequireAPIKey(keyring))
+	e.POST("/collector/report", h.CreateReport, server.RequireAPIKeyOrClientCert(keyring))
+	post := startClientCertServer(t, e, cfg, ca)
+
+	// without a key or a certificate, the report is not accepted.
+	resp, err := post("/collector/report", nil)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// a certificate is not a key, unless we accept certificates instead of keys.
+	collectorB := newTestCert(t, "collector-b", ca, false)
+	resp, err = post("/report", collectorB)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// a certificate signed by the CA authenticates another collector.
+	resp, err = post("/collector/report", collectorB)
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		m, err := parseMeasurementResponse(body)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "collector-b", m.Agent)
+		}
+	}
+
+	// a certificate from another CA does not authenticate anybody (the client does not
+	// even send it, since the server only asks for certificates from its CA).
+	resp, err = post("/collector/report", newTestCert(t, "intruder", newTestCert(t, "other CA", nil, true), false))
+	if err == nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestClientCertificatesWithoutKeys(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "collectors CA", nil, true)
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, ca.certPEM(), 0o600))
+
+	// accepting certificates instead of keys requires authentication, even without keys.
+	cfg := config.NewConfig()
+	cfg.DebugGeolocation = true
+	cfg.TLSClientCA = caFile
+	cfg.TLSClientAuth = server.ClientAuthOptional
+	cfg.TLSClientCertAuth = true
+	assert.True(t, apikeys.Enabled(cfg))
+	keyring, err := apikeys.NewKeyring(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	col := collector.NewFileSystemCollector(cfg)
+	h := server.NewHandler(col, &mockSubmitter{})
+	e := server.NewEchoServer(cfg)
+	e.POST("/report", h.CreateReport, server.RequireAPIKeyOrClientCert(keyring))
+	post := startClientCertServer(t, e, cfg, ca)
+
+	resp, err := post("/report", nil)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+	resp, err = post("/report", newTestCert(t, "collector-b", ca, false))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+}
+
+// startClientCertServer serves e over TLS, with a certificate signed by ca, and returns a
+// function that posts a report to it, with an optional client certificate.
+func startClientCertServer(t *testing.T, e *echo.Echo, cfg *config.Config, ca *testCert) func(string, *testCert) (*http.Response, error) {
+	srv := httptest.NewUnstartedServer(e)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{newTestCert(t, "server", ca, false).tlsCertificate(t)}}
+	assert.NoError(t, server.ConfigureClientAuth(srv.TLS, cfg))
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return func(path string, clientCert *testCert) (*http.Response, error) {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if clientCert != nil {
+			tlsConfig.Certificates = []tls.Certificate{clientCert.tlsCertificate(t)}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		report := makeReport(&reportData{
+			Type:      "tunnel-telemetry",
+			Timestamp: makeTimestampForYesterday(),
+			Endpoint:  "ss://1.1.1.1:443",
+		})
+		return client.Post(srv.URL+path, echo.MIMEApplicationJSON, strings.NewReader(report))
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	hostnames := []string{"collector.example.org", "collector.example.net"}
+	for _, tc := range []struct {
+		httpsAddr string
+		url       string
+		want      string
+	}{
+		{httpsAddr: ":443", url: "http://collector.example.org:80/report?x=1", want: "https://collector.example.org/report?x=1"},
+		{httpsAddr: ":8443", url: "http://collector.example.org:80/report?x=1", want: "https://collector.example.org:8443/report?x=1"},
+		{httpsAddr: ":443", url: "http://Collector.Example.NET/report", want: "https://collector.example.net/report"},
+		// the client chooses the Host header, so we never redirect to a host we don't serve.
+		{httpsAddr: ":443", url: "http://evil.example.com/report", want: "https://collector.example.org/report"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tc.url, nil)
+		rec := httptest.NewRecorder()
+		server.RedirectToHTTPS(tc.httpsAddr, hostnames).ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+		assert.Equal(t, tc.want, rec.Header().Get("Location"))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://evil.example.com/", nil)
+	rec := httptest.NewRecorder()
+	server.RedirectToHTTPS(":443", nil).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,49 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// buildTTReport builds the tt-report command, and returns the path to the binary.
+func buildTTReport(t *testing.T) string {
+	bin := filepath.Join(t.TempDir(), "tt-report")
+	out, err := exec.Command("go", "build", "-o", bin, "../cmd/tt-report").CombinedOutput()
+	if err != nil {
+		t.Fatalf("cannot build tt-report: %s\n%s", err, out)
+	}
+	return bin
+}
+
+func TestTTReportKeepsTheEndpoint(t *testing.T) {
+	bin := buildTTReport(t)
+	srv, submitter := newRecordingCollector(t)
+
+	// tt-report stamps the network of the host by default: we skip the geolocation, and
+	// the report comes with the network instead.
+	report := filepath.Join(t.TempDir(), "report.json")
+	data := fmt.Sprintf(`{"report-type": "tunnel-telemetry", "time": "%s", "endpoint": "ss://1.1.1.1:443", "client_asn": "AS3352", "client_cc": "ES"}`, makeTimestampForYesterday())
+	if err := os.WriteFile(report, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(bin, "--collector", srv.URL, "--skip-geolocation", report)
+	out, err := cmd.Output()
+	if !assert.NoError(t, err, string(out)) {
+		return
+	}
+	if assert.Len(t, submitter.submitted, 1) {
+		m := submitter.submitted[0]
+		assert.Equal(t, strings.TrimSpace(string(out)), m.UUID)
+		assert.Equal(t, "AS3352", m.ClientASN)
+		assert.Equal(t, "ss", m.Protocol)
+		assert.Equal(t, 443, m.EndpointPort)
+		assert.Equal(t, "AS13335", m.EndpointASN)
+	}
+}